@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+just enough CBOR (RFC 8949) to read what authenticators hand back during webauthn:
+attestation objects and COSE public keys. definite lengths only, which webauthn mandates.
+maps decode to map[interface{}]interface{} because COSE keys are integers e.g. -1, 3.
+integers come out as int64, byte strings []byte, text strings string.
+*/
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// decodes one item from the front of data, also returns whatever follows it
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORDepth(data, 0)
+}
+
+func decodeCBORDepth(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > 16 {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	// major type 7 uses info differently: simple values and floats
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		case 25, 26, 27:
+			size := 1 << (info - 24)
+			if len(data) < size {
+				return nil, nil, errCBORTruncated
+			}
+			return nil, data[size:], nil // floats never needed, skip over them
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	argument, data, err := readCBORArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		return int64(argument), data, nil
+	case 1:
+		return -1 - int64(argument), data, nil
+	case 2, 3:
+		if uint64(len(data)) < argument {
+			return nil, nil, errCBORTruncated
+		}
+		raw := data[:argument]
+		if major == 3 {
+			return string(raw), data[argument:], nil
+		}
+		return append([]byte{}, raw...), data[argument:], nil
+	case 4:
+		array := make([]interface{}, 0)
+		for idx := uint64(0); idx < argument; idx++ {
+			var element interface{}
+			element, data, err = decodeCBORDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, element)
+		}
+		return array, data, nil
+	case 5:
+		cborMap := make(map[interface{}]interface{})
+		for idx := uint64(0); idx < argument; idx++ {
+			var key, value interface{}
+			key, data, err = decodeCBORDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			// cose and attestation only key by int or text; an array or map key would
+			// panic as a go map key
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: %T map keys unsupported", key)
+			}
+			value, data, err = decodeCBORDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			cborMap[key] = value
+		}
+		return cborMap, data, nil
+	case 6:
+		// tag: don't care about the tag itself, only what it wraps
+		return decodeCBORDepth(data, depth+1)
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+func readCBORArgument(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, nil, errCBORTruncated
+		}
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, nil, errors.New("cbor: indefinite lengths unsupported")
+}
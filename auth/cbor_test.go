@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// the encoding side of cbor.go, only needed to play authenticator in tests. map keys
+// are written in sorted order so output is deterministic
+func encodeCBOR(value interface{}) []byte {
+	switch typed := value.(type) {
+	case int:
+		return encodeCBOR(int64(typed))
+	case int64:
+		if typed < 0 {
+			return cborHead(1, uint64(-1-typed))
+		}
+		return cborHead(0, uint64(typed))
+	case []byte:
+		return append(cborHead(2, uint64(len(typed))), typed...)
+	case string:
+		return append(cborHead(3, uint64(len(typed))), typed...)
+	case []interface{}:
+		encoded := cborHead(4, uint64(len(typed)))
+		for _, element := range typed {
+			encoded = append(encoded, encodeCBOR(element)...)
+		}
+		return encoded
+	case map[interface{}]interface{}:
+		pairs := make([][2][]byte, 0, len(typed))
+		for key, element := range typed {
+			pairs = append(pairs, [2][]byte{encodeCBOR(key), encodeCBOR(element)})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i][0], pairs[j][0]) < 0 })
+		encoded := cborHead(5, uint64(len(typed)))
+		for _, pair := range pairs {
+			encoded = append(append(encoded, pair[0]...), pair[1]...)
+		}
+		return encoded
+	case bool:
+		if typed {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+func cborHead(major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return []byte{major<<5 | byte(argument)}
+	case argument <= 0xff:
+		return []byte{major<<5 | 24, byte(argument)}
+	case argument <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(argument))
+	case argument <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(argument))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, argument)
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+		want    interface{}
+	}{
+		{"small uint", []byte{0x0a}, int64(10)},
+		{"uint8", []byte{0x18, 0x64}, int64(100)},
+		{"uint16", []byte{0x19, 0x03, 0xe8}, int64(1000)},
+		{"uint32", []byte{0x1a, 0x00, 0x0f, 0x42, 0x40}, int64(1000000)},
+		{"uint64", []byte{0x1b, 0, 0, 0, 0xe8, 0xd4, 0xa5, 0x10, 0x00}, int64(1000000000000)},
+		{"negative", []byte{0x20}, int64(-1)},
+		{"cose rs256", []byte{0x39, 0x01, 0x00}, int64(-257)},
+		{"byte string", []byte{0x43, 1, 2, 3}, []byte{1, 2, 3}},
+		{"text string", []byte{0x63, 'a', 'l', 'g'}, "alg"},
+		{"array", []byte{0x83, 0x01, 0x02, 0x03}, []interface{}{int64(1), int64(2), int64(3)}},
+		{"map with int keys", []byte{0xa2, 0x01, 0x02, 0x20, 0x41, 0xff},
+			map[interface{}]interface{}{int64(1): int64(2), int64(-1): []byte{0xff}}},
+		{"true", []byte{0xf5}, true},
+		{"false", []byte{0xf4}, false},
+		{"null", []byte{0xf6}, nil},
+		{"tag unwrapped", []byte{0xc2, 0x41, 0x01}, []byte{0x01}},
+		{"half float skipped", []byte{0xf9, 0x3c, 0x00}, nil},
+		{"round trip", encodeCBOR(map[interface{}]interface{}{
+			"fmt": "none", "attStmt": map[interface{}]interface{}{}, "authData": []byte{9, 9},
+		}), map[interface{}]interface{}{
+			"fmt": "none", "attStmt": map[interface{}]interface{}{}, "authData": []byte{9, 9},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, rest, err := decodeCBOR(test.encoded)
+			if err != nil {
+				t.Fatalf("decodeCBOR(% x): %v", test.encoded, err)
+			}
+			if len(rest) != 0 {
+				t.Errorf("left % x undecoded", rest)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORReturnsTrailingBytes(t *testing.T) {
+	got, rest, err := decodeCBOR([]byte{0x01, 0x02, 0x03})
+	if err != nil || got != int64(1) || !bytes.Equal(rest, []byte{0x02, 0x03}) {
+		t.Fatalf("got %v, rest % x, err %v", got, rest, err)
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x81}, 20)
+	deep = append(deep, 0x01)
+	tests := []struct {
+		name    string
+		encoded []byte
+	}{
+		{"empty", []byte{}},
+		{"uint8 missing argument", []byte{0x18}},
+		{"uint16 short", []byte{0x19, 0x01}},
+		{"uint32 short", []byte{0x1a, 0x01, 0x02}},
+		{"uint64 short", []byte{0x1b, 0x01}},
+		{"byte string longer than data", []byte{0x45, 1, 2}},
+		{"huge byte string length", []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"text string longer than data", []byte{0x62, 'a'}},
+		{"array missing elements", []byte{0x83, 0x01}},
+		{"map missing value", []byte{0xa1, 0x01}},
+		{"byte string map key", []byte{0xa1, 0x41, 0x01, 0x01}},
+		{"array map key", []byte{0xa1, 0x80, 0x01}},
+		{"map map key", []byte{0xa1, 0xa0, 0x01}},
+		{"tagged array map key", []byte{0xa1, 0xc2, 0x80, 0x01}},
+		{"bool map key", []byte{0xa1, 0xf5, 0x01}},
+		{"indefinite length array", []byte{0x9f, 0x01, 0xff}},
+		{"indefinite length byte string", []byte{0x5f, 0x41, 0x01, 0xff}},
+		{"reserved additional info", []byte{0x1c}},
+		{"nested too deeply", deep},
+		{"tag without content", []byte{0xc2}},
+		{"float truncated", []byte{0xfa, 0x00}},
+		{"unsupported simple value", []byte{0xf0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, _, err := decodeCBOR(test.encoded); err == nil {
+				t.Errorf("decodeCBOR(% x) = %#v, want an error", test.encoded, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+terms of service, privacy policy etc. every edit is a new document with a higher version,
+old versions are never changed so there is always a record of exactly what a user agreed
+to. documents go into the legalDocuments collection by hand (mongo shell) for now.
+*/
+type LegalDocument struct {
+	Kind        string    `bson:"kind" json:"kind"` // e.g. "terms", "privacy"
+	Version     int       `bson:"version" json:"version"`
+	Title       string    `bson:"title" json:"title"`
+	URL         string    `bson:"url" json:"url"`
+	Required    bool      `bson:"required" json:"required"`
+	PublishedAt time.Time `bson:"publishedAt" json:"publishedAt"`
+}
+
+// append only history in field consents of a users document, never overwritten
+type Consent struct {
+	Kind       string    `bson:"kind" json:"kind"`
+	Version    int       `bson:"version" json:"version"`
+	AcceptedAt time.Time `bson:"acceptedAt" json:"acceptedAt"`
+	IP         string    `bson:"ip" json:"ip"`
+	UserAgent  string    `bson:"userAgent" json:"userAgent"`
+}
+
+// code clients can switch on to show the accept terms screen
+const ConsentRequiredCode = "consent_required"
+
+// highest published version of each kind. documents with publishedAt in
+// the future aren't returned so a new version can be staged ahead of time
+func LatestLegalDocuments(lCollection *mongo.Collection) (map[string]LegalDocument, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cursor, err := lCollection.Find(ctx,
+		bson.D{{Key: "publishedAt", Value: bson.D{{Key: "$lte", Value: time.Now()}}}},
+		options.Find().SetSort(bson.D{{Key: "version", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var documents []LegalDocument
+	if err = cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	latest := make(map[string]LegalDocument)
+	for _, document := range documents {
+		latest[document.Kind] = document // sorted ascending so last one wins
+	}
+	return latest, nil
+}
+
+// required documents whose latest version doesn't appear in consents
+func outstandingConsents(consents []Consent,
+	latest map[string]LegalDocument) []LegalDocument {
+	accepted := make(map[string]bool)
+	for _, consent := range consents {
+		accepted[fmt.Sprintf("%s:%d", consent.Kind, consent.Version)] = true
+	}
+	outstanding := []LegalDocument{}
+	for kind, document := range latest {
+		if document.Required && !accepted[fmt.Sprintf("%s:%d", kind, document.Version)] {
+			outstanding = append(outstanding, document)
+		}
+	}
+	return outstanding
+}
+
+func newConsent(kind string, version int, r *http.Request) Consent {
+	return Consent{
+		Kind:       kind,
+		Version:    version,
+		AcceptedAt: time.Now(),
+		IP:         r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	}
+}
+
+/*
+pulls e.g. "termsVersion": "3" out of the register body for every current legal document.
+only the latest version can be accepted; anything else is a field error because a client
+showing an old version means the user never saw what they'd be agreeing to.
+*/
+func ConsentsFromRegistration(userInputMap map[string]string, r *http.Request,
+	lCollection *mongo.Collection, fieldErrs FieldErrors) []Consent {
+	latest, err := LatestLegalDocuments(lCollection)
+	if err != nil {
+		fmt.Printf("couldn't load legal documents: %v\n", err)
+		return nil
+	}
+	consents := []Consent{}
+	for kind, document := range latest {
+		field := kind + "Version"
+		given, supplied := userInputMap[field]
+		if !supplied {
+			continue // ConsentMiddleware will hold them up until they accept
+		}
+		version, err := strconv.Atoi(given)
+		if err != nil || version != document.Version {
+			fieldErrs.Add(field, fmt.Sprintf("current %s version is %d", kind, document.Version))
+			continue
+		}
+		consents = append(consents, newConsent(kind, version, r))
+	}
+	return consents
+}
+
+/*
+sits after AuthMiddleware on protected routes. 403 with code consent_required and the
+documents still to accept, until the user has accepted the latest version of every
+required one. publishing a new required version therefore blocks everyone until they
+re-accept through AcceptConsent, which is deliberately not behind this middleware.
+*/
+func ConsentMiddleware(collections ...*mongo.Collection) func(http.Handler) http.Handler {
+	// collections[0] is session collections[1] is user collections[2] is legal documents
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := SessionUser(r, collections[0])
+			if err != nil || len(user) == 0 {
+				RespondError(w, http.StatusUnauthorized, "no valid session")
+				return
+			}
+			latest, err := LatestLegalDocuments(collections[2])
+			if err != nil {
+				RespondError(w, http.StatusInternalServerError, "could not load legal documents")
+				return
+			}
+			var userDoc struct {
+				Consents []Consent `bson:"consents"`
+			}
+			err = collections[1].FindOne(context.TODO(),
+				bson.D{{Key: "user", Value: user}}).Decode(&userDoc)
+			if err != nil && err != mongo.ErrNoDocuments {
+				RespondError(w, http.StatusInternalServerError, "could not load consents")
+				return
+			}
+			if outstanding := outstandingConsents(userDoc.Consents, latest); len(outstanding) > 0 {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error":    "accept the latest terms to continue",
+					"code":     ConsentRequiredCode,
+					"required": outstanding,
+				})
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// latest version of every legal document, for showing before register or re-accept
+func GetLegalDocuments(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is legal documents
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		latest, err := LatestLegalDocuments(collections[0])
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not load legal documents")
+			return
+		}
+		json.NewEncoder(w).Encode(latest)
+	})
+}
+
+// body {"kind": "terms", "version": 3} from a logged in user
+func AcceptConsent(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is user collections[2] is legal documents
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		user, err := SessionUser(r, collections[0])
+		if err != nil || len(user) == 0 {
+			RespondError(w, http.StatusUnauthorized, "log in to accept terms")
+			return
+		}
+		var accepted struct {
+			Kind    string `json:"kind"`
+			Version int    `json:"version"`
+		}
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(bodyBytes, &accepted)
+		}
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, "body must be {\"kind\": ..., \"version\": ...}")
+			return
+		}
+		latest, err := LatestLegalDocuments(collections[2])
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not load legal documents")
+			return
+		}
+		document, found := latest[accepted.Kind]
+		if !found || document.Version != accepted.Version {
+			fieldErrs := make(FieldErrors)
+			fieldErrs.Add("version", "only the latest published version can be accepted")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": fieldErrs})
+			return
+		}
+		consent := newConsent(accepted.Kind, accepted.Version, r)
+		_, err = collections[1].UpdateOne(context.TODO(),
+			bson.D{{Key: "user", Value: user}},
+			bson.D{{Key: "$push", Value: bson.D{{Key: "consents", Value: consent}}}})
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not record consent")
+			return
+		}
+		json.NewEncoder(w).Encode(consent)
+	})
+}
@@ -7,18 +7,12 @@ import (
 	"math/rand"
 	"time"
 
-	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func init() {
-	// need .env file in this directory
-	err := godotenv.Load("./.env")
-	if err != nil {
-		log.Fatal(err)
-	}
-}
+// settings come from the environment; the program's main loads ./.env into it before
+// anything here reads it
 
 const cookieCharacters = "abcdefghijklmnopqrstuvwxyz" +
 	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -92,7 +86,7 @@ func DeleteSessionTimeout(session bson.M, sCollection *mongo.Collection) {
 // just don't dispatch a deletion scheduled after 90 second
 // no timeout on InsertOne either because important that user is registered in db
 func CreateNewUser(channel chan<- *mongo.InsertOneResult, userInfo map[string]string,
-	uCollection *mongo.Collection) {
+	consents []Consent, uCollection *mongo.Collection) {
 	/*
 		user documents have field "user" and "password" for now. if want "email" will need
 		an index with unique:true on both fields "user" and "email"
@@ -102,6 +96,11 @@ func CreateNewUser(channel chan<- *mongo.InsertOneResult, userInfo map[string]st
 	userDocument := make(bson.M)
 	userDocument["user"] = userInfo["user"]
 	userDocument["pwd"] = pwdSaltedHashed
+	if email := normaliseEmail(userInfo["email"]); len(email) > 0 {
+		userDocument["email"] = email
+	}
+	// terms accepted at sign up, ConsentMiddleware checks these later
+	userDocument["consents"] = consents
 	newUser, err := uCollection.InsertOne(context.TODO(), userDocument)
 	if err != nil {
 		fmt.Println("mongo error inserting new user record")
@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+data subject requests: export everything held about a user, or erase it. both can touch
+a lot of documents so the handler only records a job in the jobs collection and a
+goroutine does the work; client polls the job until status is done or failed.
+
+every collection holding personal data is a PersonalDataSource. adding e.g. an orders
+collection later means appending one more source in main.go, nothing in here changes.
+*/
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	JobExport = "export"
+	JobErase  = "erase"
+
+	EraseDelete       = "delete"
+	ErasePseudonymise = "pseudonymise" // keep document (e.g. orders for tax) but unlink user
+)
+
+type PersonalDataSource struct {
+	Collection *mongo.Collection
+	UserField  string // field holding the username, "user" in every collection so far
+	OnErase    string // EraseDelete or ErasePseudonymise
+}
+
+type Job struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Kind       string             `bson:"kind" json:"kind"`
+	User       string             `bson:"user" json:"-"`
+	Status     string             `bson:"status" json:"status"`
+	Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+	Archive    string             `bson:"archive,omitempty" json:"-"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	FinishedAt *time.Time         `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+}
+
+// EXPORT_DIR in .env, archives are written here and served from here
+func exportDir() string {
+	if dir := os.Getenv("EXPORT_DIR"); len(dir) > 0 {
+		return dir
+	}
+	return "./exports"
+}
+
+// stable per user so pseudonymised documents of one user still group together,
+// salted so the pseudonym can't be reversed by hashing candidate usernames
+func Pseudonym(user string) string {
+	hashed := sha256.Sum256([]byte(user + os.Getenv("SALT")))
+	return "erased-" + hex.EncodeToString(hashed[:8])
+}
+
+func finishJob(jobID primitive.ObjectID, jCollection *mongo.Collection, jobErr error,
+	extra bson.D) {
+	update := bson.D{{Key: "finishedAt", Value: time.Now()}}
+	if jobErr != nil {
+		update = append(update, bson.E{Key: "status", Value: JobFailed},
+			bson.E{Key: "error", Value: jobErr.Error()})
+	} else {
+		update = append(update, bson.E{Key: "status", Value: JobDone})
+		update = append(update, extra...)
+	}
+	_, err := jCollection.UpdateByID(context.TODO(), jobID,
+		bson.D{{Key: "$set", Value: update}})
+	if err != nil {
+		fmt.Printf("couldn't record outcome of job %s: %v\n", jobID.Hex(), err)
+	}
+}
+
+func markRunning(jobID primitive.ObjectID, jCollection *mongo.Collection) {
+	jCollection.UpdateByID(context.TODO(), jobID,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: JobRunning}}}})
+}
+
+/*
+spawned as a goroutine. archive is {"user", "generatedAt", "collections": {name: [docs]}}
+with documents as relaxed extended json so ObjectIDs and dates survive readable.
+password hashes are left out: not useful to the user and only a risk if the file leaks.
+*/
+func RunExportJob(job Job, sources []PersonalDataSource, jCollection *mongo.Collection) {
+	markRunning(job.ID, jCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	collected := make(map[string][]json.RawMessage)
+	for _, source := range sources {
+		cursor, err := source.Collection.Find(ctx, bson.D{{Key: source.UserField, Value: job.User}})
+		if err != nil {
+			finishJob(job.ID, jCollection, err, nil)
+			return
+		}
+		documents := []json.RawMessage{}
+		for cursor.Next(ctx) {
+			var document bson.M
+			if err = cursor.Decode(&document); err != nil {
+				finishJob(job.ID, jCollection, err, nil)
+				return
+			}
+			delete(document, "pwd")
+			extJSON, err := bson.MarshalExtJSON(document, false, false)
+			if err != nil {
+				finishJob(job.ID, jCollection, err, nil)
+				return
+			}
+			documents = append(documents, extJSON)
+		}
+		cursor.Close(ctx)
+		collected[source.Collection.Name()] = documents
+	}
+
+	archive, err := json.MarshalIndent(map[string]interface{}{
+		"user":        job.User,
+		"generatedAt": time.Now(),
+		"collections": collected,
+	}, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(exportDir(), 0o700)
+	}
+	fileName := job.ID.Hex() + ".json"
+	if err == nil {
+		err = os.WriteFile(filepath.Join(exportDir(), fileName), archive, 0o600)
+	}
+	finishJob(job.ID, jCollection, err, bson.D{{Key: "archive", Value: fileName}})
+}
+
+/*
+spawned as a goroutine. each source either loses the user's documents or has the user
+field swapped for a pseudonym. the user document itself is always pseudonymised not
+deleted, and keeps its consents: still need proof of what they agreed to while they
+were a customer. credentials go, so nobody can log in as the erased user again.
+earlier export archives are a copy of everything, so their files are deleted and every
+job of the user's is pseudonymised.
+*/
+func RunEraseJob(job Job, sources []PersonalDataSource, uCollection,
+	jCollection *mongo.Collection) {
+	markRunning(job.ID, jCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	pseudonym := Pseudonym(job.User)
+
+	for _, source := range sources {
+		if source.Collection.Name() == uCollection.Name() {
+			continue // handled below
+		}
+		filter := bson.D{{Key: source.UserField, Value: job.User}}
+		var err error
+		switch source.OnErase {
+		case EraseDelete:
+			_, err = source.Collection.DeleteMany(ctx, filter)
+		case ErasePseudonymise:
+			_, err = source.Collection.UpdateMany(ctx, filter, bson.D{{Key: "$set",
+				Value: bson.D{{Key: source.UserField, Value: pseudonym}}}})
+		}
+		if err != nil {
+			finishJob(job.ID, jCollection, err, nil)
+			return
+		}
+	}
+
+	if err := eraseJobs(ctx, job.User, pseudonym, jCollection); err != nil {
+		finishJob(job.ID, jCollection, err, nil)
+		return
+	}
+
+	_, err := uCollection.UpdateOne(ctx, bson.D{{Key: "user", Value: job.User}},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "user", Value: pseudonym},
+				{Key: "erasedAt", Value: time.Now()},
+			}},
+			{Key: "$unset", Value: bson.D{
+				{Key: "pwd", Value: ""},
+				{Key: "email", Value: ""},
+				{Key: "webauthnCredentials", Value: ""},
+			}},
+		})
+	// job document shouldn't keep the name either
+	finishJob(job.ID, jCollection, err, bson.D{{Key: "user", Value: pseudonym}})
+}
+
+// deletes user's export archives and swaps the name on their jobs for pseudonym
+func eraseJobs(ctx context.Context, user, pseudonym string, jCollection *mongo.Collection) error {
+	cursor, err := jCollection.Find(ctx, bson.D{
+		{Key: "user", Value: user},
+		{Key: "archive", Value: bson.D{{Key: "$exists", Value: true}}},
+	})
+	if err != nil {
+		return err
+	}
+	var exports []Job
+	if err = cursor.All(ctx, &exports); err != nil {
+		return err
+	}
+	for _, export := range exports {
+		err = os.Remove(filepath.Join(exportDir(), filepath.Base(export.Archive)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	_, err = jCollection.UpdateMany(ctx, bson.D{{Key: "user", Value: user}}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "user", Value: pseudonym}}},
+		{Key: "$unset", Value: bson.D{{Key: "archive", Value: ""}}},
+	})
+	return err
+}
+
+func createJob(kind, user string, jCollection *mongo.Collection) (Job, error) {
+	job := Job{Kind: kind, User: user, Status: JobPending, CreatedAt: time.Now()}
+	inserted, err := jCollection.InsertOne(context.TODO(), job)
+	if err != nil {
+		return job, err
+	}
+	job.ID = inserted.InsertedID.(primitive.ObjectID)
+	return job, nil
+}
+
+// POST /me/export, 202 with the job to poll
+func RequestExport(sources []PersonalDataSource, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is jobs
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		user, err := SessionUser(r, collections[0])
+		if err != nil || len(user) == 0 {
+			RespondError(w, http.StatusUnauthorized, "log in to export your data")
+			return
+		}
+		job, err := createJob(JobExport, user, collections[1])
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not create export job")
+			return
+		}
+		go RunExportJob(job, sources, collections[1])
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	})
+}
+
+/*
+POST /me/erase with body {"confirm": "ERASE"}, typed out so a stray request can't
+wipe an account. user is logged out as part of the job (sessions are deleted) so
+the 202 is the last thing they see from this account.
+*/
+func RequestErasure(sources []PersonalDataSource, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is user collections[2] is jobs
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		user, err := SessionUser(r, collections[0])
+		if err != nil || len(user) == 0 {
+			RespondError(w, http.StatusUnauthorized, "log in to erase your data")
+			return
+		}
+		var userInputMap map[string]string
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(bodyBytes, &userInputMap)
+		}
+		if err != nil || userInputMap["confirm"] != "ERASE" {
+			fieldErrs := make(FieldErrors)
+			fieldErrs.Add("confirm", "must be ERASE")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": fieldErrs})
+			return
+		}
+		job, err := createJob(JobErase, user, collections[2])
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not create erasure job")
+			return
+		}
+		go RunEraseJob(job, sources, collections[1], collections[2])
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	})
+}
+
+func findOwnJob(r *http.Request, collections ...*mongo.Collection) (Job, int, string) {
+	var job Job
+	user, err := SessionUser(r, collections[0])
+	if err != nil || len(user) == 0 {
+		return job, http.StatusUnauthorized, "no valid session"
+	}
+	jobID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return job, http.StatusNotFound, "no such job"
+	}
+	// filter on user too: someone else's job is indistinguishable from no job
+	err = collections[1].FindOne(context.TODO(), bson.D{
+		{Key: "_id", Value: jobID}, {Key: "user", Value: user},
+	}).Decode(&job)
+	if err != nil {
+		return job, http.StatusNotFound, "no such job"
+	}
+	return job, http.StatusOK, ""
+}
+
+// GET /me/jobs/{id}
+func GetJobStatus(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is jobs
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		job, status, msg := findOwnJob(r, collections...)
+		if status != http.StatusOK {
+			RespondError(w, status, msg)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+	})
+}
+
+// GET /me/jobs/{id}/download, only for finished export jobs
+func DownloadExport(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is jobs
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job, status, msg := findOwnJob(r, collections...)
+		if status != http.StatusOK {
+			w.Header().Set("Content-Type", "application/json")
+			RespondError(w, status, msg)
+			return
+		}
+		if job.Kind != JobExport || job.Status != JobDone {
+			w.Header().Set("Content-Type", "application/json")
+			RespondError(w, http.StatusConflict, "export not ready")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"data-export-%s\"", job.Archive))
+		// archive name is generated by RunExportJob, never from the request
+		http.ServeFile(w, r, filepath.Join(exportDir(), job.Archive))
+	})
+}
@@ -3,7 +3,7 @@ module github.com/nicklhchang/gorilla-mongo-api/auth
 go 1.19
 
 require (
-	github.com/joho/godotenv v1.4.0
+	github.com/gorilla/mux v1.8.0
 	go.mongodb.org/mongo-driver v1.10.2
 )
 
@@ -16,7 +16,6 @@ require (
 	github.com/xdg-go/scram v1.1.1 // indirect
 	github.com/xdg-go/stringprep v1.0.3 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
-	go.mongodb.org/mongo-driver v1.10.2
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/text v0.3.7 // indirect
@@ -20,7 +20,7 @@ will place its goroutine into waiting state.
 https://stackoverflow.com/questions/43021058/golang-read-request-body-multiple-times
 */
 func Register(collections ...*mongo.Collection) http.Handler {
-	// collections[0] is user collections[1] is session
+	// collections[0] is session collections[1] is user collections[3] is legal documents
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// set http headers for when need to send response back
 		w.Header().Set("Content-Type", "application/json")
@@ -36,6 +36,18 @@ func Register(collections ...*mongo.Collection) http.Handler {
 		if err != nil {
 			fmt.Println("couldn't unmarshal the byte slice representation of JSON into a map")
 		}
+		// reject before touching db; every failed rule gets reported against its field
+		fieldErrs := LoadPasswordPolicy().Validate(userInputMap["user"], userInputMap["pwd"])
+		// email optional, but needed later for magic link login
+		if email := userInputMap["email"]; len(email) > 0 && !ValidEmail(normaliseEmail(email)) {
+			fieldErrs.Add("email", "not a valid email address")
+		}
+		consents := ConsentsFromRegistration(userInputMap, r, collections[3], fieldErrs)
+		if len(fieldErrs) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": fieldErrs})
+			return
+		}
 		// construct bson document that has user field to search for existence
 		var userAsBSOND bson.D
 		userAsBSOND = append(userAsBSOND, bson.E{Key: "user", Value: userInputMap["user"]})
@@ -50,12 +62,20 @@ func Register(collections ...*mongo.Collection) http.Handler {
 			fmt.Println(found, userAsBSOND)
 			return
 		}
+		// one user per email, otherwise a magic link can't know who to log in
+		if email := normaliseEmail(userInputMap["email"]); len(email) > 0 {
+			emailTaken, err := Exists(bson.D{{Key: "email", Value: email}}, collections[1])
+			if err != nil || emailTaken {
+				json.NewEncoder(w).Encode("email already registered")
+				return
+			}
+		}
 
 		// run the two creates using goroutines to leverage context switching while InsertOne
 		// is waiting (InsertOne blocks rest of Create...()); spawn goroutines for performance
 		userChan := make(chan *mongo.InsertOneResult)
 		sessionChan := make(chan string)
-		go CreateNewUser(userChan, userInputMap, collections[1])
+		go CreateNewUser(userChan, userInputMap, consents, collections[1])
 		go CreateNewSession(sessionChan, userInputMap, collections[0])
 
 		// prepare response while considering potential timeout
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+passwordless login by email. POST /auth/magic-link mails a link containing a signed token,
+GET on the callback consumes it and sets session-id. every link also gets a document in
+the magicLinks collection: that is what makes a token single use (signature alone can't)
+and what rate limiting per address counts against.
+
+from .env in this directory:
+  - MAGIC_LINK_KEY hmac key for tokens, falls back to SALT
+  - MAGIC_LINK_URL callback the email points at
+  - MAGIC_LINK_TTL_MINUTES how long a link works (default 15)
+  - MAGIC_LINK_MAX_PER_HOUR requests allowed per address per hour (default 3)
+*/
+
+type magicLinkClaims struct {
+	Email   string `json:"e"`
+	Nonce   string `json:"n"`
+	Expires int64  `json:"x"`
+}
+
+type MagicLink struct {
+	Nonce     string    `bson:"nonce"`
+	Email     string    `bson:"email"`
+	User      string    `bson:"user"`
+	CreatedAt time.Time `bson:"createdAt"` // TTL index on this cleans up old links
+	ExpiresAt time.Time `bson:"expiresAt"`
+	Used      bool      `bson:"used"`
+}
+
+// what the rate limit counts over, expired links are kept at least this long
+const magicLinkRateWindow = time.Hour
+
+func magicLinkTTL() time.Duration {
+	return time.Duration(envInt("MAGIC_LINK_TTL_MINUTES", 15)) * time.Minute
+}
+
+/*
+ttl index deleting links once the rate limit no longer counts them, or once they stop
+working if MAGIC_LINK_TTL_MINUTES is longer. replaces the one on expiresAt, which let
+links go after 15 minutes so the hourly limit was really per 15 minutes.
+*/
+func EnsureMagicLinkIndexes(mlCollection *mongo.Collection) error {
+	keep := magicLinkRateWindow
+	if magicLinkTTL() > keep {
+		keep = magicLinkTTL()
+	}
+	ctx := context.TODO()
+	indexes := mlCollection.Indexes()
+	indexes.DropOne(ctx, "expiresAt_1") // gone already on most databases
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetName("createdAt_ttl").SetExpireAfterSeconds(int32(keep.Seconds())),
+	}
+	if _, err := indexes.CreateOne(ctx, model); err == nil {
+		return nil
+	}
+	// MAGIC_LINK_TTL_MINUTES changed since the index was made, options can't be altered
+	indexes.DropOne(ctx, "createdAt_ttl")
+	_, err := indexes.CreateOne(ctx, model)
+	return err
+}
+
+func magicLinkKey() []byte {
+	if key := os.Getenv("MAGIC_LINK_KEY"); len(key) > 0 {
+		return []byte(key)
+	}
+	return []byte(os.Getenv("SALT"))
+}
+
+func normaliseEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func ValidEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	// ParseAddress accepts "name <a@b>", only want the bare address
+	return err == nil && address.Address == strings.TrimSpace(email)
+}
+
+// token is base64url(json claims) + "." + base64url(hmac-sha256 of first part)
+func signMagicLink(claims magicLinkClaims) (string, error) {
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claimsJSON)
+	mac := hmac.New(sha256.New, magicLinkKey())
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifyMagicLink(token string) (magicLinkClaims, error) {
+	var claims magicLinkClaims
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return claims, errors.New("malformed token")
+	}
+	givenMAC, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+	mac := hmac.New(sha256.New, magicLinkKey())
+	mac.Write([]byte(payload))
+	if !hmac.Equal(givenMAC, mac.Sum(nil)) {
+		return claims, errors.New("bad token signature")
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+	if err = json.Unmarshal(claimsJSON, &claims); err != nil {
+		return claims, errors.New("malformed token")
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, errors.New("link expired")
+	}
+	return claims, nil
+}
+
+func magicLinkURL(token string) string {
+	base := os.Getenv("MAGIC_LINK_URL")
+	if len(base) == 0 {
+		base = "http://localhost:8080/api/v1/auth/magic-link/callback"
+	}
+	return base + "?token=" + token
+}
+
+/*
+body {"email": "..."}. responds the same whether or not the address belongs to a user,
+otherwise this endpoint tells anyone which emails are registered. unknown addresses
+still get a magicLinks document (already used) so they count toward the rate limit.
+*/
+func RequestMagicLink(mailer Mailer, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is user collections[2] is magic links
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var userInputMap map[string]string
+		userInputBytes, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(userInputBytes, &userInputMap)
+		}
+		email := normaliseEmail(userInputMap["email"])
+		if err != nil || !ValidEmail(email) {
+			fieldErrs := make(FieldErrors)
+			fieldErrs.Add("email", "a valid email address is required")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": fieldErrs})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		now := time.Now()
+		recent, err := collections[2].CountDocuments(ctx, bson.D{
+			{Key: "email", Value: email},
+			{Key: "createdAt", Value: bson.D{{Key: "$gte", Value: now.Add(-magicLinkRateWindow)}}},
+		})
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not check recent links")
+			return
+		}
+		if recent >= int64(envInt("MAGIC_LINK_MAX_PER_HOUR", 3)) {
+			w.Header().Set("Retry-After", "3600")
+			RespondError(w, http.StatusTooManyRequests, "too many login links requested, try later")
+			return
+		}
+
+		var userDoc bson.M
+		err = collections[1].FindOne(ctx, bson.D{{Key: "email", Value: email}}).Decode(&userDoc)
+		if err != nil && err != mongo.ErrNoDocuments {
+			RespondError(w, http.StatusInternalServerError, "could not look up user")
+			return
+		}
+		user, _ := userDoc["user"].(string)
+
+		nonceBytes := make([]byte, 24)
+		if _, err = rand.Read(nonceBytes); err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not generate link")
+			return
+		}
+		link := MagicLink{
+			Nonce:     base64.RawURLEncoding.EncodeToString(nonceBytes),
+			Email:     email,
+			User:      user,
+			CreatedAt: now,
+			ExpiresAt: now.Add(magicLinkTTL()),
+			Used:      len(user) == 0,
+		}
+		if _, err = collections[2].InsertOne(ctx, link); err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not store link")
+			return
+		}
+		if len(user) > 0 {
+			token, err := signMagicLink(magicLinkClaims{
+				Email: email, Nonce: link.Nonce, Expires: link.ExpiresAt.Unix(),
+			})
+			if err == nil {
+				err = mailer.Send(email, "your login link", fmt.Sprintf(
+					"click to log in, link works once and expires at %s:\n\n%s\n",
+					link.ExpiresAt.Format(time.RFC1123), magicLinkURL(token)))
+			}
+			if err != nil {
+				fmt.Printf("couldn't send magic link to %s: %v\n", email, err)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode("if that address is registered a login link is on its way")
+	})
+}
+
+// GET ?token=... from the emailed link. marking the link used is atomic with
+// finding it, so two clicks racing each other can't both get a session
+func MagicLinkCallback(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is user collections[2] is magic links
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		claims, err := verifyMagicLink(r.URL.Query().Get("token"))
+		if err != nil {
+			RespondError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		var link MagicLink
+		err = collections[2].FindOneAndUpdate(context.TODO(),
+			bson.D{
+				{Key: "nonce", Value: claims.Nonce},
+				{Key: "email", Value: claims.Email},
+				{Key: "used", Value: false},
+				{Key: "expiresAt", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+			},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "used", Value: true},
+				{Key: "usedAt", Value: time.Now()},
+			}}},
+			options.FindOneAndUpdate().SetReturnDocument(options.Before),
+		).Decode(&link)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				RespondError(w, http.StatusUnauthorized, "link already used or expired")
+				return
+			}
+			RespondError(w, http.StatusInternalServerError, "could not redeem link")
+			return
+		}
+
+		sessionChan := make(chan string)
+		go CreateNewSession(sessionChan, map[string]string{"user": link.User}, collections[0])
+		var cookie string
+		select {
+		case cookie = <-sessionChan:
+		case <-time.After(2 * time.Second):
+			RespondError(w, http.StatusInternalServerError, "timed out creating session")
+			return
+		}
+		w.Header().Set("Set-Cookie", fmt.Sprintf("session-id=%s", cookie))
+		json.NewEncoder(w).Encode("logged in")
+	})
+}
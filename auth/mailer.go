@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// anything that can get a plain text email to an address. handlers only see this,
+// so swapping smtp for some provider's api is a new type not a handler change
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// prints instead of sending, default when no SMTP_HOST in .env so dev still works
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	fmt.Printf("mail to %s\nsubject: %s\n%s\n", to, subject, body)
+	return nil
+}
+
+type SMTPMailer struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth
+}
+
+func (mailer SMTPMailer) Send(to, subject, body string) error {
+	// header injection: addresses and subject come from user input at some point
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("refusing to send mail with newline in header")
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		mailer.From, to, subject, body)
+	return smtp.SendMail(mailer.Addr, mailer.Auth, mailer.From, []string{to}, []byte(msg))
+}
+
+// SMTP_HOST, SMTP_PORT (default 587), SMTP_USER, SMTP_PWD, SMTP_FROM from .env
+func LoadMailer() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if len(host) == 0 {
+		return LogMailer{}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if len(port) == 0 {
+		port = "587"
+	}
+	mailer := SMTPMailer{Addr: host + ":" + port, From: os.Getenv("SMTP_FROM")}
+	if user := os.Getenv("SMTP_USER"); len(user) > 0 {
+		mailer.Auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PWD"), host)
+	}
+	return mailer
+}
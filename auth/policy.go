@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// field name -> every reason that field was rejected, so client can show all at once
+type FieldErrors map[string][]string
+
+func (fe FieldErrors) Add(field, reason string) {
+	fe[field] = append(fe[field], reason)
+}
+
+/*
+rules a password has to satisfy at registration. read from .env in this directory
+each time policy is loaded, so tweaking .env then restarting is enough to change policy.
+  - PWD_MIN_LENGTH (default 8) and PWD_MAX_LENGTH (default 128) count runes not bytes
+  - PWD_REQUIRE_UPPER/LOWER/DIGIT/SYMBOL default true, set "false" to switch off
+  - BREACHED_PWD_DIR directory of k-anonymity range files, empty means no breach check
+*/
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	BreachedDir   string
+}
+
+func LoadPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:     envInt("PWD_MIN_LENGTH", 8),
+		MaxLength:     envInt("PWD_MAX_LENGTH", 128),
+		RequireUpper:  envBool("PWD_REQUIRE_UPPER", true),
+		RequireLower:  envBool("PWD_REQUIRE_LOWER", true),
+		RequireDigit:  envBool("PWD_REQUIRE_DIGIT", true),
+		RequireSymbol: envBool("PWD_REQUIRE_SYMBOL", true),
+		BreachedDir:   os.Getenv("BREACHED_PWD_DIR"),
+	}
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// checks user and pwd fields supplied to Register. empty FieldErrors means good to go
+func (policy PasswordPolicy) Validate(user, pwd string) FieldErrors {
+	fieldErrs := make(FieldErrors)
+	if len(strings.TrimSpace(user)) == 0 {
+		fieldErrs.Add("user", "username is required")
+	}
+	if len(pwd) == 0 {
+		fieldErrs.Add("pwd", "password is required")
+		return fieldErrs // no point listing every other rule for an empty password
+	}
+
+	numRunes := len([]rune(pwd))
+	if numRunes < policy.MinLength {
+		fieldErrs.Add("pwd", fmt.Sprintf("must be at least %d characters", policy.MinLength))
+	}
+	if policy.MaxLength > 0 && numRunes > policy.MaxLength {
+		fieldErrs.Add("pwd", fmt.Sprintf("must be at most %d characters", policy.MaxLength))
+	}
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, char := range pwd {
+		switch {
+		case unicode.IsUpper(char):
+			hasUpper = true
+		case unicode.IsLower(char):
+			hasLower = true
+		case unicode.IsDigit(char):
+			hasDigit = true
+		case unicode.IsPunct(char) || unicode.IsSymbol(char) || unicode.IsSpace(char):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		fieldErrs.Add("pwd", "must contain an uppercase letter")
+	}
+	if policy.RequireLower && !hasLower {
+		fieldErrs.Add("pwd", "must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		fieldErrs.Add("pwd", "must contain a digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		fieldErrs.Add("pwd", "must contain a symbol")
+	}
+	if len(user) > 0 && strings.EqualFold(strings.TrimSpace(user), strings.TrimSpace(pwd)) {
+		fieldErrs.Add("pwd", "must not be the same as username")
+	}
+
+	breached, err := policy.IsBreached(pwd)
+	if err != nil {
+		// don't block registration because corpus is unreadable, just make some noise
+		fmt.Printf("breached password lookup failed: %v\n", err)
+	}
+	if breached {
+		fieldErrs.Add("pwd", "appears in a known data breach, choose another")
+	}
+	return fieldErrs
+}
+
+/*
+corpus uses the same layout as haveibeenpwned range api: sha1 the password, uppercase hex,
+first 5 characters name the file (optionally with .txt) and every line in that file is
+the remaining 35 characters then :count. only ever need to read the one small file.
+*/
+func (policy PasswordPolicy) IsBreached(pwd string) (bool, error) {
+	if len(policy.BreachedDir) == 0 {
+		return false, nil
+	}
+	hashed := sha1.Sum([]byte(pwd))
+	hashedHex := strings.ToUpper(hex.EncodeToString(hashed[:]))
+	prefix, suffix := hashedHex[:5], hashedHex[5:]
+
+	rangeFile, err := os.Open(filepath.Join(policy.BreachedDir, prefix))
+	if os.IsNotExist(err) {
+		rangeFile, err = os.Open(filepath.Join(policy.BreachedDir, prefix+".txt"))
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil // no file for prefix means no breached hash starts with it
+		}
+		return false, err
+	}
+	defer rangeFile.Close()
+
+	scanner := bufio.NewScanner(rangeFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineSuffix, count, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+		// padded entries in range files have count 0, they are not real breaches
+		if occurrences, err := strconv.Atoi(count); err == nil && occurrences == 0 {
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func defaultPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: 8, MaxLength: 128, RequireUpper: true, RequireLower: true,
+		RequireDigit: true, RequireSymbol: true}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	lenient := PasswordPolicy{MinLength: 4, MaxLength: 8}
+	tests := []struct {
+		name   string
+		policy PasswordPolicy
+		user   string
+		pwd    string
+		want   FieldErrors
+	}{
+		{"good", defaultPolicy(), "alice", "Correct-h0rse", FieldErrors{}},
+		{"no username", defaultPolicy(), "  ", "Correct-h0rse",
+			FieldErrors{"user": {"username is required"}}},
+		// every other rule would fail too, only the one reason is given
+		{"no password", defaultPolicy(), "alice", "",
+			FieldErrors{"pwd": {"password is required"}}},
+		{"too short", defaultPolicy(), "alice", "Sh0rt!",
+			FieldErrors{"pwd": {"must be at least 8 characters"}}},
+		{"too long", lenient, "alice", "much too long",
+			FieldErrors{"pwd": {"must be at most 8 characters"}}},
+		// 8 runes but 12 bytes
+		{"length counts runes", defaultPolicy(), "alice", "Äöü-pw1x", FieldErrors{}},
+		{"no uppercase", defaultPolicy(), "alice", "correct-h0rse",
+			FieldErrors{"pwd": {"must contain an uppercase letter"}}},
+		{"no lowercase", defaultPolicy(), "alice", "CORRECT-H0RSE",
+			FieldErrors{"pwd": {"must contain a lowercase letter"}}},
+		{"no digit", defaultPolicy(), "alice", "Correct-horse",
+			FieldErrors{"pwd": {"must contain a digit"}}},
+		{"space counts as a symbol", defaultPolicy(), "alice", "Correct h0rse", FieldErrors{}},
+		{"no symbol", defaultPolicy(), "alice", "CorrectH0rse",
+			FieldErrors{"pwd": {"must contain a symbol"}}},
+		{"every class missing", defaultPolicy(), "alice", "        ",
+			FieldErrors{"pwd": {"must contain an uppercase letter",
+				"must contain a lowercase letter", "must contain a digit"}}},
+		{"classes switched off", lenient, "alice", "abcd", FieldErrors{}},
+		{"same as username", defaultPolicy(), "Alice-Sm1th", "Alice-Sm1th",
+			FieldErrors{"pwd": {"must not be the same as username"}}},
+		{"same as username ignoring case", defaultPolicy(), "alice-sm1th", "ALICE-SM1Th",
+			FieldErrors{"pwd": {"must not be the same as username"}}},
+		{"username inside password is fine", defaultPolicy(), "alice", "Alice-Sm1th",
+			FieldErrors{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.policy.Validate(test.user, test.pwd); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// file name and line a haveibeenpwned style range corpus lists pwd under
+func rangeEntry(pwd string, count string) (string, string) {
+	hashed := sha1.Sum([]byte(pwd))
+	hashedHex := strings.ToUpper(hex.EncodeToString(hashed[:]))
+	return hashedHex[:5], hashedHex[5:] + ":" + count
+}
+
+func TestPasswordPolicyIsBreached(t *testing.T) {
+	dir := t.TempDir()
+	writeRange := func(name string, lines ...string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Join(lines, "\r\n")), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	prefix, breached := rangeEntry("Password1!", "52")
+	// some other hash sharing the prefix
+	other := strings.Repeat("0", 35) + ":7"
+	writeRange(prefix, other, breached)
+	// padded entries are not real breaches
+	paddedPrefix, padded := rangeEntry("Padded-Pa55", "0")
+	writeRange(paddedPrefix+".txt", padded)
+	txtPrefix, txtEntry := rangeEntry("Txt-Pa55word", "3")
+	writeRange(txtPrefix+".txt", strings.ToLower(txtEntry))
+	unlistedPrefix, _ := rangeEntry("Unlisted-Pa55", "1")
+	if unlistedPrefix == prefix {
+		t.Fatal("pick an unlisted password with a different prefix")
+	}
+	notInFilePrefix, _ := rangeEntry("Not-In-F1le", "1")
+	writeRange(notInFilePrefix, other)
+
+	policy := defaultPolicy()
+	policy.BreachedDir = dir
+	tests := []struct {
+		name   string
+		policy PasswordPolicy
+		pwd    string
+		want   bool
+	}{
+		{"hit", policy, "Password1!", true},
+		{"hit in .txt file, any case", policy, "Txt-Pa55word", true},
+		{"padded entry", policy, "Padded-Pa55", false},
+		{"no file for prefix", policy, "Unlisted-Pa55", false},
+		{"prefix file without it", policy, "Not-In-F1le", false},
+		{"no corpus configured", defaultPolicy(), "Password1!", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.policy.IsBreached(test.pwd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Validate reports it like any other rule
+	want := FieldErrors{"pwd": {"appears in a known data breach, choose another"}}
+	if got := policy.Validate("alice", "Password1!"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
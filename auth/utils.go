@@ -65,14 +65,16 @@ func AuthMiddleware(sCollection *mongo.Collection) func(http.Handler) http.Handl
 				*/
 				switch exists {
 				case true:
-					json.NewEncoder(w).Encode(fmt.Sprintf("session id: %s", sessionID))
+					// write nothing here: anything written now fixes the status at 200 before
+					// later middleware (e.g. ConsentMiddleware) or the handler get a say
 					// cascade same w and r into next handler (handler for protected route)
 					handler.ServeHTTP(w, r)
 				case false:
-					json.NewEncoder(w).Encode(fmt.Sprintf("session id: %s invalid", sessionID))
+					RespondError(w, http.StatusUnauthorized,
+						fmt.Sprintf("session id: %s invalid", sessionID))
 				}
 			} else {
-				json.NewEncoder(w).Encode("no session id, check your cookies")
+				RespondError(w, http.StatusUnauthorized, "no session id, check your cookies")
 			}
 		})
 	}
@@ -94,3 +96,69 @@ func Exists(searchParams bson.D, collection *mongo.Collection) (bool, error) {
 	// if must pass result, format compatible with bson.M: map[string]interface{}(result)
 	return true, nil
 }
+
+// pulls session-id out of request cookies, empty string if client never set one
+func SessionIDFromCookies(r *http.Request) string {
+	var sessionID string
+	for _, ptrCookie := range r.Cookies() {
+		if (*ptrCookie).Name == "session-id" {
+			sessionID = (*ptrCookie).Value
+		}
+	}
+	return sessionID
+}
+
+// which user the request's session belongs to. empty user and nil error means no valid session
+func SessionUser(r *http.Request, sCollection *mongo.Collection) (string, error) {
+	sessionID := SessionIDFromCookies(r)
+	if len(sessionID) == 0 {
+		return "", nil
+	}
+	var result bson.M
+	err := sCollection.FindOne(context.TODO(),
+		bson.D{{Key: "session", Value: sessionID}}).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", nil
+		}
+		return "", err
+	}
+	user, _ := result["user"].(string)
+	return user, nil
+}
+
+// sets status before body because once body is written status is stuck at 200
+func RespondError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// 400 listing every rejected field, see FieldErrors
+func RespondFieldErrors(w http.ResponseWriter, fieldErrs FieldErrors) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": fieldErrs})
+}
+
+/*
+for /admin routes, sits after AuthMiddleware. staff are users whose document has
+role "staff"; nobody can register as staff, role is set by hand in the mongo shell.
+*/
+func StaffMiddleware(sCollection, uCollection *mongo.Collection) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := SessionUser(r, sCollection)
+			if err != nil || len(user) == 0 {
+				RespondError(w, http.StatusUnauthorized, "no valid session")
+				return
+			}
+			isStaff, err := Exists(bson.D{
+				{Key: "user", Value: user}, {Key: "role", Value: "staff"},
+			}, uCollection)
+			if err != nil || !isStaff {
+				RespondError(w, http.StatusForbidden, "staff only")
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,652 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+passkeys (webauthn level 2) as an alternative to user + pwd. two ceremonies, each split
+into begin (server hands out a challenge) and finish (browser returns what authenticator
+signed). registration needs an existing session because a passkey is attached to a user
+document; login issues the same session-id cookie Login does.
+
+relying party comes from .env in this directory:
+  - WEBAUTHN_RP_ID domain passkeys are scoped to (default localhost)
+  - WEBAUTHN_RP_NAME shown by the browser prompt (default golang store)
+  - WEBAUTHN_ORIGIN exact origin frontend is served from (default http://localhost:3000)
+*/
+
+const (
+	ceremonyRegister = "webauthn.create"
+	ceremonyLogin    = "webauthn.get"
+	ceremonyTimeout  = 2 * time.Minute
+
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+// COSE algorithm identifiers this server can verify
+const (
+	coseES256 int64 = -7
+	coseEdDSA int64 = -8
+	coseRS256 int64 = -257
+)
+
+type relyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+func loadRelyingParty() relyingParty {
+	rp := relyingParty{
+		ID:     os.Getenv("WEBAUTHN_RP_ID"),
+		Name:   os.Getenv("WEBAUTHN_RP_NAME"),
+		Origin: os.Getenv("WEBAUTHN_ORIGIN"),
+	}
+	if len(rp.ID) == 0 {
+		rp.ID = "localhost"
+	}
+	if len(rp.Name) == 0 {
+		rp.Name = "golang store"
+	}
+	if len(rp.Origin) == 0 {
+		rp.Origin = "http://localhost:3000"
+	}
+	return rp
+}
+
+// stored in slice field webauthnCredentials of a users document
+type WebAuthnCredential struct {
+	ID        string `bson:"id"` // base64url credential id, what browser calls rawId
+	PublicKey []byte `bson:"publicKey"`
+	Algorithm int64  `bson:"alg"`
+	SignCount int64  `bson:"signCount"`
+	CreatedAt int64  `bson:"createdAt"`
+}
+
+type webauthnUser struct {
+	ID          primitive.ObjectID   `bson:"_id"`
+	User        string               `bson:"user"`
+	Credentials []WebAuthnCredential `bson:"webauthnCredentials"`
+}
+
+// challenges handed out by begin and not yet consumed by finish. in memory like
+// the session timeout goroutines; a restart just means the browser has to begin again
+type pendingCeremony struct {
+	kind    string
+	user    string
+	expires time.Time
+}
+
+var ceremonyMutex sync.Mutex
+var pendingCeremonies = make(map[string]pendingCeremony)
+
+func beginCeremony(kind, user string) (string, error) {
+	challengeBytes := make([]byte, 32)
+	if _, err := rand.Read(challengeBytes); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(challengeBytes)
+	ceremonyMutex.Lock()
+	defer ceremonyMutex.Unlock()
+	now := time.Now()
+	for stale, ceremony := range pendingCeremonies {
+		if now.After(ceremony.expires) {
+			delete(pendingCeremonies, stale)
+		}
+	}
+	pendingCeremonies[challenge] = pendingCeremony{
+		kind: kind, user: user, expires: now.Add(ceremonyTimeout),
+	}
+	return challenge, nil
+}
+
+// single use: challenge is removed whether or not it turns out to be valid
+func consumeCeremony(challenge, kind string) (pendingCeremony, bool) {
+	ceremonyMutex.Lock()
+	defer ceremonyMutex.Unlock()
+	ceremony, found := pendingCeremonies[challenge]
+	delete(pendingCeremonies, challenge)
+	if !found || ceremony.kind != kind || time.Now().After(ceremony.expires) {
+		return pendingCeremony{}, false
+	}
+	return ceremony, true
+}
+
+// shape of PublicKeyCredential once frontend has base64url encoded the ArrayBuffers
+type credentialResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash      []byte
+	flags         byte
+	signCount     uint32
+	credentialID  []byte
+	credentialKey []byte // COSE_Key, only present on registration
+}
+
+// browsers and libraries disagree on padding so accept either
+func decodeBase64URL(encoded string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+}
+
+func readCredentialResponse(r *http.Request) (credentialResponse, error) {
+	var credential credentialResponse
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		return credential, err
+	}
+	if err = json.Unmarshal(bodyBytes, &credential); err != nil {
+		return credential, err
+	}
+	if credential.Type != "public-key" {
+		return credential, errors.New("credential type must be public-key")
+	}
+	if len(credential.RawID) == 0 {
+		credential.RawID = credential.ID
+	}
+	return credential, nil
+}
+
+// checks type and origin, consumes the challenge and hands back its ceremony
+func verifyClientData(clientDataJSON []byte, kind string,
+	rp relyingParty) (pendingCeremony, error) {
+	var collected clientData
+	if err := json.Unmarshal(clientDataJSON, &collected); err != nil {
+		return pendingCeremony{}, errors.New("clientDataJSON is not valid json")
+	}
+	if collected.Type != kind {
+		return pendingCeremony{}, fmt.Errorf("expected client data type %s", kind)
+	}
+	if collected.Origin != rp.Origin {
+		return pendingCeremony{}, fmt.Errorf("origin %s not allowed", collected.Origin)
+	}
+	ceremony, ok := consumeCeremony(collected.Challenge, kind)
+	if !ok {
+		return pendingCeremony{}, errors.New("challenge unknown, used or expired")
+	}
+	return ceremony, nil
+}
+
+func parseAuthenticatorData(raw []byte, rp relyingParty) (authenticatorData, error) {
+	var authData authenticatorData
+	if len(raw) < 37 {
+		return authData, errors.New("authenticator data too short")
+	}
+	authData.rpIDHash = raw[:32]
+	authData.flags = raw[32]
+	authData.signCount = binary.BigEndian.Uint32(raw[33:37])
+	expectedHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(authData.rpIDHash, expectedHash[:]) {
+		return authData, errors.New("authenticator data is for another relying party")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return authData, errors.New("user presence flag not set")
+	}
+	if authData.flags&flagAttestedData == 0 {
+		return authData, nil
+	}
+	// attested credential data: aaguid(16) | credential id length(2) | id | COSE_Key
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return authData, errors.New("attested credential data too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return authData, errors.New("credential id truncated")
+	}
+	authData.credentialID = rest[:idLength]
+	rest = rest[idLength:]
+	_, afterKey, err := decodeCBOR(rest)
+	if err != nil {
+		return authData, err
+	}
+	authData.credentialKey = rest[:len(rest)-len(afterKey)]
+	return authData, nil
+}
+
+func coseBytes(key map[interface{}]interface{}, label int64) []byte {
+	value, _ := key[label].([]byte)
+	return value
+}
+
+// COSE_Key -> go public key. only algorithms browsers actually offer for passkeys
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("COSE key is not a map")
+	}
+	alg, _ := key[int64(3)].(int64)
+	switch alg {
+	case coseES256:
+		x, y := coseBytes(key, -2), coseBytes(key, -3)
+		if curve, _ := key[int64(-1)].(int64); curve != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("ES256 key must be on P-256")
+		}
+		publicKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y),
+		}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, errors.New("ES256 point not on curve")
+		}
+		return publicKey, alg, nil
+	case coseEdDSA:
+		x := coseBytes(key, -2)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("EdDSA key must be Ed25519")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case coseRS256:
+		modulus, exponent := coseBytes(key, -1), coseBytes(key, -2)
+		if len(modulus) < 256 || len(exponent) == 0 || len(exponent) > 4 {
+			return nil, 0, errors.New("RS256 key malformed or shorter than 2048 bits")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported COSE algorithm %d", alg)
+}
+
+// signature is over authenticatorData || sha256(clientDataJSON)
+func verifyAssertion(coseKey, authDataRaw, clientDataJSON, signature []byte) error {
+	publicKey, _, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authDataRaw...), clientDataHash[:]...)
+	signedHash := sha256.Sum256(signed)
+	switch typedKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(typedKey, signedHash[:], signature) {
+			return errors.New("bad ES256 signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(typedKey, signed, signature) {
+			return errors.New("bad EdDSA signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(typedKey, crypto.SHA256, signedHash[:], signature); err != nil {
+			return errors.New("bad RS256 signature")
+		}
+	}
+	return nil
+}
+
+/*
+everything registration checks that doesn't need the database: client data, the
+attestation object and the key in it. hands back the ceremony the challenge belonged
+to and the credential to store.
+*/
+func verifyRegistration(clientDataJSON, attestationRaw []byte,
+	rp relyingParty) (pendingCeremony, WebAuthnCredential, error) {
+	ceremony, err := verifyClientData(clientDataJSON, ceremonyRegister, rp)
+	if err != nil {
+		return ceremony, WebAuthnCredential{}, err
+	}
+	decoded, _, err := decodeCBOR(attestationRaw)
+	attestation, isMap := decoded.(map[interface{}]interface{})
+	if err != nil || !isMap {
+		return ceremony, WebAuthnCredential{}, errors.New("attestationObject is not a cbor map")
+	}
+	authDataRaw, _ := attestation["authData"].([]byte)
+	authData, err := parseAuthenticatorData(authDataRaw, rp)
+	if err != nil {
+		return ceremony, WebAuthnCredential{}, err
+	}
+	if len(authData.credentialID) == 0 || len(authData.credentialKey) == 0 {
+		return ceremony, WebAuthnCredential{},
+			errors.New("no attested credential in authenticator data")
+	}
+	_, alg, err := parseCOSEKey(authData.credentialKey)
+	if err != nil {
+		return ceremony, WebAuthnCredential{}, err
+	}
+	return ceremony, WebAuthnCredential{
+		ID:        base64.RawURLEncoding.EncodeToString(authData.credentialID),
+		PublicKey: authData.credentialKey,
+		Algorithm: alg,
+		SignCount: int64(authData.signCount),
+		CreatedAt: time.Now().Unix(),
+	}, nil
+}
+
+// signature by stored's key, and a counter that moved on. returns the new counter
+func verifyLogin(stored WebAuthnCredential, authData authenticatorData,
+	authDataRaw, clientDataJSON, signature []byte) (int64, error) {
+	if err := verifyAssertion(stored.PublicKey, authDataRaw, clientDataJSON, signature); err != nil {
+		return 0, err
+	}
+	// counters that stop increasing suggest a cloned authenticator. zero both sides
+	// is normal for passkeys synced between devices, they don't count
+	newCount := int64(authData.signCount)
+	if (newCount != 0 || stored.SignCount != 0) && newCount <= stored.SignCount {
+		return 0, errors.New("signature counter went backwards")
+	}
+	return newCount, nil
+}
+
+func descriptorsFor(credentials []WebAuthnCredential) []map[string]string {
+	descriptors := make([]map[string]string, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptors = append(descriptors, map[string]string{
+			"type": "public-key", "id": credential.ID,
+		})
+	}
+	return descriptors
+}
+
+// reuse a live session if the user has one, exactly like Login, otherwise make one
+func issueSession(user string, sCollection *mongo.Collection) (string, error) {
+	session, err := FindSession(bson.D{{Key: "user", Value: user}}, sCollection)
+	if err != nil {
+		return "", err
+	}
+	if len(session) > 0 {
+		return session, nil
+	}
+	sessionChan := make(chan string)
+	go CreateNewSession(sessionChan, map[string]string{"user": user}, sCollection)
+	select {
+	case session = <-sessionChan:
+		return session, nil
+	case <-time.After(2 * time.Second):
+		return "", errors.New("timed out creating session")
+	}
+}
+
+/*
+passkey registration step 1. needs a logged in session: the passkey gets attached to
+whichever user owns it. responds with PublicKeyCredentialCreationOptions for
+navigator.credentials.create(), binary fields base64url encoded.
+*/
+func WebAuthnRegisterBegin(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is user
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		user, err := SessionUser(r, collections[0])
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not look up session")
+			return
+		}
+		if len(user) == 0 {
+			RespondError(w, http.StatusUnauthorized, "log in before adding a passkey")
+			return
+		}
+		var userDoc webauthnUser
+		err = collections[1].FindOne(context.TODO(),
+			bson.D{{Key: "user", Value: user}}).Decode(&userDoc)
+		if err != nil {
+			RespondError(w, http.StatusNotFound, "no user document for session")
+			return
+		}
+		challenge, err := beginCeremony(ceremonyRegister, user)
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not generate challenge")
+			return
+		}
+		rp := loadRelyingParty()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"publicKey": map[string]interface{}{
+				"challenge": challenge,
+				"rp":        map[string]string{"id": rp.ID, "name": rp.Name},
+				"user": map[string]string{
+					// user handle must not be personally identifying, ObjectID bytes are not
+					"id":          base64.RawURLEncoding.EncodeToString(userDoc.ID[:]),
+					"name":        user,
+					"displayName": user,
+				},
+				"pubKeyCredParams": []map[string]interface{}{
+					{"type": "public-key", "alg": coseES256},
+					{"type": "public-key", "alg": coseEdDSA},
+					{"type": "public-key", "alg": coseRS256},
+				},
+				"timeout":            ceremonyTimeout.Milliseconds(),
+				"attestation":        "none",
+				"excludeCredentials": descriptorsFor(userDoc.Credentials),
+				"authenticatorSelection": map[string]string{
+					"residentKey":      "preferred",
+					"userVerification": "preferred",
+				},
+			},
+		})
+	})
+}
+
+/*
+passkey registration step 2. body is the PublicKeyCredential from create(). attestation
+statements are not verified (attestation "none" was requested), only that the
+credential was made for this relying party against a challenge this server issued.
+*/
+func WebAuthnRegisterFinish(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is user
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		user, err := SessionUser(r, collections[0])
+		if err != nil || len(user) == 0 {
+			RespondError(w, http.StatusUnauthorized, "log in before adding a passkey")
+			return
+		}
+		credential, err := readCredentialResponse(r)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		clientDataJSON, err := decodeBase64URL(credential.Response.ClientDataJSON)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, "clientDataJSON not base64url")
+			return
+		}
+		attestationRaw, err := decodeBase64URL(credential.Response.AttestationObject)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, "attestationObject not base64url")
+			return
+		}
+		ceremony, newCredential, err := verifyRegistration(clientDataJSON, attestationRaw,
+			loadRelyingParty())
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if ceremony.user != user {
+			RespondError(w, http.StatusForbidden, "challenge was issued to another user")
+			return
+		}
+
+		credentialID := newCredential.ID
+		taken, err := Exists(bson.D{{Key: "webauthnCredentials.id", Value: credentialID}},
+			collections[1])
+		if err != nil || taken {
+			RespondError(w, http.StatusConflict, "passkey already registered")
+			return
+		}
+		_, err = collections[1].UpdateOne(context.TODO(),
+			bson.D{{Key: "user", Value: user}},
+			bson.D{{Key: "$push", Value: bson.D{
+				{Key: "webauthnCredentials", Value: newCredential},
+			}}})
+		if err != nil {
+			fmt.Printf("couldn't store passkey for %s: %v\n", user, err)
+			RespondError(w, http.StatusInternalServerError, "could not store passkey")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"registered": credentialID})
+	})
+}
+
+/*
+passkey login step 1. body may name a user ({"user": "..."}) to narrow allowCredentials;
+leaving it out lets the authenticator offer any discoverable passkey for this site.
+*/
+func WebAuthnLoginBegin(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is user
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var userInputMap map[string]string
+		userInputBytes, _ := io.ReadAll(r.Body)
+		if len(userInputBytes) > 0 {
+			if err := json.Unmarshal(userInputBytes, &userInputMap); err != nil {
+				RespondError(w, http.StatusBadRequest, "body must be a json object")
+				return
+			}
+		}
+		user := userInputMap["user"]
+		allowCredentials := []map[string]string{}
+		if len(user) > 0 {
+			var userDoc webauthnUser
+			err := collections[1].FindOne(context.TODO(),
+				bson.D{{Key: "user", Value: user}}).Decode(&userDoc)
+			// unknown user gets the same response shape, don't leak who is registered
+			if err == nil {
+				allowCredentials = descriptorsFor(userDoc.Credentials)
+			}
+		}
+		challenge, err := beginCeremony(ceremonyLogin, user)
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not generate challenge")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"publicKey": map[string]interface{}{
+				"challenge":        challenge,
+				"rpId":             loadRelyingParty().ID,
+				"timeout":          ceremonyTimeout.Milliseconds(),
+				"userVerification": "preferred",
+				"allowCredentials": allowCredentials,
+			},
+		})
+	})
+}
+
+/*
+passkey login step 2. body is the PublicKeyCredential from get(). on a good signature
+the user gets a session-id cookie just like Login would have given them.
+*/
+func WebAuthnLoginFinish(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is session collections[1] is user
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		credential, err := readCredentialResponse(r)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		clientDataJSON, err := decodeBase64URL(credential.Response.ClientDataJSON)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, "clientDataJSON not base64url")
+			return
+		}
+		authDataRaw, err := decodeBase64URL(credential.Response.AuthenticatorData)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, "authenticatorData not base64url")
+			return
+		}
+		signature, err := decodeBase64URL(credential.Response.Signature)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, "signature not base64url")
+			return
+		}
+		rp := loadRelyingParty()
+		ceremony, err := verifyClientData(clientDataJSON, ceremonyLogin, rp)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		authData, err := parseAuthenticatorData(authDataRaw, rp)
+		if err != nil {
+			RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		credentialID := strings.TrimRight(credential.RawID, "=")
+		var userDoc webauthnUser
+		err = collections[1].FindOne(context.TODO(),
+			bson.D{{Key: "webauthnCredentials.id", Value: credentialID}}).Decode(&userDoc)
+		if err != nil {
+			RespondError(w, http.StatusUnauthorized, "unknown passkey")
+			return
+		}
+		if len(ceremony.user) > 0 && ceremony.user != userDoc.User {
+			RespondError(w, http.StatusUnauthorized, "passkey belongs to another user")
+			return
+		}
+		var stored WebAuthnCredential
+		for _, candidate := range userDoc.Credentials {
+			if candidate.ID == credentialID {
+				stored = candidate
+			}
+		}
+		newCount, err := verifyLogin(stored, authData, authDataRaw, clientDataJSON, signature)
+		if err != nil {
+			RespondError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		_, err = collections[1].UpdateOne(context.TODO(),
+			bson.D{
+				{Key: "_id", Value: userDoc.ID},
+				{Key: "webauthnCredentials.id", Value: credentialID},
+			},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "webauthnCredentials.$.signCount", Value: newCount},
+			}}})
+		if err != nil {
+			fmt.Printf("couldn't update passkey counter: %v\n", err)
+		}
+
+		cookie, err := issueSession(userDoc.User, collections[0])
+		if err != nil {
+			RespondError(w, http.StatusInternalServerError, "could not create session")
+			return
+		}
+		w.Header().Set("Set-Cookie", fmt.Sprintf("session-id=%s", cookie))
+		json.NewEncoder(w).Encode("logged in")
+	})
+}
@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+var testRP = relyingParty{ID: "localhost", Name: "golang store", Origin: "http://localhost:3000"}
+
+// plays the part of a security key or platform passkey: holds one key pair and builds
+// the attestation and assertion objects a browser would pass on
+type softAuthenticator struct {
+	alg          int64
+	credentialID []byte
+	key          crypto.Signer
+	signCount    uint32
+	rpID         string
+}
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+	t.Helper()
+	authenticator := &softAuthenticator{alg: alg, credentialID: make([]byte, 16), rpID: testRP.ID}
+	rand.Read(authenticator.credentialID)
+	var err error
+	switch alg {
+	case coseES256:
+		authenticator.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseEdDSA:
+		_, authenticator.key, err = ed25519.GenerateKey(rand.Reader)
+	case coseRS256:
+		authenticator.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+func (authenticator *softAuthenticator) coseKey() []byte {
+	key := map[interface{}]interface{}{int64(3): authenticator.alg}
+	switch public := authenticator.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		key[int64(1)], key[int64(-1)] = int64(2), int64(1) // EC2, P-256
+		key[int64(-2)] = public.X.FillBytes(make([]byte, 32))
+		key[int64(-3)] = public.Y.FillBytes(make([]byte, 32))
+	case ed25519.PublicKey:
+		key[int64(1)], key[int64(-1)] = int64(1), int64(6) // OKP, Ed25519
+		key[int64(-2)] = []byte(public)
+	case *rsa.PublicKey:
+		key[int64(1)] = int64(3)
+		key[int64(-1)] = public.N.Bytes()
+		key[int64(-2)] = big.NewInt(int64(public.E)).Bytes()
+	}
+	return encodeCBOR(key)
+}
+
+// rpIdHash | flags | signCount, plus attested credential data when registering
+func (authenticator *softAuthenticator) authenticatorData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(authenticator.rpID))
+	authData := append(rpIDHash[:], flags)
+	authData = binary.BigEndian.AppendUint32(authData, authenticator.signCount)
+	if flags&flagAttestedData != 0 {
+		authData = append(authData, make([]byte, 16)...) // aaguid, zero for "none"
+		authData = binary.BigEndian.AppendUint16(authData, uint16(len(authenticator.credentialID)))
+		authData = append(authData, authenticator.credentialID...)
+		authData = append(authData, authenticator.coseKey()...)
+	}
+	return authData
+}
+
+func testClientData(kind, challenge, origin string) []byte {
+	clientDataJSON, _ := json.Marshal(clientData{Type: kind, Challenge: challenge, Origin: origin})
+	return clientDataJSON
+}
+
+// navigator.credentials.create() with attestation "none"
+func (authenticator *softAuthenticator) register(challenge, origin string) ([]byte, []byte) {
+	attestation := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authenticator.authenticatorData(flagUserPresent | flagAttestedData),
+	})
+	return testClientData(ceremonyRegister, challenge, origin), attestation
+}
+
+// navigator.credentials.get(): clientDataJSON, authenticatorData and signature
+func (authenticator *softAuthenticator) login(t *testing.T, challenge,
+	origin string) ([]byte, []byte, []byte) {
+	t.Helper()
+	authenticator.signCount++
+	clientDataJSON := testClientData(ceremonyLogin, challenge, origin)
+	authData := authenticator.authenticatorData(flagUserPresent)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	var signature []byte
+	var err error
+	if _, isEd25519 := authenticator.key.(ed25519.PrivateKey); isEd25519 {
+		signature, err = authenticator.key.Sign(rand.Reader, signed, crypto.Hash(0))
+	} else {
+		signedHash := sha256.Sum256(signed)
+		signature, err = authenticator.key.Sign(rand.Reader, signedHash[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientDataJSON, authData, signature
+}
+
+func registerSoft(t *testing.T, authenticator *softAuthenticator) WebAuthnCredential {
+	t.Helper()
+	challenge, err := beginCeremony(ceremonyRegister, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDataJSON, attestation := authenticator.register(challenge, testRP.Origin)
+	ceremony, credential, err := verifyRegistration(clientDataJSON, attestation, testRP)
+	if err != nil {
+		t.Fatalf("registration: %v", err)
+	}
+	if ceremony.user != "alice" {
+		t.Errorf("ceremony user %q, want alice", ceremony.user)
+	}
+	return credential
+}
+
+func TestWebAuthnRegistrationAndLogin(t *testing.T) {
+	for _, alg := range []int64{coseES256, coseEdDSA, coseRS256} {
+		t.Run(map[int64]string{coseES256: "ES256", coseEdDSA: "EdDSA", coseRS256: "RS256"}[alg],
+			func(t *testing.T) {
+				authenticator := newSoftAuthenticator(t, alg)
+				credential := registerSoft(t, authenticator)
+				if credential.Algorithm != alg {
+					t.Errorf("algorithm %d, want %d", credential.Algorithm, alg)
+				}
+				if want := base64.RawURLEncoding.EncodeToString(authenticator.credentialID); credential.ID != want {
+					t.Errorf("credential id %s, want %s", credential.ID, want)
+				}
+
+				for attempt := 1; attempt <= 2; attempt++ {
+					challenge, _ := beginCeremony(ceremonyLogin, "")
+					clientDataJSON, authDataRaw, signature := authenticator.login(t, challenge,
+						testRP.Origin)
+					if _, err := verifyClientData(clientDataJSON, ceremonyLogin, testRP); err != nil {
+						t.Fatalf("login %d client data: %v", attempt, err)
+					}
+					authData, err := parseAuthenticatorData(authDataRaw, testRP)
+					if err != nil {
+						t.Fatalf("login %d authenticator data: %v", attempt, err)
+					}
+					newCount, err := verifyLogin(credential, authData, authDataRaw, clientDataJSON,
+						signature)
+					if err != nil {
+						t.Fatalf("login %d: %v", attempt, err)
+					}
+					if newCount != int64(attempt) {
+						t.Errorf("login %d stored counter %d", attempt, newCount)
+					}
+					credential.SignCount = newCount
+				}
+			})
+	}
+}
+
+func TestWebAuthnRegistrationRejects(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, coseES256)
+	tests := []struct {
+		name  string
+		build func(challenge string) ([]byte, []byte)
+	}{
+		{"wrong origin", func(challenge string) ([]byte, []byte) {
+			return authenticator.register(challenge, "https://evil.example")
+		}},
+		{"login client data", func(challenge string) ([]byte, []byte) {
+			_, attestation := authenticator.register(challenge, testRP.Origin)
+			return testClientData(ceremonyLogin, challenge, testRP.Origin), attestation
+		}},
+		{"unknown challenge", func(string) ([]byte, []byte) {
+			return authenticator.register("never-issued", testRP.Origin)
+		}},
+		{"another relying party", func(challenge string) ([]byte, []byte) {
+			other := *authenticator
+			other.rpID = "evil.example"
+			return other.register(challenge, testRP.Origin)
+		}},
+		{"attestation not cbor", func(challenge string) ([]byte, []byte) {
+			clientDataJSON, _ := authenticator.register(challenge, testRP.Origin)
+			return clientDataJSON, []byte{0xff, 0x00}
+		}},
+		{"no attested credential", func(challenge string) ([]byte, []byte) {
+			clientDataJSON, _ := authenticator.register(challenge, testRP.Origin)
+			return clientDataJSON, encodeCBOR(map[interface{}]interface{}{
+				"fmt": "none", "attStmt": map[interface{}]interface{}{},
+				"authData": authenticator.authenticatorData(flagUserPresent),
+			})
+		}},
+		{"user not present", func(challenge string) ([]byte, []byte) {
+			clientDataJSON, _ := authenticator.register(challenge, testRP.Origin)
+			return clientDataJSON, encodeCBOR(map[interface{}]interface{}{
+				"fmt": "none", "attStmt": map[interface{}]interface{}{},
+				"authData": authenticator.authenticatorData(flagAttestedData),
+			})
+		}},
+		{"truncated key", func(challenge string) ([]byte, []byte) {
+			clientDataJSON, _ := authenticator.register(challenge, testRP.Origin)
+			authData := authenticator.authenticatorData(flagUserPresent | flagAttestedData)
+			return clientDataJSON, encodeCBOR(map[interface{}]interface{}{
+				"fmt": "none", "attStmt": map[interface{}]interface{}{},
+				"authData": authData[:len(authData)-5],
+			})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenge, _ := beginCeremony(ceremonyRegister, "alice")
+			clientDataJSON, attestation := test.build(challenge)
+			if _, _, err := verifyRegistration(clientDataJSON, attestation, testRP); err == nil {
+				t.Error("registration accepted")
+			}
+		})
+	}
+}
+
+func TestWebAuthnChallengeIsSingleUse(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, coseEdDSA)
+	challenge, _ := beginCeremony(ceremonyRegister, "alice")
+	clientDataJSON, attestation := authenticator.register(challenge, testRP.Origin)
+	if _, _, err := verifyRegistration(clientDataJSON, attestation, testRP); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := verifyRegistration(clientDataJSON, attestation, testRP); err == nil ||
+		!strings.Contains(err.Error(), "challenge") {
+		t.Errorf("replayed registration: %v", err)
+	}
+	// a registration challenge can't be spent on a login
+	challenge, _ = beginCeremony(ceremonyRegister, "alice")
+	loginData, _, _ := authenticator.login(t, challenge, testRP.Origin)
+	if _, err := verifyClientData(loginData, ceremonyLogin, testRP); err == nil {
+		t.Error("login accepted a registration challenge")
+	}
+}
+
+func TestWebAuthnLoginRejects(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, coseES256)
+	credential := registerSoft(t, authenticator)
+
+	t.Run("tampered signature", func(t *testing.T) {
+		clientDataJSON, authDataRaw, signature := authenticator.login(t, "c", testRP.Origin)
+		signature[len(signature)-1] ^= 0x01
+		authData, _ := parseAuthenticatorData(authDataRaw, testRP)
+		if _, err := verifyLogin(credential, authData, authDataRaw, clientDataJSON, signature); err == nil {
+			t.Error("accepted a tampered signature")
+		}
+	})
+	t.Run("signed for other client data", func(t *testing.T) {
+		_, authDataRaw, signature := authenticator.login(t, "c", testRP.Origin)
+		authData, _ := parseAuthenticatorData(authDataRaw, testRP)
+		other := testClientData(ceremonyLogin, "other", testRP.Origin)
+		if _, err := verifyLogin(credential, authData, authDataRaw, other, signature); err == nil {
+			t.Error("accepted a signature over different client data")
+		}
+	})
+	t.Run("another authenticator's key", func(t *testing.T) {
+		impostor := newSoftAuthenticator(t, coseES256)
+		clientDataJSON, authDataRaw, signature := impostor.login(t, "c", testRP.Origin)
+		authData, _ := parseAuthenticatorData(authDataRaw, testRP)
+		if _, err := verifyLogin(credential, authData, authDataRaw, clientDataJSON, signature); err == nil {
+			t.Error("accepted a signature from another key")
+		}
+	})
+	t.Run("counter went backwards", func(t *testing.T) {
+		stored := credential
+		stored.SignCount = 100
+		clientDataJSON, authDataRaw, signature := authenticator.login(t, "c", testRP.Origin)
+		authData, _ := parseAuthenticatorData(authDataRaw, testRP)
+		if _, err := verifyLogin(stored, authData, authDataRaw, clientDataJSON, signature); err == nil {
+			t.Error("accepted a counter lower than the stored one")
+		}
+	})
+	t.Run("synced passkey without counter", func(t *testing.T) {
+		synced := newSoftAuthenticator(t, coseEdDSA)
+		stored := registerSoft(t, synced)
+		synced.signCount = ^uint32(0) // login increments it back round to 0
+		clientDataJSON, authDataRaw, signature := synced.login(t, "c", testRP.Origin)
+		authData, _ := parseAuthenticatorData(authDataRaw, testRP)
+		if _, err := verifyLogin(stored, authData, authDataRaw, clientDataJSON, signature); err != nil {
+			t.Errorf("zero counters both sides should pass: %v", err)
+		}
+	})
+	t.Run("authenticator data for another relying party", func(t *testing.T) {
+		other := *authenticator
+		other.rpID = "evil.example"
+		_, authDataRaw, _ := other.login(t, "c", testRP.Origin)
+		if _, err := parseAuthenticatorData(authDataRaw, testRP); err == nil {
+			t.Error("accepted authenticator data for another relying party")
+		}
+	})
+}
+
+func TestParseCOSEKeyRejects(t *testing.T) {
+	ecKey := newSoftAuthenticator(t, coseES256).key.Public().(*ecdsa.PublicKey)
+	tests := []struct {
+		name string
+		key  map[interface{}]interface{}
+	}{
+		{"unsupported algorithm", map[interface{}]interface{}{int64(3): int64(-35)}},
+		{"ES256 off P-256", map[interface{}]interface{}{int64(3): coseES256, int64(-1): int64(2),
+			int64(-2): ecKey.X.FillBytes(make([]byte, 32)), int64(-3): ecKey.Y.FillBytes(make([]byte, 32))}},
+		{"ES256 point not on curve", map[interface{}]interface{}{int64(3): coseES256, int64(-1): int64(1),
+			int64(-2): make([]byte, 32), int64(-3): append(make([]byte, 31), 1)}},
+		{"EdDSA short key", map[interface{}]interface{}{int64(3): coseEdDSA, int64(-2): make([]byte, 31)}},
+		{"RS256 short modulus", map[interface{}]interface{}{int64(3): coseRS256,
+			int64(-1): make([]byte, 128), int64(-2): []byte{1, 0, 1}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := parseCOSEKey(encodeCBOR(test.key)); err == nil {
+				t.Error("key accepted")
+			}
+		})
+	}
+	if _, _, err := parseCOSEKey(encodeCBOR([]interface{}{int64(1)})); err == nil {
+		t.Error("non-map key accepted")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	content "gorilla-mongo-api/content"
+)
+
+/*
+subcommands run against the same .env and collections as the api, instead of serving:
+
+	go run . export -format csv -o menu.csv
+	go run . import -dry-run menu.csv
+
+format defaults to the file's extension, json when there's none (stdin/stdout).
+*/
+func runCommand(args []string) int {
+	switch args[0] {
+	case "export":
+		return exportCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q, commands are export and import\n", args[0])
+	return 2
+}
+
+func fileFormat(format string, path string) string {
+	if len(format) > 0 {
+		return strings.ToLower(format)
+	}
+	if extension := strings.TrimPrefix(filepath.Ext(path), "."); len(extension) > 0 {
+		return strings.ToLower(extension)
+	}
+	return "json"
+}
+
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or json")
+	outPath := flags.String("o", "", "file to write, stdout when left out")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var out io.Writer = os.Stdout
+	if len(*outPath) > 0 {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := content.ExportItems(ctx, fileFormat(*format, *outPath), out,
+		itemCollection, categoryCollection)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// prints the report as json; exits 1 when a row is invalid or the import failed
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or json")
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var in io.Reader = os.Stdin
+	inPath := flags.Arg(0)
+	if len(inPath) > 0 && inPath != "-" {
+		file, err := os.Open(inPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		in = file
+	}
+	records, rowErrs, err := content.ParseItemRecords(fileFormat(*format, inPath), in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	report, err := content.ImportItems(ctx, records, rowErrs, *dryRun,
+		itemCollection, categoryCollection, priceChangeCollection)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err != nil {
+		// standalone mongo may have written some rows before the failure, the report says
+		// which
+		if len(report.Rows) > 0 {
+			encoder.Encode(report)
+		}
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		return 1
+	}
+	encoder.Encode(report)
+	if report.Counts[content.ImportInvalid] > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,494 @@
+package content
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+staff endpoints for the items collection, sit behind auth.StaffMiddleware.
+every write is conditional on the version the client last read (body "version" or an
+If-Match header), so two staff editing the same item can't silently overwrite each
+other: the slower one gets 409 and the current item to merge against.
+*/
+
+var errVersionConflict = errors.New("item was changed by someone else")
+
+// pointers so PATCH can tell "not sent" from zero values
+type ItemInput struct {
+	SKU            *string          `json:"sku"`
+	Name           *string          `json:"name"`
+	Cost           *Money           `json:"cost"`
+	Classification *string          `json:"classification"`
+	CategoryIDs    *[]string        `json:"categoryIds"`
+	Availability   *bool            `json:"availability"`
+	Description    *string          `json:"description"`
+	Tags           *[]string        `json:"tags"`
+	Variants       *[]Variant       `json:"variants"`
+	ModifierGroups *[]ModifierGroup `json:"modifierGroups"`
+	Slots          *[]BundleSlot    `json:"slots"`
+	Schedules      *[]Schedule      `json:"schedules"`
+	Allergens      *[]string        `json:"allergens"`
+	Dietary        *[]string        `json:"dietary"`
+	Nutrition      *Nutrition       `json:"nutrition"`
+	Version        *int64           `json:"version"`
+}
+
+func readItemInput(r *http.Request) (ItemInput, error) {
+	var input ItemInput
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		return input, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+	decoder.DisallowUnknownFields() // typo'd field name should fail loudly not be ignored
+	err = decoder.Decode(&input)
+	return input, err
+}
+
+// copies whatever fields input carries onto item
+func (input ItemInput) applyTo(item *Item, fieldErrs auth.FieldErrors) {
+	if input.SKU != nil {
+		item.SKU = strings.TrimSpace(*input.SKU)
+	}
+	if input.Name != nil {
+		item.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.Cost != nil {
+		item.Cost = *input.Cost
+	}
+	if input.Classification != nil {
+		item.Classification = strings.TrimSpace(*input.Classification)
+	}
+	if input.CategoryIDs != nil {
+		item.CategoryIDs = make([]primitive.ObjectID, 0, len(*input.CategoryIDs))
+		for _, hexID := range *input.CategoryIDs {
+			categoryID, err := primitive.ObjectIDFromHex(hexID)
+			if err != nil {
+				fieldErrs.Add("categoryIds", fmt.Sprintf("%s is not a category id", hexID))
+				continue
+			}
+			item.CategoryIDs = append(item.CategoryIDs, categoryID)
+		}
+	}
+	if input.Availability != nil {
+		item.Availability = *input.Availability
+	}
+	if input.Description != nil {
+		item.Description = strings.TrimSpace(*input.Description)
+	}
+	if input.Variants != nil {
+		item.Variants = *input.Variants
+	}
+	if input.ModifierGroups != nil {
+		item.ModifierGroups = *input.ModifierGroups
+	}
+	if input.Slots != nil {
+		item.Slots = normalizeSlots(*input.Slots, item.Cost.Currency)
+	}
+	if input.Allergens != nil {
+		item.Allergens = normalizeLabels(*input.Allergens)
+	}
+	if input.Dietary != nil {
+		item.Dietary = normalizeLabels(*input.Dietary)
+	}
+	if input.Nutrition != nil {
+		item.Nutrition = input.Nutrition
+	}
+	if input.Schedules != nil {
+		item.Schedules = normalizeSchedules(*input.Schedules, "schedules", fieldErrs)
+	}
+	if input.Tags != nil {
+		item.Tags = make([]string, 0, len(*input.Tags))
+		for _, tag := range *input.Tags {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 {
+				item.Tags = append(item.Tags, tag)
+			}
+		}
+	}
+}
+
+// every field present, for POST and PUT
+func (input ItemInput) requireAll(fieldErrs auth.FieldErrors) {
+	if input.Name == nil {
+		fieldErrs.Add("name", "required")
+	}
+	if input.Cost == nil {
+		fieldErrs.Add("cost", "required")
+	}
+	if input.CategoryIDs == nil {
+		fieldErrs.Add("categoryIds", "required")
+	}
+	if input.Availability == nil {
+		fieldErrs.Add("availability", "required")
+	}
+}
+
+func ValidateItem(item Item, tree *CategoryTree, fieldErrs auth.FieldErrors) {
+	if len(item.Name) == 0 {
+		fieldErrs.Add("name", "must not be empty")
+	}
+	if len(item.SKU) > 64 || strings.ContainsAny(item.SKU, " \t\r\n,") {
+		fieldErrs.Add("sku", "at most 64 characters, no spaces or commas")
+	}
+	if len([]rune(item.Name)) > 100 {
+		fieldErrs.Add("name", "must be at most 100 characters")
+	}
+	if item.Cost.Amount < 0 {
+		fieldErrs.Add("cost", "must not be negative")
+	}
+	if !KnownCurrency(item.Cost.Currency) {
+		fieldErrs.Add("cost", fmt.Sprintf("unknown currency %q", item.Cost.Currency))
+	}
+	if len(item.CategoryIDs) == 0 {
+		fieldErrs.Add("categoryIds", "item needs at least one category")
+	}
+	for _, categoryID := range item.CategoryIDs {
+		if _, found := tree.byID[categoryID]; !found {
+			fieldErrs.Add("categoryIds", fmt.Sprintf("no category %s", categoryID.Hex()))
+		}
+	}
+	if len([]rune(item.Description)) > 1000 {
+		fieldErrs.Add("description", "must be at most 1000 characters")
+	}
+	if len(item.Tags) > 20 {
+		fieldErrs.Add("tags", "at most 20 tags")
+	}
+	ValidateItemOptions(item, fieldErrs)
+	ValidateBundle(item, fieldErrs)
+	ValidateDietary(item, fieldErrs)
+}
+
+// version the client is writing against: If-Match header wins over body
+func expectedVersion(r *http.Request, input ItemInput) (int64, bool) {
+	if ifMatch := strings.Trim(r.Header.Get("If-Match"), "\" "); len(ifMatch) > 0 {
+		version, err := strconv.ParseInt(ifMatch, 10, 64)
+		return version, err == nil
+	}
+	if input.Version != nil {
+		return *input.Version, true
+	}
+	return 0, false
+}
+
+func itemIDFromPath(r *http.Request) (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+}
+
+func FindItemByID(itemID primitive.ObjectID, iCollection *mongo.Collection) (Item, error) {
+	findCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var item Item
+	err := iCollection.FindOne(findCtx, bson.D{{Key: "_id", Value: itemID}}).Decode(&item)
+	return item, err
+}
+
+// items inserted by hand before versioning have no version field, treat as 0
+func versionFilter(itemID primitive.ObjectID, version int64) bson.D {
+	if version == 0 {
+		return bson.D{
+			{Key: "_id", Value: itemID},
+			{Key: "version", Value: bson.D{{Key: "$in", Value: bson.A{0, nil}}}},
+		}
+	}
+	return bson.D{{Key: "_id", Value: itemID}, {Key: "version", Value: version}}
+}
+
+// $set fields then bump version, only if version still matches. returns updated item
+func UpdateItemVersioned(itemID primitive.ObjectID, version int64, set bson.D,
+	iCollection *mongo.Collection) (Item, error) {
+	updateCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var updated Item
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}}}
+	if len(set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: set})
+	}
+	err := iCollection.FindOneAndUpdate(updateCtx, versionFilter(itemID, version), update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		// either item is gone or version moved on; tell which
+		if _, findErr := FindItemByID(itemID, iCollection); findErr == mongo.ErrNoDocuments {
+			return updated, mongo.ErrNoDocuments
+		}
+		return updated, errVersionConflict
+	}
+	return updated, err
+}
+
+func itemFields(item Item) bson.D {
+	return bson.D{
+		{Key: "sku", Value: item.SKU},
+		{Key: "name", Value: item.Name},
+		{Key: "cost", Value: item.Cost},
+		{Key: "classification", Value: item.Classification},
+		{Key: "categoryIds", Value: item.CategoryIDs},
+		{Key: "availability", Value: item.Availability},
+		{Key: "description", Value: item.Description},
+		{Key: "tags", Value: item.Tags},
+		{Key: "variants", Value: item.Variants},
+		{Key: "modifierGroups", Value: item.ModifierGroups},
+		{Key: "slots", Value: item.Slots},
+		{Key: "schedules", Value: item.Schedules},
+		{Key: "allergens", Value: item.Allergens},
+		{Key: "dietary", Value: item.Dietary},
+		{Key: "nutrition", Value: item.Nutrition},
+	}
+}
+
+// shared tail of every versioned write handler
+func respondItemWrite(w http.ResponseWriter, itemID primitive.ObjectID, item Item, err error,
+	iCollection *mongo.Collection) {
+	switch {
+	case err == nil:
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", item.Version))
+		json.NewEncoder(w).Encode(item)
+	case err == mongo.ErrNoDocuments:
+		auth.RespondError(w, http.StatusNotFound, "no such item")
+	case mongo.IsDuplicateKeyError(err):
+		auth.RespondError(w, http.StatusConflict, "another item has this sku")
+	case err == errVersionConflict:
+		current, _ := FindItemByID(itemID, iCollection)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": err.Error(), "current": current,
+		})
+	default:
+		fmt.Printf("admin item write failed: %v\n", err)
+		auth.RespondError(w, http.StatusInternalServerError, "could not save item")
+	}
+}
+
+// GET /admin/items, same parameters as the menu plus staff only available and deleted
+func ListItemsAdmin(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is categories
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		tree, err := LoadCategoryTree(collections[1])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		filter := ParseMenuFilter(r.URL.Query(), true, fieldErrs)
+		page := ParseMenuPage(r.URL.Query(), fieldErrs)
+		filter.CategoryIDs = ResolveCategoryFilter(filter.Types, tree, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		items, nextCursor, err := GetMenuPage(filter.BSON(), page, collections[0])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not list items")
+			return
+		}
+		response := MenuResponse{Items: items}
+		if len(nextCursor) > 0 {
+			response.NextCursor = &nextCursor
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// POST /admin/items, every field required. responds 201 with the item and its new ID
+func CreateItem(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is categories collections[2] is priceChanges
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		input, err := readItemInput(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, fmt.Sprintf("bad item json: %v", err))
+			return
+		}
+		tree, err := LoadCategoryTree(collections[1])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		input.requireAll(fieldErrs)
+		var item Item
+		input.applyTo(&item, fieldErrs)
+		ValidateItem(item, tree, fieldErrs)
+		if err = ValidateBundleChoices(item, collections[0], fieldErrs); err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not check bundle slots")
+			return
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		item.Version = 1
+		inserted, err := collections[0].InsertOne(context.TODO(), item)
+		if mongo.IsDuplicateKeyError(err) {
+			auth.RespondError(w, http.StatusConflict, "another item has this sku")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not create item")
+			return
+		}
+		item.ID = inserted.InsertedID.(primitive.ObjectID)
+		RecordPrice(r.Context(), item.ID, item.Cost, PriceFromEdit, collections[2])
+		w.Header().Set("Location", "/api/v1/admin/items/"+item.ID.Hex())
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", item.Version))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(item)
+	})
+}
+
+// PUT /admin/items/{id}, replaces every field
+func ReplaceItem(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is categories collections[2] is priceChanges
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		input, err := readItemInput(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, fmt.Sprintf("bad item json: %v", err))
+			return
+		}
+		tree, err := LoadCategoryTree(collections[1])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		input.requireAll(fieldErrs)
+		version, ok := expectedVersion(r, input)
+		if !ok {
+			fieldErrs.Add("version", "required, send the version you last read or If-Match")
+		}
+		item := Item{ID: itemID}
+		input.applyTo(&item, fieldErrs)
+		ValidateItem(item, tree, fieldErrs)
+		if err = ValidateBundleChoices(item, collections[0], fieldErrs); err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not check bundle slots")
+			return
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		updated, err := UpdateItemVersioned(itemID, version, itemFields(item), collections[0])
+		if err == nil {
+			RecordPrice(r.Context(), itemID, updated.Cost, PriceFromEdit, collections[2])
+		}
+		respondItemWrite(w, itemID, updated, err, collections[0])
+	})
+}
+
+// PATCH /admin/items/{id}, only fields sent are changed
+func PatchItem(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is categories collections[2] is priceChanges
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		input, err := readItemInput(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, fmt.Sprintf("bad item json: %v", err))
+			return
+		}
+		tree, err := LoadCategoryTree(collections[1])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		version, ok := expectedVersion(r, input)
+		if !ok {
+			fieldErrs.Add("version", "required, send the version you last read or If-Match")
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		// validate the item as it would end up, not just the fields sent
+		current, err := FindItemByID(itemID, collections[0])
+		if err != nil {
+			respondItemWrite(w, itemID, current, err, collections[0])
+			return
+		}
+		input.applyTo(&current, fieldErrs)
+		ValidateItem(current, tree, fieldErrs)
+		if err = ValidateBundleChoices(current, collections[0], fieldErrs); err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not check bundle slots")
+			return
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		updated, err := UpdateItemVersioned(itemID, version, itemFields(current), collections[0])
+		if err == nil && input.Cost != nil {
+			RecordPrice(r.Context(), itemID, updated.Cost, PriceFromEdit, collections[2])
+		}
+		respondItemWrite(w, itemID, updated, err, collections[0])
+	})
+}
+
+// DELETE /admin/items/{id}, soft: item keeps its ID and can be restored
+func DeleteItem(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		setSoftDeleted(w, r, true, collections[0])
+	})
+}
+
+// POST /admin/items/{id}/restore
+func RestoreItem(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		setSoftDeleted(w, r, false, collections[0])
+	})
+}
+
+func setSoftDeleted(w http.ResponseWriter, r *http.Request, deleted bool,
+	iCollection *mongo.Collection) {
+	itemID, err := itemIDFromPath(r)
+	if err != nil {
+		auth.RespondError(w, http.StatusNotFound, "no such item")
+		return
+	}
+	// DELETE usually has no body, so a missing body just means rely on If-Match
+	input, _ := readItemInput(r)
+	version, ok := expectedVersion(r, input)
+	if !ok {
+		fieldErrs := make(auth.FieldErrors)
+		fieldErrs.Add("version", "required, send the version you last read or If-Match")
+		auth.RespondFieldErrors(w, fieldErrs)
+		return
+	}
+	set := bson.D{{Key: "deleted", Value: deleted}}
+	if deleted {
+		set = append(set, bson.E{Key: "deletedAt", Value: time.Now()})
+	} else {
+		set = append(set, bson.E{Key: "deletedAt", Value: nil})
+	}
+	updated, err := UpdateItemVersioned(itemID, version, set, iCollection)
+	respondItemWrite(w, itemID, updated, err, iCollection)
+}
@@ -0,0 +1,281 @@
+package content
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+where uploaded files (item images for now) live. keys are slash separated paths like
+items/<id>/<name>.jpg; URL turns a key into what clients fetch. LocalBlobStore is the
+default and is served by this api itself, S3BlobStore talks to anything speaking the S3
+api (aws, minio, r2 ...) with hand rolled v4 signing so there's no sdk dependency.
+*/
+type BlobStore interface {
+	Put(ctx context.Context, key string, contentType string, data []byte) error
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+var errBadBlobKey = errors.New("blob key must be a relative path without ..")
+
+func cleanBlobKey(key string) (string, error) {
+	cleaned := filepath.ToSlash(filepath.Clean(key))
+	if len(key) == 0 || strings.HasPrefix(cleaned, "/") || strings.HasPrefix(cleaned, "..") {
+		return "", errBadBlobKey
+	}
+	return cleaned, nil
+}
+
+/*
+BLOB_BACKEND in ./.env: local (default) or s3.
+  - local: BLOB_DIR (default ./blobs), BLOB_BASE_URL (default /api/v1/blobs)
+  - s3: S3_ENDPOINT (e.g. https://s3.eu-west-1.amazonaws.com), S3_BUCKET, S3_REGION,
+    S3_ACCESS_KEY, S3_SECRET_KEY and S3_PUBLIC_URL (default endpoint/bucket)
+*/
+func LoadBlobStore() (BlobStore, error) {
+	switch backend := strings.ToLower(os.Getenv("BLOB_BACKEND")); backend {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if len(dir) == 0 {
+			dir = "./blobs"
+		}
+		baseURL := os.Getenv("BLOB_BASE_URL")
+		if len(baseURL) == 0 {
+			baseURL = "/api/v1/blobs"
+		}
+		return &LocalBlobStore{Dir: dir, BaseURL: baseURL}, nil
+	case "s3":
+		store := &S3BlobStore{
+			Endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PublicURL: strings.TrimSuffix(os.Getenv("S3_PUBLIC_URL"), "/"),
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}
+		if len(store.Endpoint) == 0 || len(store.Bucket) == 0 || len(store.AccessKey) == 0 ||
+			len(store.SecretKey) == 0 {
+			return nil, errors.New("BLOB_BACKEND=s3 needs S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY")
+		}
+		if len(store.Region) == 0 {
+			store.Region = "us-east-1"
+		}
+		if len(store.PublicURL) == 0 {
+			store.PublicURL = store.Endpoint + "/" + store.Bucket
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_BACKEND %q", backend)
+	}
+}
+
+// files under Dir, served at BaseURL by Handler
+type LocalBlobStore struct {
+	Dir     string
+	BaseURL string
+}
+
+func (store *LocalBlobStore) path(key string) (string, error) {
+	cleaned, err := cleanBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(store.Dir, filepath.FromSlash(cleaned)), nil
+}
+
+// written to a temp file then renamed, so a reader never sees half an image
+func (store *LocalBlobStore) Put(ctx context.Context, key string, contentType string,
+	data []byte) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) // no-op once renamed
+	if _, err = tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err = tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+func (store *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (store *LocalBlobStore) URL(key string) string {
+	return strings.TrimSuffix(store.BaseURL, "/") + "/" + key
+}
+
+// mount at BaseURL, e.g. router.PathPrefix("/api/v1/blobs/").Handler(store.Handler())
+func (store *LocalBlobStore) Handler() http.Handler {
+	fileServer := http.StripPrefix(strings.TrimSuffix(store.BaseURL, "/"),
+		http.FileServer(http.Dir(store.Dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r) // no directory listings
+			return
+		}
+		// keys are never overwritten, a new upload gets a new key
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// path style requests (endpoint/bucket/key) so it works with minio and friends too
+type S3BlobStore struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PublicURL string
+	Client    *http.Client
+}
+
+func (store *S3BlobStore) objectURL(key string) (string, error) {
+	cleaned, err := cleanBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	escaped := make([]string, 0)
+	for _, segment := range strings.Split(cleaned, "/") {
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+	return store.Endpoint + "/" + store.Bucket + "/" + strings.Join(escaped, "/"), nil
+}
+
+func (store *S3BlobStore) Put(ctx context.Context, key string, contentType string,
+	data []byte) error {
+	objectURL, err := store.objectURL(key)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL,
+		bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	return store.do(request, data)
+}
+
+func (store *S3BlobStore) Delete(ctx context.Context, key string) error {
+	objectURL, err := store.objectURL(key)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, objectURL, nil)
+	if err != nil {
+		return err
+	}
+	return store.do(request, nil)
+}
+
+func (store *S3BlobStore) URL(key string) string {
+	return store.PublicURL + "/" + key
+}
+
+func (store *S3BlobStore) do(request *http.Request, payload []byte) error {
+	store.sign(request, payload, time.Now().UTC())
+	response, err := store.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("s3 %s %s: %s %s", request.Method, request.URL.Path,
+			response.Status, body)
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// AWS signature version 4, signing host, content type, payload hash and date headers
+func (store *S3BlobStore) sign(request *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headerNames := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headerValues := map[string]string{
+		"host":                 request.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if contentType := request.Header.Get("Content-Type"); len(contentType) > 0 {
+		headerNames = []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+		headerValues["content-type"] = contentType
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headerValues[name]) + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + store.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+store.SecretKey), day)
+	signingKey = hmacSHA256(signingKey, store.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		store.AccessKey, scope, signedHeaders, signature))
+}
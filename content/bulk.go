@@ -0,0 +1,638 @@
+package content
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+a whole menu in or out of the items collection (the draft, see publish.go) as csv or json.
+  - export writes every item that isn't deleted. categories go out as slugs so a file from
+    one store imports into another with the same categories
+  - import upserts by sku: a known sku updates that item, a new one creates an item.
+    an update only changes the columns (json keys) the file has, like a PATCH, so a file
+    of just sku and cost reprices items and leaves the rest. an empty cell in a column
+    that is there clears the field, the report lists those under "cleared"
+  - items missing from the file are left alone, stock, images and bundle slots are never
+    touched
+  - every row is checked before anything is written; one bad row and nothing is, the
+    report lists each row's problems. dry_run only reports what would change
+  - on a replica set the writes are one transaction. standalone mongo has none, there a
+    failure part way leaves the rows before it written; the report comes back with the
+    error and marks those rows "written"
+csv has a column per field; lists are separated by |, and variants, modifierGroups,
+schedules and nutrition hold json since they don't flatten.
+*/
+
+const (
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+	ImportInvalid   = "invalid"
+
+	maxImportBytes = 10 << 20
+)
+
+var errImportConflict = errors.New("items changed while importing, run the import again")
+
+var csvColumns = []string{"sku", "name", "cost", "categories", "availability", "description",
+	"tags", "allergens", "dietary", "variants", "modifierGroups", "schedules", "nutrition"}
+
+// one row of an import or export file
+type ItemRecord struct {
+	SKU            string          `json:"sku"`
+	Name           string          `json:"name"`
+	Cost           Money           `json:"cost"`
+	Categories     []string        `json:"categories"` // slugs (or ids)
+	Availability   bool            `json:"availability"`
+	Description    string          `json:"description"`
+	Tags           []string        `json:"tags"`
+	Allergens      []string        `json:"allergens"`
+	Dietary        []string        `json:"dietary"`
+	Variants       []Variant       `json:"variants"`
+	ModifierGroups []ModifierGroup `json:"modifierGroups"`
+	Schedules      []Schedule      `json:"schedules"`
+	Nutrition      *Nutrition      `json:"nutrition,omitempty"`
+	// columns or keys the file has for this record, nil when it has them all
+	fields map[string]bool
+}
+
+type ImportRow struct {
+	Row     int              `json:"row"` // first record is 1, as a spreadsheet counts data rows
+	SKU     string           `json:"sku"`
+	Action  string           `json:"action"`
+	Changes []string         `json:"changes,omitempty"` // fields an update changes
+	Cleared []string         `json:"cleared,omitempty"` // of those, fields it empties
+	Errors  auth.FieldErrors `json:"errors,omitempty"`
+	// the create or update is in the items collection
+	Written bool `json:"written,omitempty"`
+}
+
+type ImportReport struct {
+	DryRun        bool           `json:"dryRun"`
+	Applied       bool           `json:"applied"`
+	Transactional bool           `json:"transactional"`
+	Counts        map[string]int `json:"counts"`
+	Rows          []ImportRow    `json:"rows"`
+	// why the writes stopped part way, see ImportItemsHandler
+	Error string `json:"error,omitempty"`
+}
+
+func itemRecord(item Item, tree *CategoryTree) ItemRecord {
+	record := ItemRecord{SKU: item.SKU, Name: item.Name, Cost: item.Cost,
+		Availability: item.Availability, Description: item.Description, Tags: item.Tags,
+		Allergens: item.Allergens, Dietary: item.Dietary, Variants: item.Variants,
+		ModifierGroups: item.ModifierGroups, Schedules: item.Schedules, Nutrition: item.Nutrition,
+		Categories: make([]string, 0, len(item.CategoryIDs))}
+	for _, categoryID := range item.CategoryIDs {
+		if node, found := tree.byID[categoryID]; found {
+			record.Categories = append(record.Categories, node.Slug)
+		} else {
+			record.Categories = append(record.Categories, categoryID.Hex())
+		}
+	}
+	return record
+}
+
+/*
+the item a record describes, checked the same way /admin/items checks a PUT. current is
+the item with the record's sku, nil for a new one; it keeps whatever the file has no
+column for, the way PatchItem keeps fields that weren't sent.
+*/
+func (record ItemRecord) toItem(tree *CategoryTree, current *Item, fieldErrs auth.FieldErrors) Item {
+	has := func(field string) bool {
+		return current == nil || record.fields == nil || record.fields[field]
+	}
+	input := ItemInput{SKU: &record.SKU}
+	if has("categories") {
+		categoryIDs := make([]string, 0, len(record.Categories))
+		for _, ref := range record.Categories {
+			node, found := tree.Lookup(ref)
+			if !found {
+				fieldErrs.Add("categories", fmt.Sprintf("unknown category %s", ref))
+				continue
+			}
+			categoryIDs = append(categoryIDs, node.ID.Hex())
+		}
+		input.CategoryIDs = &categoryIDs
+	}
+	if has("name") {
+		input.Name = &record.Name
+	}
+	if has("cost") {
+		input.Cost = &record.Cost
+	}
+	if has("availability") {
+		input.Availability = &record.Availability
+	}
+	if has("description") {
+		input.Description = &record.Description
+	}
+	if has("tags") {
+		input.Tags = &record.Tags
+	}
+	if has("allergens") {
+		input.Allergens = &record.Allergens
+	}
+	if has("dietary") {
+		input.Dietary = &record.Dietary
+	}
+	if has("variants") {
+		input.Variants = &record.Variants
+	}
+	if has("modifierGroups") {
+		input.ModifierGroups = &record.ModifierGroups
+	}
+	if has("schedules") {
+		input.Schedules = &record.Schedules
+	}
+	var item Item
+	if current != nil {
+		item = *current
+	}
+	input.applyTo(&item, fieldErrs)
+	// applyTo can't tell a cleared nutrition from one not sent
+	if has("nutrition") {
+		item.Nutrition = record.Nutrition
+	}
+	if len(item.SKU) == 0 {
+		fieldErrs.Add("sku", "required, import matches items on it")
+	}
+	ValidateItem(item, tree, fieldErrs)
+	return item
+}
+
+func splitCell(cell string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(cell, "|") {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func jsonCell(value interface{}) (string, error) {
+	cellJSON, err := json.Marshal(value)
+	if err != nil || string(cellJSON) == "null" || string(cellJSON) == "[]" {
+		return "", err
+	}
+	return string(cellJSON), nil
+}
+
+/*
+records from a file plus what's wrong with each row that didn't parse. err is for the
+file as a whole (not csv, unknown column, not a json array).
+*/
+func ParseItemRecords(format string, reader io.Reader) ([]ItemRecord, []auth.FieldErrors, error) {
+	switch format {
+	case "json":
+		var rawRecords []json.RawMessage
+		if err := json.NewDecoder(reader).Decode(&rawRecords); err != nil {
+			return nil, nil, fmt.Errorf("json must be an array of items: %v", err)
+		}
+		records := make([]ItemRecord, 0, len(rawRecords))
+		rowErrs := make([]auth.FieldErrors, 0, len(rawRecords))
+		for _, rawRecord := range rawRecords {
+			var record ItemRecord
+			var keys map[string]json.RawMessage
+			fieldErrs := make(auth.FieldErrors)
+			if err := json.Unmarshal(rawRecord, &keys); err != nil {
+				fieldErrs.Add("item", "must be an object")
+			} else if err = json.Unmarshal(rawRecord, &record); err != nil {
+				fieldErrs.Add("item", err.Error())
+			}
+			record.fields = make(map[string]bool, len(keys))
+			for key := range keys {
+				record.fields[key] = true
+			}
+			records = append(records, record)
+			rowErrs = append(rowErrs, fieldErrs)
+		}
+		return records, rowErrs, nil
+	case "csv":
+		return parseCSVRecords(reader)
+	}
+	return nil, nil, fmt.Errorf("format must be csv or json")
+}
+
+func parseCSVRecords(reader io.Reader) ([]ItemRecord, []auth.FieldErrors, error) {
+	csvReader := csv.NewReader(reader)
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("csv needs a header row: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for idx, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")) // excel's BOM
+		if !containsString(csvColumns, name) {
+			return nil, nil, fmt.Errorf("unknown column %q, columns are %s", name,
+				strings.Join(csvColumns, ","))
+		}
+		columns[name] = idx
+	}
+	if _, found := columns["sku"]; !found {
+		return nil, nil, fmt.Errorf("missing column \"sku\", import matches items on it")
+	}
+
+	records := make([]ItemRecord, 0)
+	rowErrs := make([]auth.FieldErrors, 0)
+	for {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		cell := func(name string) string {
+			if idx, found := columns[name]; found {
+				return strings.TrimSpace(row[idx])
+			}
+			return ""
+		}
+		fieldErrs := make(auth.FieldErrors)
+		record := ItemRecord{SKU: cell("sku"), Name: cell("name"),
+			Description: cell("description"), Availability: true,
+			Categories: splitCell(cell("categories")), Tags: splitCell(cell("tags")),
+			Allergens: splitCell(cell("allergens")), Dietary: splitCell(cell("dietary")),
+			fields: make(map[string]bool, len(columns))}
+		for name := range columns {
+			record.fields[name] = true
+		}
+		if _, found := columns["cost"]; found {
+			if record.Cost, err = ParseMoney(cell("cost"), DefaultCurrency()); err != nil {
+				fieldErrs.Add("cost", err.Error())
+			}
+		}
+		// blank means available for a new item and unchanged for an existing one
+		if rawAvailability := cell("availability"); len(rawAvailability) > 0 {
+			if record.Availability, err = strconv.ParseBool(rawAvailability); err != nil {
+				fieldErrs.Add("availability", "must be true or false")
+			}
+		} else {
+			delete(record.fields, "availability")
+		}
+		for _, column := range []struct {
+			name   string
+			target interface{}
+		}{
+			{"variants", &record.Variants}, {"modifierGroups", &record.ModifierGroups},
+			{"schedules", &record.Schedules}, {"nutrition", &record.Nutrition},
+		} {
+			if text := cell(column.name); len(text) > 0 {
+				if err = json.Unmarshal([]byte(text), column.target); err != nil {
+					fieldErrs.Add(column.name, fmt.Sprintf("must be json: %v", err))
+				}
+			}
+		}
+		records = append(records, record)
+		rowErrs = append(rowErrs, fieldErrs)
+	}
+	return records, rowErrs, nil
+}
+
+// every item that isn't deleted, by sku then name
+func ExportItems(ctx context.Context, format string, writer io.Writer,
+	iCollection *mongo.Collection, cCollection *mongo.Collection) error {
+	tree, err := LoadCategoryTree(cCollection)
+	if err != nil {
+		return err
+	}
+	resultCursor, err := iCollection.Find(ctx,
+		bson.D{{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}}},
+		options.Find().SetSort(bson.D{{Key: "sku", Value: 1}, {Key: "name", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var items []Item
+	if err = resultCursor.All(ctx, &items); err != nil {
+		return err
+	}
+	records := make([]ItemRecord, 0, len(items))
+	for _, item := range items {
+		records = append(records, itemRecord(item, tree))
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case "csv":
+		csvWriter := csv.NewWriter(writer)
+		csvWriter.Write(csvColumns)
+		for _, record := range records {
+			row := []string{record.SKU, record.Name, record.Cost.String(),
+				strings.Join(record.Categories, "|"), strconv.FormatBool(record.Availability),
+				record.Description, strings.Join(record.Tags, "|"),
+				strings.Join(record.Allergens, "|"), strings.Join(record.Dietary, "|")}
+			for _, value := range []interface{}{record.Variants, record.ModifierGroups,
+				record.Schedules, record.Nutrition} {
+				cell, err := jsonCell(value)
+				if err != nil {
+					return err
+				}
+				row = append(row, cell)
+			}
+			csvWriter.Write(row)
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	return fmt.Errorf("format must be csv or json")
+}
+
+func isEmpty(value interface{}) bool {
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Slice, reflect.String:
+		return reflected.Len() == 0
+	case reflect.Ptr:
+		return reflected.IsNil()
+	}
+	return false
+}
+
+// names of itemFields that differ between current and updated
+// and the ones of those updated empties
+func changedFields(current Item, updated Item) ([]string, []string) {
+	before, after := itemFields(current), itemFields(updated)
+	changes, cleared := make([]string, 0), make([]string, 0)
+	for idx := range after {
+		if isEmpty(before[idx].Value) && isEmpty(after[idx].Value) {
+			continue // null and [] are the same list
+		}
+		beforeBSON, _ := bson.Marshal(bson.D{before[idx]})
+		afterBSON, _ := bson.Marshal(bson.D{after[idx]})
+		if !bytes.Equal(beforeBSON, afterBSON) {
+			changes = append(changes, after[idx].Key)
+			if isEmpty(after[idx].Value) {
+				cleared = append(cleared, after[idx].Key)
+			}
+		}
+	}
+	return changes, cleared
+}
+
+// replica sets and mongos do transactions, a standalone server doesn't
+func supportsTransactions(ctx context.Context, db *mongo.Database) bool {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := db.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	return err == nil && (len(hello.SetName) > 0 || hello.Msg == "isdbgrid")
+}
+
+/*
+checks records against the items collection and, unless dryRun or a row is invalid,
+writes them. rowErrs are parse problems from ParseItemRecords, one per record. new items
+and new costs go in pCollection's price history once written.
+*/
+func ImportItems(ctx context.Context, records []ItemRecord, rowErrs []auth.FieldErrors,
+	dryRun bool, iCollection *mongo.Collection, cCollection *mongo.Collection,
+	pCollection *mongo.Collection) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Counts: make(map[string]int),
+		Rows: make([]ImportRow, 0, len(records))}
+	tree, err := LoadCategoryTree(cCollection)
+	if err != nil {
+		return report, err
+	}
+
+	skus := make([]string, 0, len(records))
+	for _, record := range records {
+		skus = append(skus, strings.TrimSpace(record.SKU))
+	}
+	resultCursor, err := iCollection.Find(ctx,
+		bson.D{{Key: "sku", Value: bson.D{{Key: "$in", Value: skus}}}})
+	if err != nil {
+		return report, err
+	}
+	var existing []Item
+	if err = resultCursor.All(ctx, &existing); err != nil {
+		return report, err
+	}
+	bySKU := make(map[string]Item, len(existing))
+	for _, item := range existing {
+		bySKU[item.SKU] = item
+	}
+
+	var writes []mongo.WriteModel
+	writeRows := make([]int, 0) // index in report.Rows of each write
+	updates := 0
+	repriced := make(map[int]Item) // by index in writes
+	firstRow := make(map[string]int)
+	for idx, record := range records {
+		fieldErrs := rowErrs[idx]
+		if fieldErrs == nil {
+			fieldErrs = make(auth.FieldErrors)
+		}
+		current, found := bySKU[strings.TrimSpace(record.SKU)]
+		var item Item
+		if found {
+			item = record.toItem(tree, &current, fieldErrs)
+		} else {
+			item = record.toItem(tree, nil, fieldErrs)
+		}
+		row := ImportRow{Row: idx + 1, SKU: item.SKU}
+		if earlier, seen := firstRow[item.SKU]; seen && len(item.SKU) > 0 {
+			fieldErrs.Add("sku", fmt.Sprintf("also on row %d", earlier))
+		} else {
+			firstRow[item.SKU] = idx + 1
+		}
+		switch {
+		case len(fieldErrs) > 0:
+			row.Action, row.Errors = ImportInvalid, fieldErrs
+		case !found:
+			row.Action = ImportCreate
+			item.ID, item.Version = primitive.NewObjectID(), 1
+			repriced[len(writes)] = item
+			writeRows = append(writeRows, len(report.Rows))
+			writes = append(writes, mongo.NewInsertOneModel().SetDocument(item))
+		default:
+			row.Changes, row.Cleared = changedFields(current, item)
+			if len(row.Changes) == 0 && !current.Deleted {
+				row.Action = ImportUnchanged
+				break
+			}
+			if current.Deleted {
+				row.Changes = append(row.Changes, "deleted")
+			}
+			row.Action = ImportUpdate
+			updates++
+			for _, field := range row.Changes {
+				if field == "cost" {
+					item.ID = current.ID
+					repriced[len(writes)] = item
+				}
+			}
+			set := append(itemFields(item), bson.E{Key: "deleted", Value: false})
+			writeRows = append(writeRows, len(report.Rows))
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(versionFilter(current.ID, current.Version)).
+				SetUpdate(bson.D{
+					{Key: "$set", Value: set},
+					{Key: "$unset", Value: bson.D{{Key: "deletedAt", Value: ""}}},
+					{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+				}))
+		}
+		report.Counts[row.Action]++
+		report.Rows = append(report.Rows, row)
+	}
+	if dryRun || report.Counts[ImportInvalid] > 0 || len(writes) == 0 {
+		return report, nil
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	db := iCollection.Database()
+	written := 0
+	if report.Transactional = supportsTransactions(writeCtx, db); report.Transactional {
+		session, err := db.Client().StartSession()
+		if err != nil {
+			return report, err
+		}
+		defer session.EndSession(context.Background())
+		_, err = session.WithTransaction(writeCtx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+			result, err := iCollection.BulkWrite(sessionCtx, writes)
+			if err != nil {
+				return nil, err
+			}
+			// an update that matched nothing lost a race with an admin edit
+			if result.MatchedCount < int64(updates) {
+				return nil, errImportConflict
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return report, err
+		}
+		written = len(writes)
+	} else {
+		// one write at a time, so a failure part way still knows which rows went in
+		for _, write := range writes {
+			var result *mongo.BulkWriteResult
+			if result, err = iCollection.BulkWrite(writeCtx, []mongo.WriteModel{write}); err != nil {
+				break
+			}
+			if _, isUpdate := write.(*mongo.UpdateOneModel); isUpdate && result.MatchedCount == 0 {
+				err = errImportConflict
+				break
+			}
+			written++
+		}
+	}
+	for idx := 0; idx < written; idx++ {
+		report.Rows[writeRows[idx]].Written = true
+		if item, ok := repriced[idx]; ok {
+			RecordPrice(ctx, item.ID, item.Cost, PriceFromImport, pCollection)
+		}
+	}
+	if err != nil {
+		return report, err
+	}
+	report.Applied = true
+	return report, nil
+}
+
+func bulkFormat(r *http.Request) string {
+	if format := strings.ToLower(r.URL.Query().Get("format")); len(format) > 0 {
+		return format
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+// GET /admin/items/export?format=csv|json, json by default
+func ExportItemsHandler(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is categories
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := bulkFormat(r)
+		if format != "csv" && format != "json" {
+			w.Header().Set("Content-Type", "application/json")
+			auth.RespondError(w, http.StatusBadRequest, "format must be csv or json")
+			return
+		}
+		// written to a buffer first so a failure part way is still a proper 500
+		var exported bytes.Buffer
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		if err := ExportItems(ctx, format, &exported, collections[0], collections[1]); err != nil {
+			fmt.Printf("item export failed: %v\n", err)
+			w.Header().Set("Content-Type", "application/json")
+			auth.RespondError(w, http.StatusInternalServerError, "could not export items")
+			return
+		}
+		contentType := "application/json"
+		if format == "csv" {
+			contentType = "text/csv; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename=items."+format)
+		w.Write(exported.Bytes())
+	})
+}
+
+/*
+POST /admin/items/import?format=csv|json&dry_run=true, the file as the body (format also
+taken from Content-Type: text/csv). 200 with the report when applied or dry run, 400 with
+it when a row is invalid, 409 with it and an "error" when items changed under the import
+(on standalone mongo rows before that may be written, see ImportRow.Written).
+*/
+func ImportItemsHandler(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is categories collections[2] is priceChanges
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+		records, rowErrs, err := ParseItemRecords(bulkFormat(r), body)
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+		defer cancel()
+		report, err := ImportItems(ctx, records, rowErrs, dryRun, collections[0], collections[1],
+			collections[2])
+		switch {
+		case err == errImportConflict || mongo.IsDuplicateKeyError(err):
+			report.Error = err.Error()
+			if err != errImportConflict {
+				report.Error = "an item with one of these skus was created meanwhile, run the import again"
+			}
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(report)
+			return
+		case err != nil:
+			fmt.Printf("item import failed: %v\n", err)
+			auth.RespondError(w, http.StatusInternalServerError, "could not import items")
+			return
+		}
+		if report.Counts[ImportInvalid] > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,306 @@
+package content
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+combo meals. an item with slots is a bundle: its Cost is the price of the whole combo and
+each slot (main, side, drink) is filled by one of the items it allows. the first choice is
+the default, the others are substitutions, any of which can cost extra (Upcharge).
+bundles are listed, filtered, categorised and published like any other item.
+in a cart a bundle line says what fills each slot. the line is priced as one unit and
+carries a component line per slot, so stock is reserved on the items actually served.
+a bundle can't be filled with another bundle.
+*/
+
+const (
+	maxSlotQuantity = 10
+	maxSlotChoices  = 50
+)
+
+type BundleChoice struct {
+	ItemID primitive.ObjectID `bson:"itemId" json:"itemId"`
+	// on top of the bundle's Cost for the whole slot, zero for most choices
+	Upcharge Money `bson:"upcharge" json:"upcharge"`
+	// filled in when the menu is served, see describeChoices
+	Name      string `bson:"-" json:"name,omitempty"`
+	Orderable *bool  `bson:"-" json:"orderable,omitempty"`
+}
+
+type BundleSlot struct {
+	ID   string `bson:"id" json:"id"`
+	Name string `bson:"name" json:"name"`
+	// how many of the chosen item one bundle comes with
+	Quantity int            `bson:"quantity" json:"quantity"`
+	Choices  []BundleChoice `bson:"choices" json:"choices"`
+}
+
+// what the client put in one slot. variants and modifiers are the chosen item's own,
+// their price deltas are added to the bundle's
+type SelectedSlot struct {
+	SlotID    string              `bson:"slotId" json:"slotId"`
+	ItemID    primitive.ObjectID  `bson:"itemId" json:"itemId"`
+	VariantID string              `bson:"variantId,omitempty" json:"variantId,omitempty"`
+	Modifiers []SelectedModifiers `bson:"modifiers" json:"modifiers"`
+}
+
+// shape checks on a bundle's slots, done when an item is written. whether the choices
+// exist is up to ValidateBundleChoices
+func ValidateBundle(item Item, fieldErrs auth.FieldErrors) {
+	if len(item.Slots) == 0 {
+		return
+	}
+	if len(item.Variants) > 0 || len(item.ModifierGroups) > 0 {
+		fieldErrs.Add("slots", "a bundle's options come from its slots, it can't have variants or modifier groups")
+	}
+	slotIDs := make(map[string]bool)
+	for idx, slot := range item.Slots {
+		field := fmt.Sprintf("slots[%d]", idx)
+		if len(slot.ID) == 0 || len(slot.Name) == 0 {
+			fieldErrs.Add(field, "id and name required")
+		}
+		if slotIDs[slot.ID] {
+			fieldErrs.Add(field, fmt.Sprintf("duplicate slot id %s", slot.ID))
+		}
+		slotIDs[slot.ID] = true
+		if slot.Quantity < 1 || slot.Quantity > maxSlotQuantity {
+			fieldErrs.Add(field+".quantity", fmt.Sprintf("must be from 1 to %d", maxSlotQuantity))
+		}
+		if len(slot.Choices) == 0 || len(slot.Choices) > maxSlotChoices {
+			fieldErrs.Add(field+".choices", fmt.Sprintf("from 1 to %d items, the first is the default",
+				maxSlotChoices))
+		}
+		chosen := make(map[primitive.ObjectID]bool)
+		for _, choice := range slot.Choices {
+			switch {
+			case choice.ItemID.IsZero():
+				fieldErrs.Add(field+".choices", "every choice needs an itemId")
+			case choice.ItemID == item.ID:
+				fieldErrs.Add(field+".choices", "a bundle can't contain itself")
+			case chosen[choice.ItemID]:
+				fieldErrs.Add(field+".choices", fmt.Sprintf("%s listed twice", choice.ItemID.Hex()))
+			}
+			chosen[choice.ItemID] = true
+			if choice.Upcharge.Currency != item.Cost.Currency {
+				fieldErrs.Add(field+".choices", fmt.Sprintf("upcharge for %s must be in %s",
+					choice.ItemID.Hex(), item.Cost.Currency))
+			} else if choice.Upcharge.Amount < 0 {
+				fieldErrs.Add(field+".choices", "upcharges can't be negative")
+			}
+		}
+	}
+}
+
+// every item a bundle's slots allow must exist, not be deleted and not be a bundle itself
+func ValidateBundleChoices(item Item, iCollection *mongo.Collection, fieldErrs auth.FieldErrors) error {
+	ids := make([]primitive.ObjectID, 0)
+	for _, slot := range item.Slots {
+		for _, choice := range slot.Choices {
+			ids = append(ids, choice.ItemID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	choices, err := GetMenu(bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}},
+		iCollection)
+	if err != nil {
+		return err
+	}
+	byID := make(map[primitive.ObjectID]Item, len(choices))
+	for _, choice := range choices {
+		byID[choice.ID] = choice
+	}
+	for idx, slot := range item.Slots {
+		field := fmt.Sprintf("slots[%d].choices", idx)
+		for _, choice := range slot.Choices {
+			found, ok := byID[choice.ItemID]
+			switch {
+			case !ok || found.Deleted:
+				fieldErrs.Add(field, fmt.Sprintf("no item %s", choice.ItemID.Hex()))
+			case len(found.Slots) > 0:
+				fieldErrs.Add(field, fmt.Sprintf("%s is a bundle itself", found.Name))
+			}
+		}
+	}
+	return nil
+}
+
+// trims names; a choice sent without an upcharge costs nothing extra, in the bundle's currency
+func normalizeSlots(slots []BundleSlot, currency string) []BundleSlot {
+	normalized := make([]BundleSlot, 0, len(slots))
+	for _, slot := range slots {
+		slot.ID, slot.Name = strings.TrimSpace(slot.ID), strings.TrimSpace(slot.Name)
+		choices := make([]BundleChoice, 0, len(slot.Choices))
+		for _, choice := range slot.Choices {
+			if choice.Upcharge.Amount == 0 && len(choice.Upcharge.Currency) == 0 {
+				choice.Upcharge.Currency = currency
+			}
+			choices = append(choices, choice)
+		}
+		slot.Choices = choices
+		normalized = append(normalized, slot)
+	}
+	return normalized
+}
+
+// items the bundle lines need besides their own: what's chosen, or each slot's default
+func componentIDs(lines []CartLine, itemsByID map[primitive.ObjectID]Item) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0)
+	for _, line := range lines {
+		for _, selected := range line.Slots {
+			ids = append(ids, selected.ItemID)
+		}
+		for _, slot := range itemsByID[line.ItemID].Slots {
+			if len(slot.Choices) > 0 {
+				ids = append(ids, slot.Choices[0].ItemID)
+			}
+		}
+	}
+	missing := make([]primitive.ObjectID, 0, len(ids))
+	for _, itemID := range ids {
+		if _, found := itemsByID[itemID]; !found {
+			missing = append(missing, itemID)
+		}
+	}
+	return missing
+}
+
+/*
+prices a bundle line that PriceCartLine has already checked against the bundle itself:
+fills each slot (with its default when the client left it out), checks what's in it the
+way a line of its own is checked, and adds upcharges and the chosen items' variant and
+modifier deltas to the bundle's price. components get Quantity for the whole line (for
+stock) and UnitPrice/LinePrice of what they add per bundle/for the line, which is already
+in the bundle line's prices.
+*/
+func priceBundleLine(line CartLine, bundle Item, itemsByID map[primitive.ObjectID]Item,
+	tree *CategoryTree, now time.Time, field string, fieldErrs auth.FieldErrors) CartLine {
+	selections := make(map[string]SelectedSlot)
+	for _, selected := range line.Slots {
+		if _, repeated := selections[selected.SlotID]; repeated {
+			fieldErrs.Add(field+".slots", fmt.Sprintf("slot %s filled twice", selected.SlotID))
+		}
+		selections[selected.SlotID] = selected
+	}
+	knownSlots := make(map[string]bool)
+	unitPrice := line.UnitPrice
+	allergens := append([]string{}, line.Allergens...)
+	line.Components = make([]CartLine, 0, len(bundle.Slots))
+	for _, slot := range bundle.Slots {
+		knownSlots[slot.ID] = true
+		slotField := fmt.Sprintf("%s.slots.%s", field, slot.ID)
+		selected, picked := selections[slot.ID]
+		if !picked && len(slot.Choices) > 0 {
+			selected = SelectedSlot{SlotID: slot.ID, ItemID: slot.Choices[0].ItemID}
+		}
+		var choice *BundleChoice
+		for idx := range slot.Choices {
+			if slot.Choices[idx].ItemID == selected.ItemID {
+				choice = &slot.Choices[idx]
+			}
+		}
+		item, found := itemsByID[selected.ItemID]
+		switch {
+		case choice == nil && found:
+			fieldErrs.Add(slotField, fmt.Sprintf("%s can't go in %s", item.Name, slot.Name))
+			continue
+		case choice == nil:
+			fieldErrs.Add(slotField, fmt.Sprintf("%s can't go in %s", selected.ItemID.Hex(), slot.Name))
+			continue
+		case !found:
+			fieldErrs.Add(slotField, fmt.Sprintf("%s is not on the menu", selected.ItemID.Hex()))
+			continue
+		case len(item.Slots) > 0:
+			fieldErrs.Add(slotField, fmt.Sprintf("%s is a bundle itself", item.Name))
+			continue
+		}
+		if !ItemOpenAt(item, tree, now) {
+			fieldErrs.Add(slotField, fmt.Sprintf("%s is not served at this time", item.Name))
+		}
+		component := PriceCartLine(CartLine{ItemID: item.ID, VariantID: selected.VariantID,
+			Modifiers: selected.Modifiers, Quantity: 1}, item, slotField, fieldErrs)
+		// the item's own price is in the bundle's, only what was chosen on top counts
+		deltas, err := component.UnitPrice.Add(NewMoney(-item.Cost.Amount, item.Cost.Currency))
+		if err != nil {
+			continue // PriceCartLine said why
+		}
+		extra := addDelta(choice.Upcharge, deltas.Mul(int64(slot.Quantity)), slotField, fieldErrs)
+		component.Quantity = slot.Quantity * line.Quantity
+		component.UnitPrice = extra
+		component.LinePrice = extra.Mul(int64(line.Quantity))
+		unitPrice = addDelta(unitPrice, extra, slotField, fieldErrs)
+		allergens = append(allergens, component.Allergens...)
+		line.Components = append(line.Components, component)
+	}
+	for slotID := range selections {
+		if !knownSlots[slotID] {
+			fieldErrs.Add(field+".slots", fmt.Sprintf("bundle has no slot %s", slotID))
+		}
+	}
+	line.Allergens = normalizeLabels(allergens)
+	sort.Strings(line.Allergens)
+	line.UnitPrice = unitPrice
+	line.LinePrice = unitPrice.Mul(int64(line.Quantity))
+	return line
+}
+
+/*
+names the items the bundles among items can be filled with, in the caller's language,
+and says whether each can be ordered now (orderable is what the menu lists). slots are
+copied first: items may share them with the snapshot, which is never modified.
+*/
+func (snapshot *MenuSnapshot) describeChoices(items []Item, chain []string,
+	orderable MenuFilter) error {
+	ids := make([]primitive.ObjectID, 0)
+	for _, item := range items {
+		for _, slot := range item.Slots {
+			for _, choice := range slot.Choices {
+				ids = append(ids, choice.ItemID)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	byID, err := snapshot.itemsByID(ids)
+	if err != nil {
+		return err
+	}
+	soldOut := make(map[primitive.ObjectID]bool, len(snapshot.SoldOut))
+	for _, itemID := range snapshot.SoldOut {
+		soldOut[itemID] = true
+	}
+	for idx := range items {
+		if len(items[idx].Slots) == 0 {
+			continue
+		}
+		slots := make([]BundleSlot, 0, len(items[idx].Slots))
+		for _, slot := range items[idx].Slots {
+			choices := make([]BundleChoice, 0, len(slot.Choices))
+			for _, choice := range slot.Choices {
+				item, found := byID[choice.ItemID]
+				if found {
+					choice.Name = localizeItem(item, chain).Name
+				}
+				canOrder := found && !soldOut[item.ID] && orderable.Matches(item)
+				choice.Orderable = &canOrder
+				choices = append(choices, choice)
+			}
+			slot.Choices = choices
+			slots = append(slots, slot)
+		}
+		items[idx].Slots = slots
+	}
+	return nil
+}
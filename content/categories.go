@@ -0,0 +1,380 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+menu categories live in their own collection and form a tree through ParentID.
+items point at categories with Item.CategoryIDs; filtering by a category matches items
+in it or anywhere below it, so types=drinks also finds items only tagged hot-drinks.
+Item.Classification is the old flat string, kept readable for old clients and turned
+into categories once by MigrateClassifications.
+*/
+type Category struct {
+	ID           primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Name         string              `bson:"name" json:"name"`
+	Slug         string              `bson:"slug" json:"slug"`
+	ParentID     *primitive.ObjectID `bson:"parentId,omitempty" json:"parentId,omitempty"`
+	DisplayOrder int                 `bson:"displayOrder" json:"displayOrder"`
+	Image        string              `bson:"image,omitempty" json:"image,omitempty"`
+	// closes every item in it and below it outside these times, see schedule.go
+	Schedules []Schedule `bson:"schedules" json:"schedules"`
+	// language tag -> name, see locale.go
+	Translations map[string]CategoryTranslation `bson:"translations,omitempty" json:"translations,omitempty"`
+}
+
+type CategoryNode struct {
+	Category
+	Children []*CategoryNode `json:"children"`
+}
+
+// snapshot of every category, for resolving slugs and walking descendants
+type CategoryTree struct {
+	byID   map[primitive.ObjectID]*CategoryNode
+	bySlug map[string]*CategoryNode
+	Roots  []*CategoryNode
+}
+
+func Slugify(name string) string {
+	var slug strings.Builder
+	lastDash := true // no leading dash
+	for _, char := range strings.ToLower(strings.TrimSpace(name)) {
+		if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			slug.WriteRune(char)
+			lastDash = false
+		} else if !lastDash {
+			slug.WriteRune('-')
+			lastDash = true
+		}
+	}
+	return strings.TrimSuffix(slug.String(), "-")
+}
+
+func BuildCategoryTree(categories []Category) *CategoryTree {
+	tree := &CategoryTree{
+		byID:   make(map[primitive.ObjectID]*CategoryNode),
+		bySlug: make(map[string]*CategoryNode),
+	}
+	for _, category := range categories {
+		node := &CategoryNode{Category: category, Children: []*CategoryNode{}}
+		tree.byID[category.ID] = node
+		tree.bySlug[category.Slug] = node
+	}
+	for _, node := range tree.byID {
+		var parent *CategoryNode
+		if node.ParentID != nil {
+			parent = tree.byID[*node.ParentID]
+		}
+		if parent == nil {
+			// orphans (parent deleted) show at top level rather than vanish
+			tree.Roots = append(tree.Roots, node)
+			continue
+		}
+		parent.Children = append(parent.Children, node)
+	}
+	sortNodes(tree.Roots)
+	return tree
+}
+
+func sortNodes(nodes []*CategoryNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].DisplayOrder != nodes[j].DisplayOrder {
+			return nodes[i].DisplayOrder < nodes[j].DisplayOrder
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	for _, node := range nodes {
+		sortNodes(node.Children)
+	}
+}
+
+// slug or hex id -> category
+func (tree *CategoryTree) Lookup(ref string) (*CategoryNode, bool) {
+	if node, found := tree.bySlug[ref]; found {
+		return node, true
+	}
+	if categoryID, err := primitive.ObjectIDFromHex(ref); err == nil {
+		node, found := tree.byID[categoryID]
+		return node, found
+	}
+	return nil, false
+}
+
+// id of node and everything below it, each once. guards against cycles like IsAncestor:
+// the write path checks parents but documents edited by hand may loop
+func (tree *CategoryTree) Descendants(node *CategoryNode) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0)
+	seen := make(map[primitive.ObjectID]bool)
+	var walk func(node *CategoryNode)
+	walk = func(node *CategoryNode) {
+		if seen[node.ID] {
+			return
+		}
+		seen[node.ID] = true
+		ids = append(ids, node.ID)
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	walk(node)
+	return ids
+}
+
+// true if ancestorID is categoryID or one of its parents, guards against cycles
+func (tree *CategoryTree) IsAncestor(ancestorID, categoryID primitive.ObjectID) bool {
+	for steps, current := 0, tree.byID[categoryID]; current != nil && steps <= len(tree.byID); steps++ {
+		if current.ID == ancestorID {
+			return true
+		}
+		if current.ParentID == nil {
+			return false
+		}
+		current = tree.byID[*current.ParentID]
+	}
+	return false
+}
+
+func LoadCategoryTree(cCollection *mongo.Collection) (*CategoryTree, error) {
+	findCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	resultCursor, err := cCollection.Find(findCtx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	categories := make([]Category, 0)
+	if err = resultCursor.All(findCtx, &categories); err != nil {
+		return nil, err
+	}
+	return BuildCategoryTree(categories), nil
+}
+
+// turns slugs/ids from the types parameter into every category id they cover
+func ResolveCategoryFilter(refs []string, tree *CategoryTree,
+	fieldErrs auth.FieldErrors) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0)
+	for _, ref := range refs {
+		node, found := tree.Lookup(ref)
+		if !found {
+			// old clients send classification strings, which became slugs
+			node, found = tree.Lookup(Slugify(ref))
+		}
+		if !found {
+			fieldErrs.Add("types", fmt.Sprintf("unknown category %s", ref))
+			continue
+		}
+		ids = append(ids, tree.Descendants(node)...)
+	}
+	return ids
+}
+
+func EnsureCategoryIndexes(cCollection *mongo.Collection) error {
+	_, err := cCollection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "slug", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+/*
+one off (but safe to run every start): every distinct classification on items without
+categoryIds becomes a top level category, and those items get pointed at it.
+*/
+func MigrateClassifications(iCollection, cCollection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	unmigrated := bson.D{{Key: "categoryIds", Value: bson.D{{Key: "$exists", Value: false}}}}
+	classifications, err := iCollection.Distinct(ctx, "classification", unmigrated)
+	if err != nil {
+		return err
+	}
+	for _, rawClassification := range classifications {
+		classification, isString := rawClassification.(string)
+		if !isString || len(Slugify(classification)) == 0 {
+			continue
+		}
+		var category Category
+		err = cCollection.FindOneAndUpdate(ctx,
+			bson.D{{Key: "slug", Value: Slugify(classification)}},
+			bson.D{{Key: "$setOnInsert", Value: bson.D{
+				{Key: "name", Value: classification},
+				{Key: "displayOrder", Value: 0},
+			}}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&category)
+		if err != nil {
+			return err
+		}
+		_, err = iCollection.UpdateMany(ctx,
+			append(bson.D{{Key: "classification", Value: classification}}, unmigrated...),
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "categoryIds", Value: bson.A{category.ID}},
+			}}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GET /content/categories, whole tree ordered by displayOrder then name
+func GetCategoriesHandler(cache MenuCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		snapshot, err := cache.Current(r.Context())
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		chain := RequestLanguages(r, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("Content-Language", contentLanguage(chain))
+		roots := localizeCategories(snapshot.Tree.Roots, chain)
+		json.NewEncoder(w).Encode(roots)
+	})
+}
+
+type CategoryInput struct {
+	Name         string     `json:"name"`
+	Slug         string     `json:"slug"`
+	ParentID     string     `json:"parentId"`
+	DisplayOrder int        `json:"displayOrder"`
+	Image        string     `json:"image"`
+	Schedules    []Schedule `json:"schedules"`
+}
+
+func readCategory(r *http.Request, tree *CategoryTree,
+	fieldErrs auth.FieldErrors) (Category, error) {
+	var input CategoryInput
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(bodyBytes, &input)
+	}
+	if err != nil {
+		return Category{}, err
+	}
+	category := Category{
+		Name:         strings.TrimSpace(input.Name),
+		Slug:         Slugify(input.Slug),
+		DisplayOrder: input.DisplayOrder,
+		Image:        strings.TrimSpace(input.Image),
+		Schedules:    normalizeSchedules(input.Schedules, "schedules", fieldErrs),
+	}
+	if len(category.Name) == 0 {
+		fieldErrs.Add("name", "required")
+	}
+	if len(category.Slug) == 0 {
+		category.Slug = Slugify(category.Name)
+	}
+	if len(input.ParentID) > 0 {
+		parent, found := tree.Lookup(input.ParentID)
+		if !found {
+			fieldErrs.Add("parentId", "no such category")
+		} else {
+			category.ParentID = &parent.ID
+		}
+	}
+	return category, nil
+}
+
+// POST /admin/categories
+func CreateCategory(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is categories
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		tree, err := LoadCategoryTree(collections[0])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		category, err := readCategory(r, tree, fieldErrs)
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, "bad category json")
+			return
+		}
+		if _, taken := tree.bySlug[category.Slug]; taken {
+			fieldErrs.Add("slug", "already used by another category")
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		inserted, err := collections[0].InsertOne(context.TODO(), category)
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not create category")
+			return
+		}
+		category.ID = inserted.InsertedID.(primitive.ObjectID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(category)
+	})
+}
+
+// PUT /admin/categories/{id}, moving under one of its own descendants is refused
+func ReplaceCategory(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is categories
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		categoryID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such category")
+			return
+		}
+		tree, err := LoadCategoryTree(collections[0])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+		if _, found := tree.byID[categoryID]; !found {
+			auth.RespondError(w, http.StatusNotFound, "no such category")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		category, err := readCategory(r, tree, fieldErrs)
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, "bad category json")
+			return
+		}
+		if other, taken := tree.bySlug[category.Slug]; taken && other.ID != categoryID {
+			fieldErrs.Add("slug", "already used by another category")
+		}
+		if category.ParentID != nil && tree.IsAncestor(categoryID, *category.ParentID) {
+			fieldErrs.Add("parentId", "category can't be placed under itself")
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		category.ID = categoryID
+		// managed through /translations, not part of the category body
+		category.Translations = tree.byID[categoryID].Translations
+		_, err = collections[0].ReplaceOne(context.TODO(),
+			bson.D{{Key: "_id", Value: categoryID}}, category)
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not save category")
+			return
+		}
+		json.NewEncoder(w).Encode(category)
+	})
+}
@@ -0,0 +1,46 @@
+package content
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCategoryDescendants(t *testing.T) {
+	ids := make([]primitive.ObjectID, 5)
+	for idx := range ids {
+		ids[idx] = primitive.ObjectID{0xca, byte(idx + 1)}
+	}
+	// drinks > hot-drinks > coffee, and loop-a <-> loop-b pointing at each other
+	tree := BuildCategoryTree([]Category{
+		{ID: ids[0], Slug: "drinks"},
+		{ID: ids[1], Slug: "hot-drinks", ParentID: &ids[0]},
+		{ID: ids[2], Slug: "coffee", ParentID: &ids[1]},
+		{ID: ids[3], Slug: "loop-a", ParentID: &ids[4]},
+		{ID: ids[4], Slug: "loop-b", ParentID: &ids[3]},
+	})
+	tests := []struct {
+		slug string
+		want []primitive.ObjectID
+	}{
+		{"drinks", ids[0:3]},
+		{"hot-drinks", ids[1:3]},
+		{"coffee", ids[2:3]},
+		{"loop-a", ids[3:5]},
+	}
+	for _, test := range tests {
+		t.Run(test.slug, func(t *testing.T) {
+			node, found := tree.Lookup(test.slug)
+			if !found {
+				t.Fatalf("no category %s", test.slug)
+			}
+			got := tree.Descendants(node)
+			sort.Slice(got, func(i, j int) bool { return got[i].Hex() < got[j].Hex() })
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
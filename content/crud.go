@@ -7,7 +7,10 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+
+	auth "gorilla-mongo-api/auth"
 )
 
 // blueprints to give result variable a type,
@@ -23,17 +26,55 @@ type Session struct {
 }
 
 type Item struct {
-	Name           string `bson:"name"`
-	Cost           int    `bson:"cost"`
-	Classification string `bson:"classification"`
-	Availability   bool   `bson:"availability"`
+	ID primitive.ObjectID `bson:"_id,omitempty"`
+	// staff's own code for the item, unique when set; bulk import matches on it
+	SKU  string `bson:"sku"`
+	Name string `bson:"name"`
+	Cost Money  `bson:"cost"`
+	// deprecated flat category, superseded by CategoryIDs
+	Classification string               `bson:"classification"`
+	CategoryIDs    []primitive.ObjectID `bson:"categoryIds"`
+	Availability   bool                 `bson:"availability"`
+	Description    string               `bson:"description"`
+	Tags           []string             `bson:"tags"`
+	Variants       []Variant            `bson:"variants"`
+	ModifierGroups []ModifierGroup      `bson:"modifierGroups"`
+	// only bundles (combo meals) have slots, see bundles.go
+	Slots []BundleSlot `bson:"slots"`
+	// language tag -> name and description in that language, see locale.go
+	Translations map[string]ItemTranslation `bson:"translations,omitempty"`
+	// see dietary.go
+	Allergens []string   `bson:"allergens"`
+	Dietary   []string   `bson:"dietary"`
+	Nutrition *Nutrition `bson:"nutrition,omitempty"`
+	// when it can be ordered, see schedule.go. none means whenever available
+	Schedules []Schedule `bson:"schedules"`
+	// photos uploaded through /admin/items/{id}/images, first one is the main photo
+	Images []ItemImage `bson:"images"`
+	// counted stock, nil when not counted. see inventory.go
+	Stock             *int64 `bson:"stock,omitempty"`
+	Reserved          int64  `bson:"reserved"`
+	LowStockThreshold int64  `bson:"lowStockThreshold"`
+	// availability was turned off by stock reaching zero, restocking turns it back on
+	SoldOut bool `bson:"soldOut"`
+	// approved reviews, filled in from the menu cache when serving; never stored. see reviews.go
+	Rating *RatingSummary `bson:"-"`
+	// how often item is ordered, only used to sort the menu for now
+	Popularity int64 `bson:"popularity"`
+	// bumped on every admin write; a write naming an older version is rejected
+	Version int64 `bson:"version"`
+	// soft delete: hidden from menu but restorable from /admin/items
+	Deleted   bool       `bson:"deleted"`
+	DeletedAt *time.Time `bson:"deletedAt,omitempty"`
 }
 
 type Cart struct {
-	Items      []Item `bson:"items"`
-	User       string `bson:"user"`
-	Session    string `bson:"session"`
-	LastUpdate int64  `bson:"lastUpdate"`
+	Items      []Item     `bson:"items"`
+	Lines      []CartLine `bson:"lines"`
+	Total      Money      `bson:"total"`
+	User       string     `bson:"user"`
+	Session    string     `bson:"session"`
+	LastUpdate int64      `bson:"lastUpdate"`
 }
 
 func GetCart(sessionID string, cCollection *mongo.Collection) (map[string]interface{}, error) {
@@ -51,14 +92,14 @@ func GetCart(sessionID string, cCollection *mongo.Collection) (map[string]interf
 	return result, nil // bson.M just fancy wrapping for map[string]interface{}
 }
 
-func UpsertCart(filter bson.D, cCollection *mongo.Collection) error {
-	// considering that upsert may create new document will need to put req body
-	// into bson.D and then pass as param to SetUpdate(), along with $set lastUpdate.
+func UpsertCart(filter bson.D, cartFields bson.D, cCollection *mongo.Collection) error {
+	// considering that upsert may create new document, req body is put into bson.D
+	// cartFields and passed to SetUpdate(), along with $set lastUpdate.
 	timeAtUpsert := time.Now().Unix()
 	timestamp := bson.D{
-		{Key: "$set", Value: bson.D{
+		{Key: "$set", Value: append(bson.D{
 			{Key: "lastUpdate", Value: timeAtUpsert},
-		}},
+		}, cartFields...)},
 	}
 	bwModelSlice := []mongo.WriteModel{
 		mongo.NewUpdateOneModel().SetFilter(filter).
@@ -83,19 +124,86 @@ func GetMenu(filter bson.D, iCollection *mongo.Collection) ([]Item, error) {
 		fmt.Printf("get menu mongo api Find() failed: %v", err)
 		return nil, err
 	}
-	// not expecting more than 50 items in collection right now
-	retItems := make([]Item, 0, 50)
-	// context.Background; no initial deadline, no initial cancellation (Done) channel
-	cursCtx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
-	defer cancel()
-	for another := resultCursor.Next(cursCtx); another; another = resultCursor.Next(cursCtx) {
-		var item Item
-		err = resultCursor.Decode(&item)
+	// whole result shares the find deadline; a short separate one for the cursor cut
+	// large menus off part way through. use GetMenuPage where result could be big
+	retItems := make([]Item, 0)
+	err = resultCursor.All(findCtx, &retItems)
+	if err != nil {
+		fmt.Printf("issues decoding cursor docs into go values: %v", err)
+		return nil, err
+	}
+	return retItems, nil
+}
+
+/*
+validates and prices every line against current items, fetched in one query (two with
+bundles), and refuses items whose schedules (or whose categories') are closed right now.
+prices (from LivePrices) override the items' costs. a line that's also in held, the cart
+as saved, keeps its price from there while the hold lasts, see holdPrice
+*/
+func PriceCart(lines []CartLine, held []CartLine, tree *CategoryTree,
+	iCollection *mongo.Collection, prices map[primitive.ObjectID]Money,
+	fieldErrs auth.FieldErrors) ([]CartLine, Money, error) {
+	itemIDs := make([]primitive.ObjectID, 0, len(lines))
+	for _, line := range lines {
+		itemIDs = append(itemIDs, line.ItemID)
+	}
+	items, err := GetMenu(bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: itemIDs}}}},
+		iCollection)
+	if err != nil {
+		return nil, Money{}, err
+	}
+	itemsByID := make(map[primitive.ObjectID]Item, len(items))
+	for _, item := range items {
+		itemsByID[item.ID] = item
+	}
+	// what fills bundles' slots
+	if missing := componentIDs(lines, itemsByID); len(missing) > 0 {
+		components, err := GetMenu(bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: missing}}}},
+			iCollection)
 		if err != nil {
-			fmt.Printf("issues decoding current cursor doc into go value: %v", err)
-			return nil, err
+			return nil, Money{}, err
+		}
+		for _, item := range components {
+			itemsByID[item.ID] = item
 		}
-		retItems = append(retItems, item)
 	}
-	return retItems, nil
+	for itemID, cost := range prices {
+		if item, found := itemsByID[itemID]; found {
+			item.Cost = cost
+			itemsByID[itemID] = item
+		}
+	}
+	heldByKey := heldLines(held)
+	priced := make([]CartLine, 0, len(lines))
+	var total Money
+	now := time.Now()
+	for idx, line := range lines {
+		field := fmt.Sprintf("lines[%d]", idx)
+		item, found := itemsByID[line.ItemID]
+		if !found {
+			fieldErrs.Add(field+".itemId", "no such item")
+			continue
+		}
+		if !ItemOpenAt(item, tree, now) {
+			fieldErrs.Add(field, fmt.Sprintf("%s is not served at this time", item.Name))
+		}
+		line.Components = nil
+		line = PriceCartLine(line, item, field, fieldErrs)
+		switch {
+		case len(item.Slots) > 0:
+			line = priceBundleLine(line, item, itemsByID, tree, now, field, fieldErrs)
+		case len(line.Slots) > 0:
+			fieldErrs.Add(field+".slots", fmt.Sprintf("%s is not a bundle", item.Name))
+		}
+		line = holdPrice(line, heldByKey, now)
+		priced = append(priced, line)
+		if len(total.Currency) == 0 {
+			total = line.LinePrice
+		} else if total, err = total.Add(line.LinePrice); err != nil {
+			fieldErrs.Add(field, fmt.Sprintf("priced in %s, cart is in %s",
+				line.LinePrice.Currency, total.Currency))
+		}
+	}
+	return priced, total, nil
 }
@@ -0,0 +1,344 @@
+package content
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+what's in an item, for customers with allergies or diets. allergens are the 14 the EU
+requires on menus and dietary labels a fixed set, so a filter for "milk" can't miss an
+item tagged "dairy". variants and modifier options list the allergens they add (cheese
+adds milk); cart lines carry the item's allergens plus those of what was chosen.
+menu filters only see the item's own allergens, so an item may still offer an option
+that adds an excluded allergen; the cart line will show it.
+*/
+
+var knownAllergens = map[string]bool{
+	"celery": true, "crustaceans": true, "eggs": true, "fish": true, "gluten": true,
+	"lupin": true, "milk": true, "molluscs": true, "mustard": true, "nuts": true,
+	"peanuts": true, "sesame": true, "soya": true, "sulphites": true,
+}
+
+// label -> allergens an item with that label can't contain
+var knownDietary = map[string][]string{
+	"vegan":          {"crustaceans", "eggs", "fish", "milk", "molluscs"},
+	"vegetarian":     {"crustaceans", "fish", "molluscs"},
+	"gluten-free":    {"gluten"},
+	"dairy-free":     {"milk"},
+	"nut-free":       {"nuts", "peanuts"},
+	"halal":          {},
+	"kosher":         {},
+	"pescatarian":    {},
+	"egg-free":       {"eggs"},
+	"soy-free":       {"soya"},
+	"sesame-free":    {"sesame"},
+	"shellfish-free": {"crustaceans", "molluscs"},
+}
+
+// per serving, every field optional
+type Nutrition struct {
+	ServingGrams   *float64 `bson:"servingGrams,omitempty" json:"servingGrams,omitempty"`
+	Calories       *float64 `bson:"calories,omitempty" json:"calories,omitempty"` // kcal
+	FatGrams       *float64 `bson:"fatGrams,omitempty" json:"fatGrams,omitempty"`
+	SaturatesGrams *float64 `bson:"saturatesGrams,omitempty" json:"saturatesGrams,omitempty"`
+	CarbsGrams     *float64 `bson:"carbsGrams,omitempty" json:"carbsGrams,omitempty"`
+	SugarsGrams    *float64 `bson:"sugarsGrams,omitempty" json:"sugarsGrams,omitempty"`
+	ProteinGrams   *float64 `bson:"proteinGrams,omitempty" json:"proteinGrams,omitempty"`
+	SaltGrams      *float64 `bson:"saltGrams,omitempty" json:"saltGrams,omitempty"`
+}
+
+// for error messages
+func allergenNames() string {
+	names := make([]string, 0, len(knownAllergens))
+	for name := range knownAllergens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func dietaryNames() string {
+	names := make([]string, 0, len(knownDietary))
+	for name := range knownDietary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func validateAllergens(allergens []string, field string, fieldErrs auth.FieldErrors) {
+	for _, allergen := range allergens {
+		if !knownAllergens[allergen] {
+			fieldErrs.Add(field, fmt.Sprintf("unknown allergen %q, use one of %s",
+				allergen, allergenNames()))
+		}
+	}
+}
+
+// allergens in every one of lists
+func commonAllergens(lists [][]string) []string {
+	if len(lists) == 0 {
+		return nil
+	}
+	common := make([]string, 0)
+	for _, allergen := range lists[0] {
+		inAll := true
+		for _, list := range lists[1:] {
+			inAll = inAll && containsString(list, allergen)
+		}
+		if inAll {
+			common = append(common, allergen)
+		}
+	}
+	return common
+}
+
+// allergen -> why every order of the item has it although the item doesn't list it:
+// every variant adds it, or every option of a group that must be picked from does
+func unavoidableAllergens(item Item) map[string]string {
+	unavoidable := make(map[string]string)
+	variantAllergens := make([][]string, 0, len(item.Variants))
+	for _, variant := range item.Variants {
+		variantAllergens = append(variantAllergens, variant.Allergens)
+	}
+	for _, allergen := range commonAllergens(variantAllergens) {
+		unavoidable[allergen] = "every variant adds it"
+	}
+	for _, group := range item.ModifierGroups {
+		if group.MinSelect == 0 {
+			continue
+		}
+		optionAllergens := make([][]string, 0, len(group.Options))
+		for _, option := range group.Options {
+			optionAllergens = append(optionAllergens, option.Allergens)
+		}
+		for _, allergen := range commonAllergens(optionAllergens) {
+			if _, found := unavoidable[allergen]; !found {
+				unavoidable[allergen] = fmt.Sprintf("every option of required group %s adds it",
+					group.ID)
+			}
+		}
+	}
+	return unavoidable
+}
+
+/*
+labels and allergens known, labels not contradicted by allergens, nutrition not negative.
+a label is also contradicted when no order can avoid the allergen, see unavoidableAllergens
+*/
+func ValidateDietary(item Item, fieldErrs auth.FieldErrors) {
+	validateAllergens(item.Allergens, "allergens", fieldErrs)
+	contains := make(map[string]bool)
+	for _, allergen := range item.Allergens {
+		contains[allergen] = true
+	}
+	unavoidable := unavoidableAllergens(item)
+	for _, label := range item.Dietary {
+		excluded, known := knownDietary[label]
+		if !known {
+			fieldErrs.Add("dietary", fmt.Sprintf("unknown label %q, use one of %s",
+				label, dietaryNames()))
+			continue
+		}
+		for _, allergen := range excluded {
+			if contains[allergen] {
+				fieldErrs.Add("dietary", fmt.Sprintf("%s item can't contain %s", label, allergen))
+			} else if reason, found := unavoidable[allergen]; found {
+				fieldErrs.Add("dietary", fmt.Sprintf("%s item can't contain %s, %s",
+					label, allergen, reason))
+			}
+		}
+	}
+	if item.Nutrition != nil {
+		nutrition := item.Nutrition
+		for name, value := range map[string]*float64{
+			"servingGrams": nutrition.ServingGrams, "calories": nutrition.Calories,
+			"fatGrams": nutrition.FatGrams, "saturatesGrams": nutrition.SaturatesGrams,
+			"carbsGrams": nutrition.CarbsGrams, "sugarsGrams": nutrition.SugarsGrams,
+			"proteinGrams": nutrition.ProteinGrams, "saltGrams": nutrition.SaltGrams,
+		} {
+			if value != nil && *value < 0 {
+				fieldErrs.Add("nutrition."+name, "must not be negative")
+			}
+		}
+	}
+	for idx, variant := range item.Variants {
+		validateAllergens(variant.Allergens, fmt.Sprintf("variants[%d].allergens", idx), fieldErrs)
+	}
+	for idx, group := range item.ModifierGroups {
+		for _, option := range group.Options {
+			validateAllergens(option.Allergens,
+				fmt.Sprintf("modifierGroups[%d].options.%s.allergens", idx, option.ID), fieldErrs)
+		}
+	}
+}
+
+// lower cased, trimmed, without duplicates, in order given
+func normalizeLabels(labels []string) []string {
+	normalized := make([]string, 0, len(labels))
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if len(label) > 0 && !seen[label] {
+			seen[label] = true
+			normalized = append(normalized, label)
+		}
+	}
+	return normalized
+}
+
+// union of item, chosen variant and chosen option allergens, sorted
+func lineAllergens(item Item, variant *Variant, options []*ModifierOption) []string {
+	union := make(map[string]bool)
+	for _, allergen := range item.Allergens {
+		union[allergen] = true
+	}
+	if variant != nil {
+		for _, allergen := range variant.Allergens {
+			union[allergen] = true
+		}
+	}
+	for _, option := range options {
+		for _, allergen := range option.Allergens {
+			union[allergen] = true
+		}
+	}
+	allergens := make([]string, 0, len(union))
+	for allergen := range union {
+		allergens = append(allergens, allergen)
+	}
+	sort.Strings(allergens)
+	return allergens
+}
+
+// comma separated or repeated, like types
+func queryList(query url.Values, key string) []string {
+	values := make([]string, 0)
+	for _, raw := range query[key] {
+		values = append(values, strings.Split(raw, ",")...)
+	}
+	return normalizeLabels(values)
+}
+
+/*
+- allergens=sesame: items containing all of these
+- exclude_allergens=milk,peanuts: items containing none of these
+- dietary=vegan,halal: items with all of these labels
+- exclude_dietary=...: items with none of these labels
+- max_calories=500: items with nutrition saying at most this many kcal
+*/
+type DietaryFilter struct {
+	Allergens        []string
+	ExcludeAllergens []string
+	Dietary          []string
+	ExcludeDietary   []string
+	MaxCalories      *float64
+}
+
+func ParseDietaryFilter(query url.Values, fieldErrs auth.FieldErrors) DietaryFilter {
+	filter := DietaryFilter{
+		Allergens:        queryList(query, "allergens"),
+		ExcludeAllergens: queryList(query, "exclude_allergens"),
+		Dietary:          queryList(query, "dietary"),
+		ExcludeDietary:   queryList(query, "exclude_dietary"),
+	}
+	validateAllergens(filter.Allergens, "allergens", fieldErrs)
+	validateAllergens(filter.ExcludeAllergens, "exclude_allergens", fieldErrs)
+	for key, labels := range map[string][]string{
+		"dietary": filter.Dietary, "exclude_dietary": filter.ExcludeDietary,
+	} {
+		for _, label := range labels {
+			if _, known := knownDietary[label]; !known {
+				fieldErrs.Add(key, fmt.Sprintf("unknown label %q, use one of %s",
+					label, dietaryNames()))
+			}
+		}
+	}
+	if rawCalories := strings.TrimSpace(query.Get("max_calories")); len(rawCalories) > 0 {
+		calories, err := strconv.ParseFloat(rawCalories, 64)
+		if err != nil || calories < 0 {
+			fieldErrs.Add("max_calories", "must be a number, zero or more")
+		} else {
+			filter.MaxCalories = &calories
+		}
+	}
+	return filter
+}
+
+func (filter DietaryFilter) BSON() bson.D {
+	query := bson.D{}
+	for _, field := range []struct {
+		key              string
+		include, exclude []string
+	}{
+		{"allergens", filter.Allergens, filter.ExcludeAllergens},
+		{"dietary", filter.Dietary, filter.ExcludeDietary},
+	} {
+		condition := bson.D{}
+		if len(field.include) > 0 {
+			condition = append(condition, bson.E{Key: "$all", Value: field.include})
+		}
+		if len(field.exclude) > 0 {
+			condition = append(condition, bson.E{Key: "$nin", Value: field.exclude})
+		}
+		if len(condition) > 0 {
+			query = append(query, bson.E{Key: field.key, Value: condition})
+		}
+	}
+	if filter.MaxCalories != nil {
+		query = append(query, bson.E{Key: "nutrition.calories",
+			Value: bson.D{{Key: "$lte", Value: *filter.MaxCalories}}})
+	}
+	return query
+}
+
+func containsAll(values []string, wanted []string) bool {
+	for _, want := range wanted {
+		if !containsString(values, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsNone(values []string, unwanted []string) bool {
+	for _, value := range values {
+		if containsString(unwanted, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, wanted string) bool {
+	for _, value := range values {
+		if value == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// Go twin of BSON, for menus served from memory
+func (filter DietaryFilter) Matches(item Item) bool {
+	if !containsAll(item.Allergens, filter.Allergens) ||
+		!containsNone(item.Allergens, filter.ExcludeAllergens) ||
+		!containsAll(item.Dietary, filter.Dietary) ||
+		!containsNone(item.Dietary, filter.ExcludeDietary) {
+		return false
+	}
+	if filter.MaxCalories != nil {
+		// like $lte, items saying nothing about calories don't match
+		return item.Nutrition != nil && item.Nutrition.Calories != nil &&
+			*item.Nutrition.Calories <= *filter.MaxCalories
+	}
+	return true
+}
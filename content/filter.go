@@ -0,0 +1,196 @@
+package content
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+query parameters narrowing down the menu. every one is optional; leaving them all out
+lists the whole (available) menu.
+
+  - types=drinks,mains or types=drinks&types=mains: items in any of these categories
+    (slug or id) or their subcategories. old classification strings still work
+
+  - min_price, max_price: inclusive cost range in minor units (cents). price is the old
+    name for max_price
+
+  - currency: ISO 4217 code the price range is in, defaults to MENU_CURRENCY. only items
+    priced in that currency match a price range
+
+  - available=true|false|all: staff only (admin listing), customers only see available
+
+  - deleted=true: staff only, include soft deleted items
+
+  - allergens, exclude_allergens, dietary, exclude_dietary, max_calories: see
+    DietaryFilter
+
+customers only ever see items open now by their schedules (OpenAt), staff see all.
+*/
+type MenuFilter struct {
+	Types             []string
+	CategoryIDs       []primitive.ObjectID // Types resolved by ResolveCategoryFilter
+	MinPrice          *int
+	MaxPrice          *int
+	Currency          string
+	Availability      *bool // nil matches both
+	IncludeDeleted    bool
+	OpenAt            *time.Time           // nil ignores schedules
+	ClosedCategoryIDs []primitive.ObjectID // CategoryTree.ClosedAt(OpenAt)
+	Dietary           DietaryFilter
+}
+
+func parsePrice(query url.Values, key string, fieldErrs auth.FieldErrors) *int {
+	raw := strings.TrimSpace(query.Get(key))
+	if len(raw) == 0 {
+		return nil
+	}
+	price, err := strconv.Atoi(raw)
+	if err != nil || price < 0 {
+		fieldErrs.Add(key, "must be a whole number, zero or more")
+		return nil
+	}
+	return &price
+}
+
+// staff decides whether availability and deleted can be asked for
+func ParseMenuFilter(query url.Values, staff bool, fieldErrs auth.FieldErrors) MenuFilter {
+	filter := MenuFilter{}
+	for _, rawTypes := range query["types"] {
+		for _, classification := range strings.Split(rawTypes, ",") {
+			if classification = strings.TrimSpace(classification); len(classification) > 0 {
+				filter.Types = append(filter.Types, classification)
+			}
+		}
+	}
+
+	filter.MinPrice = parsePrice(query, "min_price", fieldErrs)
+	filter.MaxPrice = parsePrice(query, "max_price", fieldErrs)
+	if legacyMax := parsePrice(query, "price", fieldErrs); legacyMax != nil {
+		if filter.MaxPrice != nil {
+			fieldErrs.Add("price", "use max_price or price, not both")
+		}
+		filter.MaxPrice = legacyMax
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		fieldErrs.Add("min_price", "must not be more than max_price")
+	}
+	filter.Dietary = ParseDietaryFilter(query, fieldErrs)
+	filter.Currency = DefaultCurrency()
+	if rawCurrency := strings.TrimSpace(query.Get("currency")); len(rawCurrency) > 0 {
+		filter.Currency = strings.ToUpper(rawCurrency)
+		if !KnownCurrency(filter.Currency) {
+			fieldErrs.Add("currency", "not a supported ISO 4217 currency code")
+		}
+	}
+
+	available := true
+	filter.Availability = &available
+	if rawAvailable := query.Get("available"); len(rawAvailable) > 0 {
+		switch {
+		case !staff:
+			fieldErrs.Add("available", "staff only")
+		case rawAvailable == "all":
+			filter.Availability = nil
+		default:
+			parsed, err := strconv.ParseBool(rawAvailable)
+			if err != nil {
+				fieldErrs.Add("available", "must be true, false or all")
+			}
+			filter.Availability = &parsed
+		}
+	} else if staff {
+		filter.Availability = nil // staff listing shows everything unless asked otherwise
+	}
+	if rawDeleted := query.Get("deleted"); len(rawDeleted) > 0 {
+		includeDeleted, err := strconv.ParseBool(rawDeleted)
+		switch {
+		case !staff:
+			fieldErrs.Add("deleted", "staff only")
+		case err != nil:
+			fieldErrs.Add("deleted", "must be true or false")
+		default:
+			filter.IncludeDeleted = includeDeleted
+		}
+	}
+	return filter
+}
+
+// mongo filter for items collection
+func (filter MenuFilter) BSON() bson.D {
+	query := bson.D{}
+	if len(filter.Types) > 0 {
+		query = append(query, bson.E{Key: "categoryIds",
+			Value: bson.D{{Key: "$in", Value: filter.CategoryIDs}}})
+	}
+	costRange := bson.D{}
+	if filter.MinPrice != nil {
+		costRange = append(costRange, bson.E{Key: "$gte", Value: *filter.MinPrice})
+	}
+	if filter.MaxPrice != nil {
+		costRange = append(costRange, bson.E{Key: "$lte", Value: *filter.MaxPrice})
+	}
+	if len(costRange) > 0 {
+		query = append(query,
+			bson.E{Key: "cost.currency", Value: filter.Currency},
+			bson.E{Key: "cost.amount", Value: costRange})
+	}
+	if filter.Availability != nil {
+		query = append(query, bson.E{Key: "availability", Value: *filter.Availability})
+	}
+	if !filter.IncludeDeleted {
+		query = append(query, bson.E{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}})
+	}
+	query = append(query, filter.Dietary.BSON()...)
+	if filter.OpenAt != nil {
+		query = append(query, scheduleBSON(*filter.OpenAt, filter.ClosedCategoryIDs)...)
+	}
+	return query
+}
+
+// Go twin of BSON, for menus served from memory (see menucache.go)
+func (filter MenuFilter) Matches(item Item) bool {
+	if len(filter.Types) > 0 {
+		inCategory := false
+		for _, categoryID := range item.CategoryIDs {
+			for _, wanted := range filter.CategoryIDs {
+				inCategory = inCategory || categoryID == wanted
+			}
+		}
+		if !inCategory {
+			return false
+		}
+	}
+	if filter.MinPrice != nil || filter.MaxPrice != nil {
+		if item.Cost.Currency != filter.Currency ||
+			(filter.MinPrice != nil && item.Cost.Amount < int64(*filter.MinPrice)) ||
+			(filter.MaxPrice != nil && item.Cost.Amount > int64(*filter.MaxPrice)) {
+			return false
+		}
+	}
+	if filter.Availability != nil && item.Availability != *filter.Availability {
+		return false
+	}
+	if !filter.IncludeDeleted && item.Deleted {
+		return false
+	}
+	if !filter.Dietary.Matches(item) {
+		return false
+	}
+	if filter.OpenAt != nil {
+		closed := make(map[primitive.ObjectID]bool, len(filter.ClosedCategoryIDs))
+		for _, categoryID := range filter.ClosedCategoryIDs {
+			closed[categoryID] = true
+		}
+		at := filter.OpenAt.In(StoreLocation())
+		return SchedulesOpenAt(item.Schedules, at) && inOpenCategory(item, closed)
+	}
+	return true
+}
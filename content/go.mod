@@ -2,7 +2,13 @@ module github.com/nicklhchang/gorilla-mongo-api/content
 
 go 1.19
 
-require go.mongodb.org/mongo-driver v1.10.2
+replace gorilla-mongo-api/auth => ../auth
+
+require (
+	github.com/gorilla/mux v1.8.0
+	go.mongodb.org/mongo-driver v1.10.2
+	gorilla-mongo-api/auth v0.0.0
+)
 
 require (
 	github.com/golang/snappy v0.0.1 // indirect
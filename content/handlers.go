@@ -1,15 +1,17 @@
 package content
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+
+	auth "gorilla-mongo-api/auth"
 )
 
 /*
@@ -46,7 +48,18 @@ func GetCartByUserSession(collections ...*mongo.Collection) http.Handler {
 	})
 }
 
-func PutUpsertCartSync(collections ...*mongo.Collection) http.Handler {
+/*
+body {"lines": [{"itemId", "variantId", "modifiers": [{"groupId", "optionIds"}], "quantity"}]}
+replaces the cart's lines. names and prices are never taken from the client: every line
+is checked against its item and priced by PriceCartLine, then stock is reserved for the
+session (409 when there isn't enough). empty body just touches the cart.
+lines are priced against the published menu, stock is reserved on the live items. lines
+already in the cart keep the price they were added at, see PriceHold.
+*/
+func PutUpsertCartSync(menu MenuSource, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is carts collections[2] is categories
+	// collections[3] is sessions collections[4] is reservations
+	// collections[5] is orders collections[6] is priceChanges
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		ptrCookieSlice := r.Cookies()
@@ -56,45 +69,146 @@ func PutUpsertCartSync(collections ...*mongo.Collection) http.Handler {
 				filter = append(filter, bson.E{Key: "session", Value: (*ptrCookie).Value})
 			}
 		}
-		// so far not handling any request body from post req
-		err := UpsertCart(filter, collections[1])
+		cartFields := bson.D{}
+		user, err := auth.SessionUser(r, collections[3])
+		if err != nil {
+			fmt.Printf("couldn't find user for cart session: %v", err)
+		} else if len(user) > 0 {
+			cartFields = append(cartFields, bson.E{Key: "user", Value: user})
+		}
+
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, "no body could be read")
+			return
+		}
+		var cart Cart
+		if len(bytes.TrimSpace(bodyBytes)) > 0 {
+			var cartInput struct {
+				Lines []CartLine `json:"lines"`
+			}
+			if err = json.Unmarshal(bodyBytes, &cartInput); err != nil {
+				auth.RespondError(w, http.StatusBadRequest, "body must be {\"lines\": [...]}")
+				return
+			}
+			live, err := menu.Menu(r.Context())
+			if err != nil {
+				auth.RespondError(w, http.StatusInternalServerError, "could not load menu")
+				return
+			}
+			tree, err := LoadCategoryTree(live.Categories)
+			if err != nil {
+				auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+				return
+			}
+			prices, err := LivePrices(r.Context(), live, collections[6])
+			if err != nil {
+				auth.RespondError(w, http.StatusInternalServerError, "could not load prices")
+				return
+			}
+			saved, err := loadCart(auth.SessionIDFromCookies(r), collections[1])
+			if err != nil && err != mongo.ErrNoDocuments {
+				auth.RespondError(w, http.StatusInternalServerError, "could not load cart")
+				return
+			}
+			fieldErrs := make(auth.FieldErrors)
+			cart.Lines, cart.Total, err = PriceCart(cartInput.Lines, saved.Lines, tree, live.Items,
+				prices, fieldErrs)
+			if err != nil {
+				auth.RespondError(w, http.StatusInternalServerError, "could not load items for cart")
+				return
+			}
+			if len(fieldErrs) > 0 {
+				auth.RespondFieldErrors(w, fieldErrs)
+				return
+			}
+			err = ReserveCart(auth.SessionIDFromCookies(r), cart.Lines, collections[0], collections[4],
+				fieldErrs)
+			if err != nil {
+				fmt.Printf("could not reserve stock for cart: %v\n", err)
+				auth.RespondError(w, http.StatusInternalServerError, "could not reserve stock")
+				return
+			}
+			if len(fieldErrs) > 0 {
+				respondCartConflict(w, fieldErrs)
+				return
+			}
+			cartFields = append(cartFields,
+				bson.E{Key: "lines", Value: cart.Lines},
+				bson.E{Key: "total", Value: cart.Total})
+		}
+		err = UpsertCart(filter, cartFields, collections[1])
 		if err != nil {
 			fmt.Printf("here's the error when upserting cart: %v", err)
+			auth.RespondError(w, http.StatusInternalServerError, "could not save cart")
+			return
 		}
+		json.NewEncoder(w).Encode(cart)
 	})
 }
 
-func GetMenuHandler(collections ...*mongo.Collection) http.Handler {
+/*
+every query parameter is optional, see MenuFilter and MenuPage for what's accepted.
+bad parameters get a 400 listing what's wrong with each rather than a half applied filter.
+items, categories and stock come from cache (the published version, or the draft for
+preview). published pages carry an ETag and Last-Modified, see httpcache.go.
+*/
+func GetMenuHandler(cache MenuCache) http.Handler {
+	validator := &menuValidator{}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// fmt.Printf("request context: %v\n", r.Context())
 		w.Header().Set("Content-Type", "application/json")
 		// required to get request URL params
 		err := r.ParseForm()
 		if err != nil {
-			log.Fatal(err)
+			auth.RespondError(w, http.StatusBadRequest, fmt.Sprintf("malformed query: %v", err))
+			return
 		}
-		// could iterate over r.Form.Get("types") and check against ASCII code for ,
-		types := strings.Split(r.Form.Get("types"), ",")
-		// extract prive but convert to integer base 10 for mongo api
-		price, err := strconv.Atoi(r.Form.Get("price"))
+		fieldErrs := make(auth.FieldErrors)
+		filter := ParseMenuFilter(r.Form, false, fieldErrs)
+		page := ParseMenuPage(r.Form, fieldErrs)
+		chain := RequestLanguages(r, fieldErrs)
+		snapshot, err := cache.Current(r.Context())
 		if err != nil {
-			json.NewEncoder(w).Encode("price provided could not be converted to integer")
+			fmt.Printf("no menu to serve: %v\n", err)
+			auth.RespondError(w, http.StatusInternalServerError, "could not load menu")
+			return
+		}
+		tree := snapshot.Tree
+		if len(filter.Types) > 0 {
+			filter.CategoryIDs = ResolveCategoryFilter(filter.Types, tree, fieldErrs)
+		}
+		now := time.Now()
+		filter.OpenAt = &now
+		filter.ClosedCategoryIDs = tree.ClosedAt(now.In(StoreLocation()))
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
 		}
 
-		// done in this format following MongoDB Go Driver docs
-		filter := bson.D{
-			{Key: "cost", Value: bson.D{{Key: "$lte", Value: price}}},
-			{Key: "classification", Value: bson.D{{Key: "$in", Value: types}}},
-		}
-		// could use append and replace each element of bson.D with bson.E (E for element)
-		// filter = append(filter, bson.E{Key: "cost", Value: bson.D{{Key: "$lte", Value: price}}})
-		filter = append(filter, bson.E{Key: "availability", Value: true})
-
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("Content-Language", contentLanguage(chain))
+		if validator.respondCached(w, r, snapshot, filter.ClosedCategoryIDs, chain, now) {
+			return
+		}
 		// use a crud function for readability
-		items, err := GetMenu(filter, collections[0])
+		items, nextCursor, err := snapshot.Page(filter, page)
 		if err != nil {
 			fmt.Printf("let's inspect items: %v and error: %v", items, err)
+			auth.RespondError(w, http.StatusInternalServerError, "could not load menu")
+			return
+		}
+		for idx := range items {
+			items[idx] = localizeItem(snapshot.Rated(items[idx]), chain)
+		}
+		if err = snapshot.describeChoices(items, chain, orderableNow(snapshot, now)); err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load menu")
+			return
+		}
+		response := MenuResponse{Items: items}
+		if len(nextCursor) > 0 {
+			response.NextCursor = &nextCursor
 		}
-		json.NewEncoder(w).Encode(items)
+		json.NewEncoder(w).Encode(response)
 	})
 }
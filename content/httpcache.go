@@ -0,0 +1,126 @@
+package content
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+conditional GETs for /content/menu. a published version never changes, so a menu page is
+fixed by the version, the query string, what's sold out, item ratings, prices scheduled
+since the publish, which schedules are open and the languages asked for (Accept-Language,
+see locale.go). the ETag hashes exactly those; a client revalidating with If-None-Match
+gets a 304 without the items being read. Last-Modified is when this process first saw the
+current state (never before the version was published), so after a restart it only errs
+towards 200s.
+drafts (preview) change without a version and are never cached.
+*/
+
+// MENU_CACHE_CONTROL in ./.env, default makes browsers revalidate every time
+func MenuCacheControl() string {
+	if cacheControl := strings.TrimSpace(os.Getenv("MENU_CACHE_CONTROL")); len(cacheControl) > 0 {
+		return cacheControl
+	}
+	// private: the menu sits behind AuthMiddleware, shared caches shouldn't keep it
+	return "private, no-cache"
+}
+
+type menuValidator struct {
+	mutex sync.Mutex
+	state string
+	since time.Time
+}
+
+func (validator *menuValidator) lastModified(state string, publishedAt time.Time) time.Time {
+	validator.mutex.Lock()
+	defer validator.mutex.Unlock()
+	if validator.state != state {
+		validator.state = state
+		validator.since = time.Now().UTC().Truncate(time.Second)
+	}
+	if publishedAt.After(validator.since) {
+		return publishedAt.UTC().Truncate(time.Second)
+	}
+	return validator.since
+}
+
+// everything besides the query string that decides what a menu page holds at at
+func menuFingerprint(snapshot *MenuSnapshot, closedCategories []primitive.ObjectID,
+	at time.Time) string {
+	at = at.In(StoreLocation())
+	schedules, soldOut := snapshot.Schedules, snapshot.SoldOut
+	parts := make([]string, 0, len(schedules)+len(closedCategories)+len(soldOut))
+	for _, schedule := range schedules {
+		parts = append(parts, fmt.Sprintf("schedule %v %v %d %d %v %s %s open=%v",
+			schedule.DayNames, schedule.Days, schedule.StartMinute, schedule.EndMinute,
+			schedule.Wraps, schedule.StartDate, schedule.EndDate, schedule.OpenAt(at)))
+	}
+	for _, categoryID := range closedCategories {
+		parts = append(parts, "closed "+categoryID.Hex())
+	}
+	for _, itemID := range soldOut {
+		parts = append(parts, "soldout "+itemID.Hex())
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("v%d popularity %s ratings %s prices %s\n%s", snapshot.Live.Version,
+		snapshot.popularityDigest, snapshot.ratingsDigest, snapshot.pricesDigest,
+		strings.Join(parts, "\n"))
+}
+
+func menuETag(state string, query string, languages []string) string {
+	sum := sha256.Sum256([]byte(state + "\n?" + query + "\n" + strings.Join(languages, ",")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// If-None-Match compares weakly, as RFC 9110 says, and beats If-Modified-Since
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); len(ifNoneMatch) > 0 {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.After(since)
+}
+
+/*
+sets ETag, Last-Modified and Cache-Control for a published menu page and answers 304 when
+the client already has it. returns true when the response is done.
+*/
+func (validator *menuValidator) respondCached(w http.ResponseWriter, r *http.Request,
+	snapshot *MenuSnapshot, closedCategories []primitive.ObjectID, languages []string,
+	at time.Time) bool {
+	if snapshot.Live.Version == 0 {
+		w.Header().Set("Cache-Control", "no-store")
+		return false
+	}
+	state := menuFingerprint(snapshot, closedCategories, at)
+	// Encode sorts by key, so the same filter in any order gets the same tag
+	etag := menuETag(state, r.Form.Encode(), languages)
+	lastModified := validator.lastModified(state, snapshot.Live.PublishedAt)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", MenuCacheControl())
+	if notModified(r, etag, lastModified) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
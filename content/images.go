@@ -0,0 +1,399 @@
+package content
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+staff upload item photos as multipart/form-data (field "image"). only jpeg and png are
+taken, decided by sniffing the bytes not by the filename or the client's content type.
+every upload is decoded and encoded again, which drops exif (gps, camera serial), icc
+profiles and png text chunks, then thumbnails are made at each configured size. the
+original and thumbnails go to the BlobStore; the item only keeps their keys and urls.
+*/
+
+const maxImagePixels = 40_000_000 // decoding is width*height*4 bytes of memory
+
+var allowedImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+type ItemImage struct {
+	ID          string      `bson:"id" json:"id"`
+	Key         string      `bson:"key" json:"key"`
+	URL         string      `bson:"url" json:"url"`
+	ContentType string      `bson:"contentType" json:"contentType"`
+	Width       int         `bson:"width" json:"width"`
+	Height      int         `bson:"height" json:"height"`
+	Thumbnails  []Thumbnail `bson:"thumbnails" json:"thumbnails"`
+	UploadedAt  time.Time   `bson:"uploadedAt" json:"uploadedAt"`
+}
+
+// Size is the longest side the thumbnail was fitted into
+type Thumbnail struct {
+	Size   int    `bson:"size" json:"size"`
+	Key    string `bson:"key" json:"key"`
+	URL    string `bson:"url" json:"url"`
+	Width  int    `bson:"width" json:"width"`
+	Height int    `bson:"height" json:"height"`
+}
+
+type ImagePolicy struct {
+	MaxBytes      int64
+	ThumbSizes    []int
+	MaxItemImages int
+}
+
+/*
+from ./.env: IMAGE_MAX_BYTES (default 5MB), IMAGE_THUMB_SIZES comma separated longest
+side in pixels (default 160,480), IMAGE_MAX_PER_ITEM (default 10)
+*/
+func LoadImagePolicy() ImagePolicy {
+	policy := ImagePolicy{MaxBytes: 5 << 20, ThumbSizes: []int{160, 480}, MaxItemImages: 10}
+	if maxBytes, err := strconv.ParseInt(os.Getenv("IMAGE_MAX_BYTES"), 10, 64); err == nil &&
+		maxBytes > 0 {
+		policy.MaxBytes = maxBytes
+	}
+	if rawSizes := os.Getenv("IMAGE_THUMB_SIZES"); len(rawSizes) > 0 {
+		sizes := make([]int, 0)
+		for _, rawSize := range strings.Split(rawSizes, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(rawSize))
+			if err == nil && size > 0 {
+				sizes = append(sizes, size)
+			}
+		}
+		sort.Ints(sizes)
+		policy.ThumbSizes = sizes
+	}
+	if maxImages, err := strconv.Atoi(os.Getenv("IMAGE_MAX_PER_ITEM")); err == nil &&
+		maxImages > 0 {
+		policy.MaxItemImages = maxImages
+	}
+	return policy
+}
+
+func encodeImage(img image.Image, contentType string) ([]byte, error) {
+	var encoded bytes.Buffer
+	var err error
+	if contentType == "image/png" {
+		err = png.Encode(&encoded, img)
+	} else {
+		err = jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 85})
+	}
+	return encoded.Bytes(), err
+}
+
+/*
+fits src into size x size keeping aspect ratio, averaging every source pixel that falls
+in each destination pixel (box filter). good enough for downscaling photos and needs
+nothing outside the standard library. never scales up.
+*/
+func resizeToFit(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= size && srcH <= size {
+		return src
+	}
+	dstW, dstH := size, srcH*size/srcW
+	if srcH > srcW {
+		dstW, dstH = srcW*size/srcH, size
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+	rgba := image.NewNRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	sums := make([][4]uint64, dstW*dstH)
+	counts := make([]uint64, dstW*dstH)
+	for y := 0; y < srcH; y++ {
+		dstY := y * dstH / srcH
+		for x := 0; x < srcW; x++ {
+			idx := dstY*dstW + x*dstW/srcW
+			pixel := rgba.NRGBAAt(x, y)
+			sums[idx][0] += uint64(pixel.R)
+			sums[idx][1] += uint64(pixel.G)
+			sums[idx][2] += uint64(pixel.B)
+			sums[idx][3] += uint64(pixel.A)
+			counts[idx]++
+		}
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for idx, sum := range sums {
+		count := counts[idx]
+		if count == 0 {
+			continue
+		}
+		dst.SetNRGBA(idx%dstW, idx/dstW, color.NRGBA{
+			R: uint8(sum[0] / count), G: uint8(sum[1] / count),
+			B: uint8(sum[2] / count), A: uint8(sum[3] / count),
+		})
+	}
+	return dst
+}
+
+type processedImage struct {
+	contentType string
+	extension   string
+	img         image.Image
+	original    []byte
+}
+
+// sniffs, bounds checks and re-encodes an upload. errors are safe to show the client
+func processImage(data []byte) (processedImage, error) {
+	contentType := http.DetectContentType(data)
+	extension, allowed := allowedImageTypes[contentType]
+	if !allowed {
+		return processedImage{}, fmt.Errorf("must be a jpeg or png image, got %s", contentType)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return processedImage{}, fmt.Errorf("could not read image")
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return processedImage{}, fmt.Errorf("image is more than %d pixels", maxImagePixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return processedImage{}, fmt.Errorf("could not read image")
+	}
+	original, err := encodeImage(img, contentType)
+	if err != nil {
+		return processedImage{}, err
+	}
+	return processedImage{contentType: contentType, extension: extension, img: img,
+		original: original}, nil
+}
+
+func randomImageID() (string, error) {
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// puts original and thumbnails, removing whatever was already put if any put fails
+func storeImage(ctx context.Context, store BlobStore, policy ImagePolicy, prefix string,
+	processed processedImage) (ItemImage, error) {
+	imageID, err := randomImageID()
+	if err != nil {
+		return ItemImage{}, err
+	}
+	bounds := processed.img.Bounds()
+	stored := ItemImage{
+		ID:          imageID,
+		Key:         prefix + imageID + processed.extension,
+		ContentType: processed.contentType,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Thumbnails:  []Thumbnail{},
+		UploadedAt:  time.Now().UTC(),
+	}
+	putKeys := make([]string, 0)
+	cleanUp := func() {
+		for _, key := range putKeys {
+			store.Delete(context.Background(), key)
+		}
+	}
+	if err = store.Put(ctx, stored.Key, stored.ContentType, processed.original); err != nil {
+		return ItemImage{}, err
+	}
+	putKeys = append(putKeys, stored.Key)
+	stored.URL = store.URL(stored.Key)
+
+	for _, size := range policy.ThumbSizes {
+		thumbImg := resizeToFit(processed.img, size)
+		encoded, err := encodeImage(thumbImg, processed.contentType)
+		if err != nil {
+			cleanUp()
+			return ItemImage{}, err
+		}
+		thumb := Thumbnail{
+			Size:   size,
+			Key:    fmt.Sprintf("%s%s_%d%s", prefix, imageID, size, processed.extension),
+			Width:  thumbImg.Bounds().Dx(),
+			Height: thumbImg.Bounds().Dy(),
+		}
+		if err = store.Put(ctx, thumb.Key, processed.contentType, encoded); err != nil {
+			cleanUp()
+			return ItemImage{}, err
+		}
+		putKeys = append(putKeys, thumb.Key)
+		thumb.URL = store.URL(thumb.Key)
+		stored.Thumbnails = append(stored.Thumbnails, thumb)
+	}
+	return stored, nil
+}
+
+func deleteImageBlobs(store BlobStore, stored ItemImage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	keys := []string{stored.Key}
+	for _, thumb := range stored.Thumbnails {
+		keys = append(keys, thumb.Key)
+	}
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			fmt.Printf("could not delete blob %s: %v\n", key, err)
+		}
+	}
+}
+
+// POST /admin/items/{id}/images, multipart with the file in field "image". responds 201
+// with the item. appending can't clobber anyone's edit, so no version is needed
+func UploadItemImage(store BlobStore, policy ImagePolicy,
+	collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		item, err := FindItemByID(itemID, collections[0])
+		if err != nil || item.Deleted {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		if len(item.Images) >= policy.MaxItemImages {
+			auth.RespondError(w, http.StatusConflict,
+				fmt.Sprintf("item already has %d images", policy.MaxItemImages))
+			return
+		}
+
+		// room for multipart headers around the file itself
+		r.Body = http.MaxBytesReader(w, r.Body, policy.MaxBytes+64<<10)
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			if strings.Contains(err.Error(), "request body too large") {
+				auth.RespondError(w, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("image must be at most %d bytes", policy.MaxBytes))
+				return
+			}
+			auth.RespondError(w, http.StatusBadRequest, "send the file as multipart field image")
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, policy.MaxBytes+1))
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, "could not read upload")
+			return
+		}
+		if int64(len(data)) > policy.MaxBytes {
+			auth.RespondError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("image must be at most %d bytes", policy.MaxBytes))
+			return
+		}
+		processed, err := processImage(data)
+		if err != nil {
+			fieldErrs := make(auth.FieldErrors)
+			fieldErrs.Add("image", err.Error())
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+
+		storeCtx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		stored, err := storeImage(storeCtx, store, policy, "items/"+itemID.Hex()+"/", processed)
+		if err != nil {
+			fmt.Printf("could not store item image: %v\n", err)
+			auth.RespondError(w, http.StatusInternalServerError, "could not store image")
+			return
+		}
+		var updated Item
+		err = collections[0].FindOneAndUpdate(storeCtx,
+			bson.D{
+				{Key: "_id", Value: itemID},
+				{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+				// guards the count against concurrent uploads
+				{Key: fmt.Sprintf("images.%d", policy.MaxItemImages-1),
+					Value: bson.D{{Key: "$exists", Value: false}}},
+			},
+			bson.D{
+				{Key: "$push", Value: bson.D{{Key: "images", Value: stored}}},
+				{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+		if err != nil {
+			deleteImageBlobs(store, stored)
+			if err == mongo.ErrNoDocuments {
+				auth.RespondError(w, http.StatusConflict, "item was deleted or is full of images")
+				return
+			}
+			auth.RespondError(w, http.StatusInternalServerError, "could not save item")
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", updated.Version))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(updated)
+	})
+}
+
+// DELETE /admin/items/{id}/images/{imageId}, removes it from the item then from the store
+func DeleteItemImage(store BlobStore, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		imageID := mux.Vars(r)["imageId"]
+		var before Item
+		updateCtx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		err = collections[0].FindOneAndUpdate(updateCtx,
+			bson.D{{Key: "_id", Value: itemID}, {Key: "images.id", Value: imageID}},
+			bson.D{
+				{Key: "$pull", Value: bson.D{{Key: "images",
+					Value: bson.D{{Key: "id", Value: imageID}}}}},
+				{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+			}).Decode(&before)
+		if err == mongo.ErrNoDocuments {
+			auth.RespondError(w, http.StatusNotFound, "no such image on item")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not save item")
+			return
+		}
+		for _, stored := range before.Images {
+			if stored.ID == imageID {
+				deleteImageBlobs(store, stored)
+			}
+		}
+		updated, err := FindItemByID(itemID, collections[0])
+		respondItemWrite(w, itemID, updated, err, collections[0])
+	})
+}
@@ -0,0 +1,555 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+stock for items that opt in (Item.Stock set; nil means not counted, never runs out).
+  - Item.Reserved is the sum of unexpired reservations, so stock - reserved is what
+    another customer can still put in a cart
+  - a cart upsert reserves what its lines need in the reservations collection, one
+    document per session and item, which expires unless the cart is touched again.
+    ExpireReservationsEvery hands expired ones back
+  - placing an order turns the session's reservations into a conditional decrement of
+    stock; at zero stock the item flips to unavailable (SoldOut remembers it was us, so
+    restocking flips it back) and crossing LowStockThreshold emits a StockEvent
+every stock change is a single conditional update on the item document, so two customers
+racing for the last one can't both get it.
+*/
+
+var errOutOfStock = errors.New("not enough stock")
+
+type Reservation struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	ItemID    primitive.ObjectID `bson:"itemId"`
+	Session   string             `bson:"session"`
+	Quantity  int64              `bson:"quantity"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+type StockEvent struct {
+	ItemID    primitive.ObjectID `bson:"itemId" json:"itemId"`
+	Name      string             `bson:"name" json:"name"`
+	Stock     int64              `bson:"stock" json:"stock"`
+	Threshold int64              `bson:"threshold" json:"threshold"`
+	At        time.Time          `bson:"at" json:"at"`
+}
+
+// told when an item's stock drops to or below its LowStockThreshold
+type StockEvents interface {
+	LowStock(ctx context.Context, event StockEvent) error
+}
+
+// prints events, for development
+type LogStockEvents struct{}
+
+func (LogStockEvents) LowStock(ctx context.Context, event StockEvent) error {
+	fmt.Printf("low stock: %s (%s) has %d left, threshold %d\n",
+		event.Name, event.ItemID.Hex(), event.Stock, event.Threshold)
+	return nil
+}
+
+// keeps events in a collection for staff tooling to pick up
+type CollectionStockEvents struct {
+	Events *mongo.Collection
+}
+
+func (sink CollectionStockEvents) LowStock(ctx context.Context, event StockEvent) error {
+	_, err := sink.Events.InsertOne(ctx, event)
+	return err
+}
+
+// CART_RESERVATION_MINUTES in ./.env, how long a cart holds stock without being touched
+func reservationTTL() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("CART_RESERVATION_MINUTES"))
+	if err != nil || minutes < 1 {
+		minutes = 15
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func EnsureReservationIndexes(rCollection *mongo.Collection) error {
+	_, err := rCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "session", Value: 1}, {Key: "itemId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}},
+	})
+	return err
+}
+
+// total quantity per item across lines, variants of one item share its stock. bundles
+// take stock of what fills their slots too
+func lineQuantities(lines []CartLine) map[primitive.ObjectID]int64 {
+	quantities := make(map[primitive.ObjectID]int64)
+	for _, line := range lines {
+		quantities[line.ItemID] += int64(line.Quantity)
+		for _, component := range line.Components {
+			quantities[component.ItemID] += int64(component.Quantity)
+		}
+	}
+	return quantities
+}
+
+var trackedStock = bson.E{Key: "stock", Value: bson.D{{Key: "$type", Value: "number"}}}
+
+var reservedOrZero = bson.D{{Key: "$ifNull", Value: bson.A{"$reserved", 0}}}
+
+// takes quantity more of the item's free stock. false for untracked items, which have
+// nothing to reserve
+func reserveStock(ctx context.Context, itemID primitive.ObjectID, quantity int64,
+	iCollection *mongo.Collection) (bool, error) {
+	result, err := iCollection.UpdateOne(ctx,
+		bson.D{
+			{Key: "_id", Value: itemID},
+			trackedStock,
+			{Key: "$expr", Value: bson.D{{Key: "$gte", Value: bson.A{
+				bson.D{{Key: "$subtract", Value: bson.A{"$stock", reservedOrZero}}}, quantity,
+			}}}},
+		},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "reserved", Value: quantity}}}})
+	if err != nil {
+		return true, err
+	}
+	if result.MatchedCount == 1 {
+		return true, nil
+	}
+	item, err := FindItemByID(itemID, iCollection)
+	if err != nil {
+		return true, err
+	}
+	if item.Stock == nil {
+		return false, nil
+	}
+	return true, errOutOfStock
+}
+
+func releaseStock(ctx context.Context, itemID primitive.ObjectID, quantity int64,
+	iCollection *mongo.Collection) error {
+	if quantity == 0 {
+		return nil
+	}
+	_, err := iCollection.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: itemID}, trackedStock},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "reserved", Value: -quantity}}}})
+	return err
+}
+
+// deleting the reservation document is what gives its quantity to the caller, so the
+// expiry sweep and a cart write can never both hand back the same units. Quantity 0 when
+// the session had none
+func claimReservation(ctx context.Context, session string, itemID primitive.ObjectID,
+	rCollection *mongo.Collection) (Reservation, error) {
+	var claimed Reservation
+	err := rCollection.FindOneAndDelete(ctx,
+		bson.D{{Key: "session", Value: session}, {Key: "itemId", Value: itemID}}).
+		Decode(&claimed)
+	if err == mongo.ErrNoDocuments {
+		return Reservation{}, nil
+	}
+	return claimed, err
+}
+
+/*
+makes the session's reservations match lines: more is reserved, less is released, and
+every kept reservation gets a fresh expiry. an item short of stock keeps what it had and
+gets an error in fieldErrs naming how many are left.
+*/
+func ReserveCart(session string, lines []CartLine, iCollection, rCollection *mongo.Collection,
+	fieldErrs auth.FieldErrors) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wanted := lineQuantities(lines)
+	resultCursor, err := rCollection.Find(ctx, bson.D{{Key: "session", Value: session}})
+	if err != nil {
+		return err
+	}
+	var existing []Reservation
+	if err = resultCursor.All(ctx, &existing); err != nil {
+		return err
+	}
+	for _, reservation := range existing {
+		if _, stillWanted := wanted[reservation.ItemID]; !stillWanted {
+			wanted[reservation.ItemID] = 0
+		}
+	}
+	names := make(map[primitive.ObjectID]string)
+	for _, line := range lines {
+		names[line.ItemID] = line.Name
+		for _, component := range line.Components {
+			names[component.ItemID] = component.Name
+		}
+	}
+
+	expiresAt := time.Now().Add(reservationTTL())
+	for itemID, quantity := range wanted {
+		reservation, err := claimReservation(ctx, session, itemID, rCollection)
+		if err != nil {
+			return err
+		}
+		held := reservation.Quantity
+		switch {
+		case quantity > held:
+			tracked, err := reserveStock(ctx, itemID, quantity-held, iCollection)
+			switch {
+			case err == errOutOfStock:
+				left := held
+				if item, findErr := FindItemByID(itemID, iCollection); findErr == nil &&
+					item.Stock != nil {
+					left = *item.Stock - item.Reserved + held
+				}
+				fieldErrs.Add("lines", fmt.Sprintf("only %d of %s left", left, names[itemID]))
+				quantity = held
+			case err != nil:
+				releaseStock(ctx, itemID, held, iCollection)
+				return err
+			case !tracked:
+				continue
+			}
+		case quantity < held:
+			if err = releaseStock(ctx, itemID, held-quantity, iCollection); err != nil {
+				return err
+			}
+		}
+		if quantity == 0 {
+			continue
+		}
+		_, err = rCollection.InsertOne(ctx, Reservation{ItemID: itemID, Session: session,
+			Quantity: quantity, ExpiresAt: expiresAt})
+		if err != nil {
+			// a concurrent write for the same session got there first, it holds its own
+			releaseStock(ctx, itemID, quantity, iCollection)
+			if !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hands back stock held by reservations past their expiry
+func ExpireReservations(iCollection, rCollection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	expired := bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$lt", Value: time.Now()}}}}
+	for {
+		var reservation Reservation
+		err := rCollection.FindOneAndDelete(ctx, expired).Decode(&reservation)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = releaseStock(ctx, reservation.ItemID, reservation.Quantity, iCollection); err != nil {
+			return err
+		}
+	}
+}
+
+func ExpireReservationsEvery(ctx context.Context, interval time.Duration,
+	iCollection, rCollection *mongo.Collection) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := ExpireReservations(iCollection, rCollection); err != nil {
+			fmt.Printf("expiring reservations failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// second stage of every stock update: flip availability off at zero, back on when
+// stock returns to an item we flipped off
+var soldOutStage = bson.D{{Key: "$set", Value: bson.D{
+	{Key: "soldOut", Value: bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$lte", Value: bson.A{"$stock", 0}}},
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$soldOut", false}}}, "$availability"}}},
+		false,
+	}}}},
+	{Key: "availability", Value: bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$lte", Value: bson.A{"$stock", 0}}},
+		false,
+		bson.D{{Key: "$or", Value: bson.A{
+			"$availability", bson.D{{Key: "$ifNull", Value: bson.A{"$soldOut", false}}}}}},
+	}}}},
+}}}
+
+// stock += delta, with the sold out flip. returns the item as it is afterwards
+func adjustStock(ctx context.Context, itemID primitive.ObjectID, delta int64,
+	iCollection *mongo.Collection) (Item, error) {
+	var updated Item
+	err := iCollection.FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: itemID}, trackedStock},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.D{{Key: "stock",
+				Value: bson.D{{Key: "$add", Value: bson.A{"$stock", delta}}}}}}},
+			soldOutStage,
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	return updated, err
+}
+
+func emitLowStock(ctx context.Context, events StockEvents, before int64, item Item) {
+	if item.Stock == nil || item.LowStockThreshold <= 0 {
+		return
+	}
+	// only on crossing, not on every sale below the threshold
+	if before > item.LowStockThreshold && *item.Stock <= item.LowStockThreshold {
+		err := events.LowStock(ctx, StockEvent{ItemID: item.ID, Name: item.Name,
+			Stock: *item.Stock, Threshold: item.LowStockThreshold, At: time.Now().UTC()})
+		if err != nil {
+			fmt.Printf("could not emit low stock event for %s: %v\n", item.ID.Hex(), err)
+		}
+	}
+}
+
+/*
+takes quantities out of stock for an order, using the session's reservations first. all
+or nothing: if one item is short, fieldErrs says which were short and everything is
+handed back, the stock already taken and the session's reservations with it, so a 409
+leaves the cart holding what it held. untracked items pass straight through. putBack
+does the same for a caller whose order fails after this succeeded.
+*/
+func DecrementStock(session string, quantities map[primitive.ObjectID]int64,
+	iCollection, rCollection *mongo.Collection, events StockEvents,
+	fieldErrs auth.FieldErrors) (putBack func(), err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	taken := make(map[primitive.ObjectID]int64)
+	claimed := make(map[primitive.ObjectID]Reservation)
+	putBack = func() {
+		// own context: callers put back after this one is cancelled
+		undoCtx, undoCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer undoCancel()
+		restoreStock(undoCtx, taken, claimed, iCollection, rCollection)
+	}
+	for itemID, quantity := range quantities {
+		reservation, err := claimReservation(ctx, session, itemID, rCollection)
+		if err != nil {
+			putBack()
+			return func() {}, err
+		}
+		if reservation.Quantity > 0 {
+			claimed[itemID] = reservation
+		}
+		held := reservation.Quantity
+		var updated Item
+		err = iCollection.FindOneAndUpdate(ctx,
+			bson.D{
+				{Key: "_id", Value: itemID},
+				trackedStock,
+				// stock minus everyone else's reservations covers this order
+				{Key: "$expr", Value: bson.D{{Key: "$gte", Value: bson.A{
+					bson.D{{Key: "$subtract", Value: bson.A{"$stock",
+						bson.D{{Key: "$subtract", Value: bson.A{reservedOrZero, held}}}}}},
+					quantity,
+				}}}},
+			},
+			mongo.Pipeline{
+				{{Key: "$set", Value: bson.D{
+					{Key: "stock", Value: bson.D{{Key: "$subtract", Value: bson.A{"$stock", quantity}}}},
+					{Key: "reserved", Value: bson.D{{Key: "$max", Value: bson.A{0,
+						bson.D{{Key: "$subtract", Value: bson.A{reservedOrZero, held}}}}}}},
+				}}},
+				soldOutStage,
+			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+		if err == nil {
+			taken[itemID] = quantity
+			emitLowStock(ctx, events, *updated.Stock+quantity, updated)
+			continue
+		}
+		// the reservation still counts in reserved, putBack gives the document back
+		if err != mongo.ErrNoDocuments {
+			putBack()
+			return func() {}, err
+		}
+		item, findErr := FindItemByID(itemID, iCollection)
+		if findErr != nil {
+			putBack()
+			return func() {}, findErr
+		}
+		if item.Stock == nil {
+			delete(claimed, itemID)
+			continue // not counted
+		}
+		// reserved still has this session's hold in it
+		fieldErrs.Add("lines", fmt.Sprintf("only %d of %s left",
+			*item.Stock-item.Reserved+held, item.Name))
+	}
+	if len(fieldErrs) > 0 {
+		putBack()
+		return func() {}, errOutOfStock
+	}
+	return putBack, nil
+}
+
+/*
+undoes DecrementStock: taken stock goes back on the items, and every reservation it
+claimed is put back, both the document and (for items it took) its share of reserved.
+a reservation the session has made again meanwhile wins, the claimed one's units are
+released instead.
+*/
+func restoreStock(ctx context.Context, taken map[primitive.ObjectID]int64,
+	claimed map[primitive.ObjectID]Reservation, iCollection, rCollection *mongo.Collection) {
+	for itemID, quantity := range taken {
+		if _, err := adjustStock(ctx, itemID, quantity, iCollection); err != nil {
+			fmt.Printf("could not put back stock of %s: %v\n", itemID.Hex(), err)
+		}
+		if reservation, found := claimed[itemID]; found {
+			_, err := iCollection.UpdateOne(ctx,
+				bson.D{{Key: "_id", Value: itemID}, trackedStock},
+				bson.D{{Key: "$inc", Value: bson.D{{Key: "reserved", Value: reservation.Quantity}}}})
+			if err != nil {
+				fmt.Printf("could not put back reserved of %s: %v\n", itemID.Hex(), err)
+			}
+		}
+	}
+	for itemID, reservation := range claimed {
+		_, err := rCollection.InsertOne(ctx, reservation)
+		if err == nil {
+			continue
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			err = releaseStock(ctx, itemID, reservation.Quantity, iCollection)
+		}
+		if err != nil {
+			fmt.Printf("could not put back reservation of %s: %v\n", itemID.Hex(), err)
+		}
+	}
+}
+
+/*
+body {"stock": 20} sets the count (and starts counting an untracked item), {"add": 5}
+or {"add": -2} adjusts it, {"lowStockThreshold": 3} sets when StockEvents hears about it,
+{"untrack": true} stops counting. not versioned: orders change stock all the time and
+shouldn't make staff item edits conflict.
+*/
+type StockInput struct {
+	Stock             *int64 `json:"stock"`
+	Add               *int64 `json:"add"`
+	LowStockThreshold *int64 `json:"lowStockThreshold"`
+	Untrack           bool   `json:"untrack"`
+}
+
+// PUT /admin/items/{id}/stock
+func SetItemStock(events StockEvents, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is reservations
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		var input StockInput
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(bodyBytes, &input)
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, "bad stock json")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		if input.Stock != nil && input.Add != nil {
+			fieldErrs.Add("stock", "send stock or add, not both")
+		}
+		if input.Stock != nil && *input.Stock < 0 {
+			fieldErrs.Add("stock", "must not be negative")
+		}
+		if input.LowStockThreshold != nil && *input.LowStockThreshold < 0 {
+			fieldErrs.Add("lowStockThreshold", "must not be negative")
+		}
+		if input.Untrack && (input.Stock != nil || input.Add != nil) {
+			fieldErrs.Add("untrack", "can't untrack and set stock at once")
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		current, err := FindItemByID(itemID, collections[0])
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+
+		set := bson.D{}
+		if input.LowStockThreshold != nil {
+			set = append(set, bson.E{Key: "lowStockThreshold", Value: *input.LowStockThreshold})
+		}
+		switch {
+		case input.Untrack:
+			// reservations would otherwise come back off reserved if it is tracked again
+			if _, err = collections[1].DeleteMany(ctx,
+				bson.D{{Key: "itemId", Value: itemID}}); err != nil {
+				break
+			}
+			set = append(set, bson.E{Key: "reserved", Value: 0})
+			_, err = collections[0].UpdateOne(ctx, bson.D{{Key: "_id", Value: itemID}},
+				bson.D{{Key: "$set", Value: set}, {Key: "$unset", Value: bson.D{{Key: "stock", Value: ""}}}})
+		case input.Stock != nil:
+			// setting the stock counts from there, minus whatever carts already hold
+			set = append(set, bson.E{Key: "stock", Value: *input.Stock})
+			if current.Stock == nil {
+				set = append(set, bson.E{Key: "reserved", Value: 0})
+			}
+			_, err = collections[0].UpdateOne(ctx, bson.D{{Key: "_id", Value: itemID}},
+				mongo.Pipeline{{{Key: "$set", Value: set}}, soldOutStage})
+		case input.Add != nil:
+			if current.Stock == nil {
+				auth.RespondError(w, http.StatusConflict, "item stock isn't tracked, set stock first")
+				return
+			}
+			if len(set) > 0 {
+				_, err = collections[0].UpdateOne(ctx, bson.D{{Key: "_id", Value: itemID}},
+					bson.D{{Key: "$set", Value: set}})
+			}
+			if err == nil {
+				_, err = adjustStock(ctx, itemID, *input.Add, collections[0])
+			}
+		case len(set) > 0:
+			_, err = collections[0].UpdateOne(ctx, bson.D{{Key: "_id", Value: itemID}},
+				bson.D{{Key: "$set", Value: set}})
+		}
+		if err != nil {
+			fmt.Printf("could not set stock of %s: %v\n", itemID.Hex(), err)
+			auth.RespondError(w, http.StatusInternalServerError, "could not save stock")
+			return
+		}
+		updated, err := FindItemByID(itemID, collections[0])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load item")
+			return
+		}
+		if current.Stock != nil {
+			emitLowStock(ctx, events, *current.Stock, updated)
+		}
+		json.NewEncoder(w).Encode(updated)
+	})
+}
@@ -0,0 +1,458 @@
+package content
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+menu text in more than one language. an item's own name and description are in
+MENU_LANGUAGE (default en); Translations holds the others by language tag, and so do
+categories for their names. customers get one language per field, the first one in
+their chain that has it:
+  - the lang parameter (lang=fr-CA, or a comma separated list), else Accept-Language by q
+  - each tag then its shorter forms (fr-CA, fr), then MENU_LANGUAGE_FALLBACKS for it
+    (e.g. "ca:es,pt-BR:pt-PT")
+  - MENU_LANGUAGE last, which every item has
+MENU_LANGUAGES lists the languages staff translate into, for the missing report.
+*/
+
+type ItemTranslation struct {
+	Name        string `bson:"name" json:"name"`
+	Description string `bson:"description" json:"description"`
+}
+
+type CategoryTranslation struct {
+	Name string `bson:"name" json:"name"`
+}
+
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// "fr-ca" -> "fr-CA", "zh-hant-tw" -> "zh-Hant-TW"; false when it isn't a language tag
+func normalizeLanguage(tag string) (string, bool) {
+	tag = strings.ReplaceAll(strings.TrimSpace(tag), "_", "-")
+	if !languageTagPattern.MatchString(tag) {
+		return "", false
+	}
+	parts := strings.Split(tag, "-")
+	parts[0] = strings.ToLower(parts[0])
+	for idx := 1; idx < len(parts); idx++ {
+		switch len(parts[idx]) {
+		case 2:
+			parts[idx] = strings.ToUpper(parts[idx])
+		case 4:
+			parts[idx] = strings.ToUpper(parts[idx][:1]) + strings.ToLower(parts[idx][1:])
+		default:
+			parts[idx] = strings.ToLower(parts[idx])
+		}
+	}
+	return strings.Join(parts, "-"), true
+}
+
+// language the items' own name and description are written in
+func BaseLanguage() string {
+	if base, ok := normalizeLanguage(os.Getenv("MENU_LANGUAGE")); ok {
+		return base
+	}
+	return "en"
+}
+
+// languages staff are expected to translate into, base left out
+func TranslatedLanguages() []string {
+	languages := make([]string, 0)
+	for _, raw := range strings.Split(os.Getenv("MENU_LANGUAGES"), ",") {
+		if tag, ok := normalizeLanguage(raw); ok && tag != BaseLanguage() &&
+			!containsString(languages, tag) {
+			languages = append(languages, tag)
+		}
+	}
+	return languages
+}
+
+func languageFallbacks() map[string][]string {
+	fallbacks := make(map[string][]string)
+	for _, pair := range strings.Split(os.Getenv("MENU_LANGUAGE_FALLBACKS"), ",") {
+		from, to, found := strings.Cut(pair, ":")
+		fromTag, fromOK := normalizeLanguage(from)
+		toTag, toOK := normalizeLanguage(to)
+		if found && fromOK && toOK {
+			fallbacks[fromTag] = append(fallbacks[fromTag], toTag)
+		}
+	}
+	return fallbacks
+}
+
+// Accept-Language tags, highest q first, q=0 and * left out
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	candidates := make([]weighted, 0)
+	for _, part := range strings.Split(header, ",") {
+		rawTag, params, _ := strings.Cut(part, ";")
+		tag, ok := normalizeLanguage(rawTag)
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(params[2:], 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	tags := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		tags = append(tags, candidate.tag)
+	}
+	return tags
+}
+
+// every language to try, best first, always ending with the base language
+func LanguageChain(preferred []string) []string {
+	fallbacks := languageFallbacks()
+	chain := make([]string, 0)
+	var add func(tag string)
+	add = func(tag string) {
+		if containsString(chain, tag) {
+			return
+		}
+		chain = append(chain, tag)
+		for _, fallback := range fallbacks[tag] {
+			add(fallback)
+		}
+	}
+	for _, tag := range preferred {
+		for {
+			add(tag)
+			cut := strings.LastIndex(tag, "-")
+			if cut < 0 {
+				break
+			}
+			tag = tag[:cut]
+		}
+	}
+	add(BaseLanguage())
+	return chain
+}
+
+// chain for a customer request; a bad lang parameter is a field error
+func RequestLanguages(r *http.Request, fieldErrs auth.FieldErrors) []string {
+	preferred := make([]string, 0)
+	if rawLang := r.URL.Query().Get("lang"); len(rawLang) > 0 {
+		for _, raw := range strings.Split(rawLang, ",") {
+			tag, ok := normalizeLanguage(raw)
+			if !ok {
+				fieldErrs.Add("lang", fmt.Sprintf("%q is not a language tag like fr or fr-CA", raw))
+				continue
+			}
+			preferred = append(preferred, tag)
+		}
+	} else {
+		preferred = parseAcceptLanguage(r.Header.Get("Accept-Language"))
+	}
+	return LanguageChain(preferred)
+}
+
+// the first language in chain that's the base or one staff translate into
+func contentLanguage(chain []string) string {
+	translated := TranslatedLanguages()
+	for _, tag := range chain {
+		if tag == BaseLanguage() || containsString(translated, tag) {
+			return tag
+		}
+	}
+	return BaseLanguage()
+}
+
+// copy of item with name and description in the best language of chain
+func localizeItem(item Item, chain []string) Item {
+	base := BaseLanguage()
+	name, description := "", ""
+	for _, tag := range chain {
+		translation := item.Translations[tag]
+		if tag == base {
+			translation = ItemTranslation{Name: item.Name, Description: item.Description}
+		}
+		if len(name) == 0 {
+			name = translation.Name
+		}
+		if len(description) == 0 {
+			description = translation.Description
+		}
+	}
+	item.Name, item.Description = name, description
+	item.Translations = nil // customers get the one language, not all of them
+	return item
+}
+
+// copies of nodes (and their children) with names in the best language of chain
+func localizeCategories(nodes []*CategoryNode, chain []string) []*CategoryNode {
+	base := BaseLanguage()
+	localized := make([]*CategoryNode, 0, len(nodes))
+	for _, node := range nodes {
+		copied := *node
+		for _, tag := range chain {
+			if tag == base {
+				break // the node's own name
+			}
+			if translation := node.Translations[tag]; len(translation.Name) > 0 {
+				copied.Name = translation.Name
+				break
+			}
+		}
+		copied.Translations = nil
+		copied.Children = localizeCategories(node.Children, chain)
+		localized = append(localized, &copied)
+	}
+	return localized
+}
+
+func languageFromPath(r *http.Request, fieldErrs auth.FieldErrors) string {
+	tag, ok := normalizeLanguage(mux.Vars(r)["lang"])
+	switch {
+	case !ok:
+		fieldErrs.Add("lang", "not a language tag like fr or fr-CA")
+	case tag == BaseLanguage():
+		fieldErrs.Add("lang", fmt.Sprintf("%s is the base language, edit the item or category itself",
+			tag))
+	}
+	return tag
+}
+
+func readTranslation(r *http.Request, target interface{}) error {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
+
+// PUT /admin/items/{id}/translations/{lang} {"name", "description"}
+func PutItemTranslation(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		var translation ItemTranslation
+		if err = readTranslation(r, &translation); err != nil {
+			auth.RespondError(w, http.StatusBadRequest, fmt.Sprintf("bad translation json: %v", err))
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		tag := languageFromPath(r, fieldErrs)
+		translation.Name = strings.TrimSpace(translation.Name)
+		translation.Description = strings.TrimSpace(translation.Description)
+		if len(translation.Name) == 0 && len(translation.Description) == 0 {
+			fieldErrs.Add("name", "name or description required")
+		}
+		if len([]rune(translation.Name)) > 100 {
+			fieldErrs.Add("name", "must be at most 100 characters")
+		}
+		if len([]rune(translation.Description)) > 1000 {
+			fieldErrs.Add("description", "must be at most 1000 characters")
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		updated, err := updateItemTranslation(itemID, bson.D{{Key: "$set",
+			Value: bson.D{{Key: "translations." + tag, Value: translation}}}}, collections[0])
+		respondItemWrite(w, itemID, updated, err, collections[0])
+	})
+}
+
+// DELETE /admin/items/{id}/translations/{lang}
+func DeleteItemTranslation(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		tag := languageFromPath(r, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		updated, err := updateItemTranslation(itemID, bson.D{{Key: "$unset",
+			Value: bson.D{{Key: "translations." + tag, Value: ""}}}}, collections[0])
+		respondItemWrite(w, itemID, updated, err, collections[0])
+	})
+}
+
+// translations don't conflict with other edits, so no version check; still bumps it
+func updateItemTranslation(itemID primitive.ObjectID, update bson.D,
+	iCollection *mongo.Collection) (Item, error) {
+	updateCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var updated Item
+	update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}})
+	err := iCollection.FindOneAndUpdate(updateCtx,
+		bson.D{{Key: "_id", Value: itemID}, {Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}}},
+		update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	return updated, err
+}
+
+// PUT /admin/categories/{id}/translations/{lang} {"name"}, DELETE removes it
+func CategoryTranslationHandler(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is categories
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		categoryID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such category")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		tag := languageFromPath(r, fieldErrs)
+		update := bson.D{{Key: "$unset", Value: bson.D{{Key: "translations." + tag, Value: ""}}}}
+		if r.Method == http.MethodPut {
+			var translation CategoryTranslation
+			if err = readTranslation(r, &translation); err != nil {
+				auth.RespondError(w, http.StatusBadRequest, fmt.Sprintf("bad translation json: %v", err))
+				return
+			}
+			translation.Name = strings.TrimSpace(translation.Name)
+			if len(translation.Name) == 0 || len([]rune(translation.Name)) > 100 {
+				fieldErrs.Add("name", "required, at most 100 characters")
+			}
+			update = bson.D{{Key: "$set",
+				Value: bson.D{{Key: "translations." + tag, Value: translation}}}}
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		updateCtx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		var category Category
+		err = collections[0].FindOneAndUpdate(updateCtx, bson.D{{Key: "_id", Value: categoryID}},
+			update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&category)
+		if err == mongo.ErrNoDocuments {
+			auth.RespondError(w, http.StatusNotFound, "no such category")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not save translation")
+			return
+		}
+		json.NewEncoder(w).Encode(category)
+	})
+}
+
+type MissingTranslation struct {
+	ID      primitive.ObjectID `json:"id"`
+	Name    string             `json:"name"` // in the base language
+	Missing []string           `json:"missing"`
+}
+
+type MissingTranslations struct {
+	Items      []MissingTranslation `json:"items"`
+	Categories []MissingTranslation `json:"categories"`
+}
+
+/*
+GET /admin/translations/missing?lang=fr,de (default MENU_LANGUAGES): per language, items
+and categories without their own translation of a field the base language has. fallbacks
+don't count, the point is what staff still have to write.
+*/
+func MissingTranslationsHandler(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is categories
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fieldErrs := make(auth.FieldErrors)
+		languages := TranslatedLanguages()
+		if rawLang := r.URL.Query().Get("lang"); len(rawLang) > 0 {
+			languages = make([]string, 0)
+			for _, raw := range strings.Split(rawLang, ",") {
+				if tag, ok := normalizeLanguage(raw); ok {
+					languages = append(languages, tag)
+				} else {
+					fieldErrs.Add("lang", fmt.Sprintf("%q is not a language tag", raw))
+				}
+			}
+		}
+		if len(languages) == 0 {
+			fieldErrs.Add("lang", "required when MENU_LANGUAGES is not set")
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		items, err := GetMenu(bson.D{{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}}},
+			collections[0])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load items")
+			return
+		}
+		tree, err := LoadCategoryTree(collections[1])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+
+		report := make(map[string]MissingTranslations, len(languages))
+		for _, tag := range languages {
+			missing := MissingTranslations{Items: []MissingTranslation{},
+				Categories: []MissingTranslation{}}
+			for _, item := range items {
+				translation := item.Translations[tag]
+				fields := make([]string, 0)
+				if len(translation.Name) == 0 {
+					fields = append(fields, "name")
+				}
+				if len(item.Description) > 0 && len(translation.Description) == 0 {
+					fields = append(fields, "description")
+				}
+				if len(fields) > 0 {
+					missing.Items = append(missing.Items,
+						MissingTranslation{ID: item.ID, Name: item.Name, Missing: fields})
+				}
+			}
+			for _, node := range tree.byID {
+				if len(node.Translations[tag].Name) == 0 {
+					missing.Categories = append(missing.Categories,
+						MissingTranslation{ID: node.ID, Name: node.Name, Missing: []string{"name"}})
+				}
+			}
+			sort.Slice(missing.Categories, func(i, j int) bool {
+				return missing.Categories[i].Name < missing.Categories[j].Name
+			})
+			report[tag] = missing
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,516 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+what the customer menu is served from. MemoryMenuCache keeps the live version's items
+and categories plus what's sold out, how popular items are, item ratings and scheduled
+prices in memory, so a menu request reads no collections; NoMenuCache reads them all from
+mongo on every request (tests, debugging, MENU_CACHE=off). MemoryMenuCache.Run keeps the
+snapshot current from change streams on menuState (a publish swaps the whole snapshot),
+items (stock and popularity), reviews and priceChanges, the last three only reload sold
+out ids, popularity, ratings and prices; standalone mongo has no change streams, there it
+polls every MENU_CACHE_POLL_SECONDS.
+*/
+
+type MenuCache interface {
+	Current(ctx context.Context) (*MenuSnapshot, error)
+	Stats() MenuCacheStats
+}
+
+type MenuCacheStats struct {
+	Hits     uint64    `json:"hits"`
+	Misses   uint64    `json:"misses"`
+	Rebuilds uint64    `json:"rebuilds"`
+	Version  int64     `json:"version"`
+	BuiltAt  time.Time `json:"builtAt"`
+	// "change-stream", "polling", or "none" for NoMenuCache
+	Updates string `json:"updates"`
+}
+
+// everything a menu request needs, never modified once built
+type MenuSnapshot struct {
+	Live      LiveMenu
+	Tree      *CategoryTree
+	SoldOut   []primitive.ObjectID
+	Schedules []Schedule // distinct item schedules, for the ETag
+	// item id -> times ordered in all, read live from the items collection rather than
+	// the copy. see livePopularity
+	Popularity       map[primitive.ObjectID]int64
+	popularityDigest string
+	// item id -> rating from approved reviews, see reviews.go
+	Ratings       map[primitive.ObjectID]RatingSummary
+	ratingsDigest string
+	// item id -> cost scheduled after the version was copied, see LivePrices
+	Prices       map[primitive.ObjectID]Money
+	pricesDigest string
+	BuiltAt      time.Time
+	// nil when not held in memory, pages then come from Live.Items
+	items []Item
+	byID  map[primitive.ObjectID]int // index into items
+}
+
+// rCollection (reviews) and pCollection (priceChanges) can be nil, items then have no
+// ratings and the version's prices
+func loadSnapshot(ctx context.Context, menu MenuSource, iCollection *mongo.Collection,
+	rCollection *mongo.Collection, pCollection *mongo.Collection,
+	withItems bool) (*MenuSnapshot, error) {
+	live, err := menu.Menu(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &MenuSnapshot{Live: live, BuiltAt: time.Now()}
+	if snapshot.Tree, err = LoadCategoryTree(live.Categories); err != nil {
+		return nil, err
+	}
+	if snapshot.SoldOut, err = soldOutIDs(ctx, iCollection); err != nil {
+		return nil, err
+	}
+	if err = snapshot.loadPopularity(ctx, iCollection); err != nil {
+		return nil, err
+	}
+	if snapshot.Schedules, err = versionSchedules(ctx, live.Items); err != nil {
+		return nil, err
+	}
+	if err = snapshot.loadRatings(ctx, rCollection); err != nil {
+		return nil, err
+	}
+	if err = snapshot.loadPrices(ctx, pCollection); err != nil {
+		return nil, err
+	}
+	if withItems {
+		if snapshot.items, err = GetMenu(bson.D{}, live.Items); err != nil {
+			return nil, err
+		}
+		snapshot.byID = make(map[primitive.ObjectID]int, len(snapshot.items))
+		for idx, item := range snapshot.items {
+			snapshot.byID[item.ID] = idx
+		}
+	}
+	return snapshot, nil
+}
+
+func (snapshot *MenuSnapshot) loadPopularity(ctx context.Context,
+	iCollection *mongo.Collection) error {
+	popularity, err := livePopularity(ctx, iCollection, nil)
+	if err != nil {
+		return err
+	}
+	snapshot.Popularity = popularity
+	snapshot.popularityDigest = popularityDigest(popularity)
+	return nil
+}
+
+func (snapshot *MenuSnapshot) loadRatings(ctx context.Context,
+	rCollection *mongo.Collection) error {
+	snapshot.Ratings = map[primitive.ObjectID]RatingSummary{}
+	if rCollection != nil {
+		ratings, err := LoadRatings(ctx, rCollection)
+		if err != nil {
+			return err
+		}
+		snapshot.Ratings = ratings
+	}
+	snapshot.ratingsDigest = ratingsDigest(snapshot.Ratings)
+	return nil
+}
+
+func (snapshot *MenuSnapshot) loadPrices(ctx context.Context,
+	pCollection *mongo.Collection) error {
+	prices, err := LivePrices(ctx, snapshot.Live, pCollection)
+	if err != nil {
+		return err
+	}
+	snapshot.Prices = prices
+	snapshot.pricesDigest = pricesDigest(prices)
+	return nil
+}
+
+// item at the price that applies now, which may be newer than the version's
+func (snapshot *MenuSnapshot) Priced(item Item) Item {
+	if cost, ok := snapshot.Prices[item.ID]; ok {
+		item.Cost = cost
+	}
+	return item
+}
+
+// item with how often it has been ordered up to now, not up to the publish
+func (snapshot *MenuSnapshot) Popular(item Item) Item {
+	item.Popularity = snapshot.Popularity[item.ID]
+	return item
+}
+
+// item with its rating, nil when it has no approved reviews
+func (snapshot *MenuSnapshot) Rated(item Item) Item {
+	item.Rating = nil
+	if rating, ok := snapshot.Ratings[item.ID]; ok {
+		item.Rating = &rating
+	}
+	return item
+}
+
+// one page of the menu, from memory when the snapshot holds the items
+func (snapshot *MenuSnapshot) Page(filter MenuFilter, page MenuPage) ([]Item, string, error) {
+	if snapshot.items != nil {
+		items, nextCursor := snapshot.pageOf(snapshot.items, filter, page)
+		return items, nextCursor, nil
+	}
+	// the version holds costs and popularity as they were at the copy. when the filter or
+	// sort depends on newer ones mongo only narrows the items down, the rest is done here
+	// the way the in memory menu does it
+	byPrice := filter.MinPrice != nil || filter.MaxPrice != nil || page.SortField == "cost.amount"
+	if page.SortField == "popularity" || (byPrice && len(snapshot.Prices) > 0) {
+		unpriced := filter
+		unpriced.MinPrice, unpriced.MaxPrice = nil, nil
+		items, err := GetMenu(withoutSoldOut(unpriced.BSON(), snapshot.SoldOut),
+			snapshot.Live.Items)
+		if err != nil {
+			return nil, "", err
+		}
+		items, nextCursor := snapshot.pageOf(items, filter, page)
+		return items, nextCursor, nil
+	}
+	items, nextCursor, err := GetMenuPage(withoutSoldOut(filter.BSON(), snapshot.SoldOut),
+		page, snapshot.Live.Items)
+	for idx := range items {
+		items[idx] = snapshot.Popular(snapshot.Priced(items[idx]))
+	}
+	return items, nextCursor, err
+}
+
+// items at their current price and popularity, then filtered and paged like GetMenuPage
+func (snapshot *MenuSnapshot) pageOf(items []Item, filter MenuFilter,
+	page MenuPage) ([]Item, string) {
+	soldOut := make(map[primitive.ObjectID]bool, len(snapshot.SoldOut))
+	for _, itemID := range snapshot.SoldOut {
+		soldOut[itemID] = true
+	}
+	matching := make([]Item, 0)
+	for _, item := range items {
+		item = snapshot.Popular(snapshot.Priced(item))
+		if !soldOut[item.ID] && filter.Matches(item) {
+			matching = append(matching, item)
+		}
+	}
+	return pageItems(matching, page)
+}
+
+// the items with these ids that filter matches and aren't sold out, in the order of ids
+func (snapshot *MenuSnapshot) Lookup(ids []primitive.ObjectID, filter MenuFilter) ([]Item, error) {
+	soldOut := make(map[primitive.ObjectID]bool, len(snapshot.SoldOut))
+	for _, itemID := range snapshot.SoldOut {
+		soldOut[itemID] = true
+	}
+	byID, err := snapshot.itemsByID(ids)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]Item, 0, len(ids))
+	for _, itemID := range ids {
+		item, ok := byID[itemID]
+		if !ok || soldOut[itemID] {
+			continue
+		}
+		if item = snapshot.Popular(snapshot.Priced(item)); filter.Matches(item) {
+			found = append(found, item)
+		}
+	}
+	return found, nil
+}
+
+// whichever of ids are in the version, from memory or one query
+func (snapshot *MenuSnapshot) itemsByID(ids []primitive.ObjectID) (map[primitive.ObjectID]Item, error) {
+	byID := make(map[primitive.ObjectID]Item, len(ids))
+	if snapshot.items != nil {
+		for _, itemID := range ids {
+			if idx, ok := snapshot.byID[itemID]; ok {
+				byID[itemID] = snapshot.items[idx]
+			}
+		}
+		return byID, nil
+	}
+	if len(ids) == 0 {
+		return byID, nil
+	}
+	items, err := GetMenu(bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}},
+		snapshot.Live.Items)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		byID[item.ID] = item
+	}
+	return byID, nil
+}
+
+// the distinct item schedules in a version, which is all of them scheduleBSON can match
+func versionSchedules(ctx context.Context, iCollection *mongo.Collection) ([]Schedule, error) {
+	resultCursor, err := iCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$schedules"}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$schedules"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Schedule Schedule `bson:"_id"`
+	}
+	if err = resultCursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	schedules := make([]Schedule, 0, len(groups))
+	for _, group := range groups {
+		schedules = append(schedules, group.Schedule)
+	}
+	return schedules, nil
+}
+
+// reads through to mongo every time
+type NoMenuCache struct {
+	Menu    MenuSource
+	Items   *mongo.Collection // live items, for what's sold out
+	Reviews *mongo.Collection // for ratings, can be nil
+	Prices  *mongo.Collection // priceChanges, can be nil
+	reads   uint64
+}
+
+func (cache *NoMenuCache) Current(ctx context.Context) (*MenuSnapshot, error) {
+	atomic.AddUint64(&cache.reads, 1)
+	return loadSnapshot(ctx, cache.Menu, cache.Items, cache.Reviews, cache.Prices, false)
+}
+
+func (cache *NoMenuCache) Stats() MenuCacheStats {
+	return MenuCacheStats{Misses: atomic.LoadUint64(&cache.reads), Updates: "none"}
+}
+
+type MemoryMenuCache struct {
+	publisher *MenuPublisher
+	reviews   *mongo.Collection
+	prices    *mongo.Collection
+	poll      time.Duration
+	mutex     sync.RWMutex
+	snapshot  *MenuSnapshot
+	updates   string
+	hits      uint64
+	misses    uint64
+	rebuilds  uint64
+}
+
+// MENU_CACHE_POLL_SECONDS in ./.env, default 5; only used without change streams.
+// reviews and prices (priceChanges) can be nil, items then have no ratings and the
+// version's prices
+func NewMemoryMenuCache(publisher *MenuPublisher, reviews *mongo.Collection,
+	prices *mongo.Collection) *MemoryMenuCache {
+	poll := 5 * time.Second
+	if seconds, err := strconv.Atoi(os.Getenv("MENU_CACHE_POLL_SECONDS")); err == nil && seconds > 0 {
+		poll = time.Duration(seconds) * time.Second
+	}
+	return &MemoryMenuCache{publisher: publisher, reviews: reviews, prices: prices, poll: poll}
+}
+
+func (cache *MemoryMenuCache) Current(ctx context.Context) (*MenuSnapshot, error) {
+	cache.mutex.RLock()
+	snapshot := cache.snapshot
+	cache.mutex.RUnlock()
+	if snapshot != nil {
+		atomic.AddUint64(&cache.hits, 1)
+		return snapshot, nil
+	}
+	// not built yet, or the last build failed
+	atomic.AddUint64(&cache.misses, 1)
+	return cache.rebuild(ctx)
+}
+
+func (cache *MemoryMenuCache) Stats() MenuCacheStats {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	stats := MenuCacheStats{
+		Hits:     atomic.LoadUint64(&cache.hits),
+		Misses:   atomic.LoadUint64(&cache.misses),
+		Rebuilds: atomic.LoadUint64(&cache.rebuilds),
+		Updates:  cache.updates,
+	}
+	if cache.snapshot != nil {
+		stats.Version = cache.snapshot.Live.Version
+		stats.BuiltAt = cache.snapshot.BuiltAt
+	}
+	return stats
+}
+
+func (cache *MemoryMenuCache) store(snapshot *MenuSnapshot) {
+	cache.mutex.Lock()
+	cache.snapshot = snapshot
+	cache.mutex.Unlock()
+}
+
+func (cache *MemoryMenuCache) rebuild(ctx context.Context) (*MenuSnapshot, error) {
+	snapshot, err := loadSnapshot(ctx, cache.publisher, cache.publisher.Drafts, cache.reviews,
+		cache.prices, true)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&cache.rebuilds, 1)
+	cache.store(snapshot)
+	return snapshot, nil
+}
+
+// stock moved, an order was placed, a review was moderated or a price applied: same
+// version, new sold out ids, popularity, ratings and prices
+func (cache *MemoryMenuCache) refreshLive(ctx context.Context) error {
+	cache.mutex.RLock()
+	current := cache.snapshot
+	cache.mutex.RUnlock()
+	if current == nil {
+		_, err := cache.rebuild(ctx)
+		return err
+	}
+	soldOut, err := soldOutIDs(ctx, cache.publisher.Drafts)
+	if err != nil {
+		return err
+	}
+	updated := *current
+	updated.SoldOut = soldOut
+	if err = updated.loadPopularity(ctx, cache.publisher.Drafts); err != nil {
+		return err
+	}
+	if err = updated.loadRatings(ctx, cache.reviews); err != nil {
+		return err
+	}
+	if err = updated.loadPrices(ctx, cache.prices); err != nil {
+		return err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	// a rebuild that finished meanwhile has newer sold out ids, popularity, ratings and prices
+	if cache.snapshot == current {
+		cache.snapshot = &updated
+	}
+	return nil
+}
+
+// keeps the snapshot current until ctx is cancelled
+func (cache *MemoryMenuCache) Run(ctx context.Context) {
+	err := cache.watch(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	fmt.Printf("menu cache: no change streams (%v), polling every %v\n", err, cache.poll)
+	cache.mutex.Lock()
+	cache.updates = "polling"
+	cache.mutex.Unlock()
+	cache.pollEvery(ctx)
+}
+
+/*
+returns when change streams can't be opened (standalone mongo). once open, a broken
+stream is reopened; the snapshot is rebuilt each time since events may have been missed.
+*/
+func (cache *MemoryMenuCache) watch(ctx context.Context) error {
+	state := cache.publisher.State.Name()
+	watched := bson.A{cache.publisher.Drafts.Name(), state}
+	if cache.reviews != nil {
+		watched = append(watched, cache.reviews.Name())
+	}
+	if cache.prices != nil {
+		watched = append(watched, cache.prices.Name())
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{
+		{Key: "ns.coll", Value: bson.D{{Key: "$in", Value: watched}}},
+	}}}}
+	opened := false
+	for {
+		stream, err := cache.publisher.Drafts.Database().Watch(ctx, pipeline)
+		if err != nil && !opened {
+			return err
+		}
+		if err == nil {
+			if !opened {
+				cache.mutex.Lock()
+				cache.updates = "change-stream"
+				cache.mutex.Unlock()
+			}
+			opened = true
+			if _, err = cache.rebuild(ctx); err != nil {
+				fmt.Printf("menu cache rebuild failed: %v\n", err)
+			}
+			for stream.Next(ctx) {
+				var event struct {
+					Namespace struct {
+						Collection string `bson:"coll"`
+					} `bson:"ns"`
+				}
+				if err = stream.Decode(&event); err != nil {
+					continue
+				}
+				if event.Namespace.Collection == state {
+					_, err = cache.rebuild(ctx)
+				} else {
+					err = cache.refreshLive(ctx)
+				}
+				if err != nil {
+					fmt.Printf("menu cache update failed: %v\n", err)
+				}
+			}
+			err = stream.Err()
+			stream.Close(context.Background())
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fmt.Printf("menu cache change stream closed (%v), reopening\n", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (cache *MemoryMenuCache) pollEvery(ctx context.Context) {
+	ticker := time.NewTicker(cache.poll)
+	defer ticker.Stop()
+	for {
+		cache.mutex.RLock()
+		current := cache.snapshot
+		cache.mutex.RUnlock()
+		live, err := cache.publisher.Menu(ctx)
+		switch {
+		case err != nil:
+		case current == nil || live.Version != current.Live.Version ||
+			!live.PublishedAt.Equal(current.Live.PublishedAt):
+			_, err = cache.rebuild(ctx)
+		default:
+			err = cache.refreshLive(ctx)
+		}
+		if err != nil {
+			fmt.Printf("menu cache poll failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GET /admin/menu/cache, hit/miss counters and what the cache holds
+func MenuCacheStatsHandler(cache MenuCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cache.Stats())
+	})
+}
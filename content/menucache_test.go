@@ -0,0 +1,243 @@
+package content
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+NoMenuCache pages with MenuFilter.BSON and GetMenuPage, MemoryMenuCache with Matches and
+pageItems. there is no mongo in tests, so each side is checked on its own: Matches
+against the items each filter should let through, BSON against the query it should
+build.
+*/
+
+func menuItems() ([]Item, map[string]primitive.ObjectID) {
+	categories := map[string]primitive.ObjectID{}
+	for idx, name := range []string{"mains", "sides", "late"} {
+		categories[name] = primitive.ObjectID{0xca, byte(idx + 1)}
+	}
+	schedules := func(schedule Schedule) []Schedule {
+		return normalizeSchedules([]Schedule{schedule}, "schedules", auth.FieldErrors{})
+	}
+	calories := func(kcal float64) *Nutrition { return &Nutrition{Calories: &kcal} }
+	items := []Item{
+		{Name: "Cheese Burger", Cost: NewMoney(850, "USD"), Popularity: 12,
+			CategoryIDs: []primitive.ObjectID{categories["mains"]},
+			Allergens:   []string{"dairy", "gluten"}, Nutrition: calories(700)},
+		{Name: "Veggie Burger", Cost: NewMoney(800, "USD"), Popularity: 12,
+			CategoryIDs: []primitive.ObjectID{categories["mains"]},
+			Allergens:   []string{"gluten", "nuts"}, Dietary: []string{"vegan", "vegetarian"},
+			Nutrition: calories(450)},
+		{Name: "Fries", Cost: NewMoney(300, "USD"), Popularity: 40,
+			CategoryIDs: []primitive.ObjectID{categories["sides"]}, Dietary: []string{"vegan"},
+			Nutrition: calories(300)},
+		{Name: "Fries", Cost: NewMoney(350, "USD"), Popularity: 40,
+			CategoryIDs: []primitive.ObjectID{categories["sides"]}, Dietary: []string{"vegan"}},
+		// open by its own schedule (monday's window runs past midnight), not by category
+		{Name: "Late Night Wings", Cost: NewMoney(900, "USD"), Popularity: 3,
+			CategoryIDs: []primitive.ObjectID{categories["late"]},
+			Schedules:   schedules(Schedule{DayNames: []string{"mon"}, From: "22:00", Until: "02:00"})},
+		{Name: "Midnight Toastie", Cost: NewMoney(600, "USD"),
+			Schedules: schedules(Schedule{DayNames: []string{"monday"}, From: "22:00", Until: "02:00"})},
+		{Name: "Lunch Salad", Cost: NewMoney(700, "USD"), Dietary: []string{"vegan"},
+			CategoryIDs: []primitive.ObjectID{categories["mains"]}, Nutrition: calories(350),
+			Schedules: schedules(Schedule{DayNames: []string{"tue"}, From: "11:00", Until: "15:00"})},
+		{Name: "Summer Lemonade", Cost: NewMoney(250, "USD"),
+			CategoryIDs: []primitive.ObjectID{categories["sides"]},
+			Schedules:   schedules(Schedule{StartDate: "2026-06-01", EndDate: "2026-09-30"})},
+		{Name: "Euro Crepe", Cost: NewMoney(500, "EUR"), Popularity: 5},
+		{Name: "Hidden Special", Cost: NewMoney(999, "USD"),
+			CategoryIDs: []primitive.ObjectID{categories["mains"]}},
+		{Name: "Retired Shake", Cost: NewMoney(450, "USD"), Deleted: true,
+			CategoryIDs: []primitive.ObjectID{categories["sides"]}},
+		// one of its categories is open
+		{Name: "Wings Bucket", Cost: NewMoney(1200, "USD"), Popularity: 7,
+			CategoryIDs: []primitive.ObjectID{categories["late"], categories["mains"]}},
+		{Name: "Soda", Cost: NewMoney(200, "USD"), Dietary: []string{"vegan", "vegetarian"},
+			CategoryIDs: []primitive.ObjectID{categories["sides"]}, Nutrition: calories(150)},
+	}
+	for idx := range items {
+		// ids out of name order so _id tie breaks are exercised
+		items[idx].ID = primitive.ObjectID{0x1d, byte((idx*7)%13 + 1)}
+		items[idx].Availability = items[idx].Name != "Hidden Special"
+	}
+	return items, categories
+}
+
+func TestMenuFilterMatches(t *testing.T) {
+	t.Setenv("STORE_TIMEZONE", "UTC")
+	items, categories := menuItems()
+	at := time.Date(2026, 10, 20, 1, 30, 0, 0, time.UTC) // a tuesday
+	price := func(amount int) *int { return &amount }
+	kcal := 400.0
+	available := true
+	tests := []struct {
+		name   string
+		filter MenuFilter
+		want   []string
+	}{
+		{"customer", MenuFilter{Availability: &available, Currency: "USD"},
+			[]string{"Cheese Burger", "Veggie Burger", "Fries", "Fries", "Late Night Wings",
+				"Midnight Toastie", "Lunch Salad", "Summer Lemonade", "Euro Crepe",
+				"Wings Bucket", "Soda"}},
+		{"staff sees everything", MenuFilter{IncludeDeleted: true, Currency: "USD"},
+			[]string{"Cheese Burger", "Veggie Burger", "Fries", "Fries", "Late Night Wings",
+				"Midnight Toastie", "Lunch Salad", "Summer Lemonade", "Euro Crepe",
+				"Hidden Special", "Retired Shake", "Wings Bucket", "Soda"}},
+		{"price range is inclusive", MenuFilter{MinPrice: price(300), MaxPrice: price(850),
+			Currency: "USD", Availability: &available},
+			[]string{"Cheese Burger", "Veggie Burger", "Fries", "Fries", "Midnight Toastie",
+				"Lunch Salad"}},
+		{"max price", MenuFilter{MaxPrice: price(500), Currency: "USD",
+			Availability: &available},
+			[]string{"Fries", "Fries", "Summer Lemonade", "Soda"}},
+		{"price only in its currency", MenuFilter{MinPrice: price(0), Currency: "EUR",
+			Availability: &available},
+			[]string{"Euro Crepe"}},
+		{"category", MenuFilter{Types: []string{"mains"},
+			CategoryIDs:  []primitive.ObjectID{categories["mains"]},
+			Availability: &available, Currency: "USD"},
+			[]string{"Cheese Burger", "Veggie Burger", "Lunch Salad", "Wings Bucket"}},
+		// fries without nutrition don't pass max_calories
+		{"dietary", MenuFilter{Dietary: DietaryFilter{ExcludeAllergens: []string{"nuts"},
+			Dietary: []string{"vegan"}, MaxCalories: &kcal}, Availability: &available,
+			Currency: "USD"},
+			[]string{"Fries", "Lunch Salad", "Soda"}},
+		{"open now", MenuFilter{OpenAt: &at,
+			ClosedCategoryIDs: []primitive.ObjectID{categories["late"]},
+			Availability:      &available, Currency: "USD"},
+			[]string{"Cheese Burger", "Veggie Burger", "Fries", "Fries", "Midnight Toastie",
+				"Euro Crepe", "Wings Bucket", "Soda"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, item := range items {
+				if test.filter.Matches(item) {
+					got = append(got, item.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMenuFilterBSON(t *testing.T) {
+	t.Setenv("STORE_TIMEZONE", "UTC")
+	at := time.Date(2026, 10, 20, 1, 30, 0, 0, time.UTC)
+	closed := []primitive.ObjectID{{0xca, 3}}
+	mains := []primitive.ObjectID{{0xca, 1}}
+	price := func(amount int) *int { return &amount }
+	kcal := 400.0
+	available := true
+	customer := bson.D{
+		{Key: "availability", Value: true},
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+	}
+	tests := []struct {
+		name   string
+		filter MenuFilter
+		want   bson.D
+	}{
+		{"customer", MenuFilter{Availability: &available, Currency: "USD"}, customer},
+		{"staff sees everything", MenuFilter{IncludeDeleted: true, Currency: "USD"}, bson.D{}},
+		{"price range", MenuFilter{MinPrice: price(300), MaxPrice: price(850), Currency: "EUR",
+			Availability: &available},
+			append(bson.D{
+				{Key: "cost.currency", Value: "EUR"},
+				{Key: "cost.amount", Value: bson.D{{Key: "$gte", Value: 300},
+					{Key: "$lte", Value: 850}}},
+			}, customer...)},
+		{"category", MenuFilter{Types: []string{"mains"}, CategoryIDs: mains,
+			Availability: &available, Currency: "USD"},
+			append(bson.D{{Key: "categoryIds", Value: bson.D{{Key: "$in", Value: mains}}}},
+				customer...)},
+		{"dietary", MenuFilter{Dietary: DietaryFilter{Allergens: []string{"dairy"},
+			ExcludeAllergens: []string{"nuts"}, ExcludeDietary: []string{"spicy"},
+			MaxCalories: &kcal}, Availability: &available, Currency: "USD"},
+			append(append(bson.D{}, customer...),
+				bson.E{Key: "allergens", Value: bson.D{{Key: "$all", Value: []string{"dairy"}},
+					{Key: "$nin", Value: []string{"nuts"}}}},
+				bson.E{Key: "dietary", Value: bson.D{{Key: "$nin", Value: []string{"spicy"}}}},
+				bson.E{Key: "nutrition.calories", Value: bson.D{{Key: "$lte", Value: 400.0}}})},
+		{"open now", MenuFilter{OpenAt: &at, ClosedCategoryIDs: closed,
+			Availability: &available, Currency: "USD"},
+			append(append(bson.D{}, customer...), scheduleBSON(at, closed)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.filter.BSON(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// walking the cursors a page at a time visits what one big page holds, in its order
+func TestMenuPageCursors(t *testing.T) {
+	items, _ := menuItems()
+	available := true
+	filter := MenuFilter{Availability: &available, Currency: "USD"}
+	snapshot := &MenuSnapshot{SoldOut: []primitive.ObjectID{items[2].ID},
+		Popularity: map[primitive.ObjectID]int64{}}
+	for _, item := range items {
+		snapshot.Popularity[item.ID] = item.Popularity
+	}
+	for _, sortParam := range []string{"name", "-name", "cost", "-cost", "popularity",
+		"-popularity"} {
+		fieldErrs := auth.FieldErrors{}
+		all, _ := snapshot.pageOf(items, filter, ParseMenuPage(url.Values{"sort": {sortParam},
+			"limit": {strconv.Itoa(len(items))}}, fieldErrs))
+		if len(fieldErrs) > 0 {
+			t.Fatal(fieldErrs)
+		}
+		for _, limit := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%s/%d", sortParam, limit), func(t *testing.T) {
+				query := url.Values{"sort": {sortParam}, "limit": {strconv.Itoa(limit)}}
+				walked := make([]Item, 0, len(all))
+				for pageNumber := 0; pageNumber <= len(items); pageNumber++ {
+					fieldErrs := auth.FieldErrors{}
+					page := ParseMenuPage(query, fieldErrs)
+					if len(fieldErrs) > 0 {
+						t.Fatalf("page %d: %v", pageNumber, fieldErrs)
+					}
+					got, nextCursor := snapshot.pageOf(items, filter, page)
+					if len(got) > limit {
+						t.Fatalf("page %d has %d items", pageNumber, len(got))
+					}
+					walked = append(walked, got...)
+					if len(nextCursor) == 0 {
+						if names(walked) != names(all) {
+							t.Errorf("walked %s, want %s", names(walked), names(all))
+						}
+						return
+					}
+					query = url.Values{"sort": {sortParam}, "limit": {strconv.Itoa(limit)},
+						"cursor": {nextCursor}}
+				}
+				t.Fatal("cursor never reaches the last page")
+			})
+		}
+	}
+}
+
+func names(items []Item) string {
+	labels := make([]string, 0, len(items))
+	for _, item := range items {
+		labels = append(labels, fmt.Sprintf("%s#%x", item.Name, item.ID[1]))
+	}
+	return "[" + strings.Join(labels, ", ") + "]"
+}
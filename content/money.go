@@ -0,0 +1,249 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+prices as an integer amount of the currency's minor unit (cents, pence, yen) plus the
+ISO 4217 code, so 12.50 EUR is {Amount: 1250, Currency: "EUR"}. never floats: anything
+that produces fractions of a minor unit goes through MulRatio, which rounds half to even.
+amounts in different currencies can't be added or compared; that is an error, not a
+silent conversion.
+*/
+type Money struct {
+	Amount   int64  `bson:"amount" json:"amount"`
+	Currency string `bson:"currency" json:"currency"`
+}
+
+// ISO 4217 code -> digits after the decimal point. extend when the menu goes abroad
+var minorUnits = map[string]int{
+	"AUD": 2, "CAD": 2, "CHF": 2, "CNY": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2,
+	"INR": 2, "MXN": 2, "NOK": 2, "NZD": 2, "PLN": 2, "SEK": 2, "SGD": 2, "USD": 2,
+	"ZAR": 2, "JPY": 0, "KRW": 0, "ISK": 0, "BHD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+var errCurrencyMismatch = errors.New("amounts are in different currencies")
+
+func KnownCurrency(currency string) bool {
+	_, known := minorUnits[currency]
+	return known
+}
+
+// MENU_CURRENCY in ./.env, what every price without an explicit currency is in
+func DefaultCurrency() string {
+	currency := strings.ToUpper(strings.TrimSpace(os.Getenv("MENU_CURRENCY")))
+	if KnownCurrency(currency) {
+		return currency
+	}
+	return "USD"
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return m, errCurrencyMismatch
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+func (m Money) Mul(quantity int64) Money {
+	return Money{Amount: m.Amount * quantity, Currency: m.Currency}
+}
+
+// m * numerator / denominator to the nearest minor unit, halves to even (banker's rounding)
+// e.g. 8% tax on m is m.MulRatio(8, 100)
+func (m Money) MulRatio(numerator, denominator int64) Money {
+	exact := new(big.Rat).SetFrac(
+		new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(numerator)),
+		big.NewInt(denominator))
+	return Money{Amount: roundHalfEven(exact), Currency: m.Currency}
+}
+
+func roundHalfEven(exact *big.Rat) int64 {
+	quotient, remainder := new(big.Int).QuoRem(exact.Num(), exact.Denom(), new(big.Int))
+	// remainder has the sign of the numerator; compare 2*|remainder| with denominator
+	twiceRemainder := new(big.Int).Abs(remainder)
+	twiceRemainder.Lsh(twiceRemainder, 1)
+	switch cmp := twiceRemainder.Cmp(exact.Denom()); {
+	case cmp > 0, cmp == 0 && quotient.Bit(0) == 1:
+		if exact.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	return quotient.Int64()
+}
+
+// amount in major units without currency, e.g. "12.50", "-0.05", "1200" for JPY
+func (m Money) Decimal() string {
+	digits := minorUnits[m.Currency]
+	if digits == 0 {
+		return strconv.FormatInt(m.Amount, 10)
+	}
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	scale := int64(1)
+	for i := 0; i < digits; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, digits, amount%scale)
+}
+
+// e.g. "12.50 EUR"
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+/*
+"12.5", "12.50 EUR" or "EUR 12.50" -> Money. currency falls back to defaultCurrency when
+the string has none. more decimals than the currency has are rounded half to even.
+*/
+func ParseMoney(text string, defaultCurrency string) (Money, error) {
+	fields := strings.Fields(text)
+	currency, number := defaultCurrency, ""
+	switch len(fields) {
+	case 1:
+		number = fields[0]
+	case 2:
+		if KnownCurrency(strings.ToUpper(fields[0])) {
+			currency, number = strings.ToUpper(fields[0]), fields[1]
+		} else {
+			currency, number = strings.ToUpper(fields[1]), fields[0]
+		}
+	default:
+		return Money{}, fmt.Errorf("%q is not an amount", text)
+	}
+	if !KnownCurrency(currency) {
+		return Money{}, fmt.Errorf("unknown currency %q", currency)
+	}
+	exact, ok := new(big.Rat).SetString(number)
+	if !ok || strings.ContainsAny(number, "/eE") {
+		return Money{}, fmt.Errorf("%q is not an amount", text)
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(minorUnits[currency])), nil)
+	exact.Mul(exact, new(big.Rat).SetInt(scale))
+	return Money{Amount: roundHalfEven(exact), Currency: currency}, nil
+}
+
+// adds a human readable "formatted" next to amount and currency, ignored when reading back
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount    int64  `json:"amount"`
+		Currency  string `json:"currency"`
+		Formatted string `json:"formatted"`
+	}{m.Amount, m.Currency, m.String()})
+}
+
+/*
+accepts {"amount": 1250, "currency": "EUR"}, a string ParseMoney understands, or a bare
+integer of minor units in DefaultCurrency (what cost used to be).
+*/
+func (m *Money) UnmarshalJSON(data []byte) error {
+	trimmed := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(trimmed, "{"):
+		var fields struct {
+			Amount   *int64 `json:"amount"`
+			Currency string `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		if fields.Amount == nil {
+			return errors.New("money needs an amount")
+		}
+		currency := strings.ToUpper(strings.TrimSpace(fields.Currency))
+		if len(currency) == 0 {
+			currency = DefaultCurrency()
+		}
+		*m = Money{Amount: *fields.Amount, Currency: currency}
+	case strings.HasPrefix(trimmed, `"`):
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		parsed, err := ParseMoney(text, DefaultCurrency())
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	default:
+		var amount int64
+		if err := json.Unmarshal(data, &amount); err != nil {
+			return errors.New("money must be {amount, currency}, a string or whole minor units")
+		}
+		*m = Money{Amount: amount, Currency: DefaultCurrency()}
+	}
+	return nil
+}
+
+// documents written before Money have a bare number; read it as minor units of DefaultCurrency
+func (m *Money) UnmarshalBSONValue(valueType bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: valueType, Value: data}
+	switch valueType {
+	case bsontype.EmbeddedDocument:
+		var fields struct {
+			Amount   int64  `bson:"amount"`
+			Currency string `bson:"currency"`
+		}
+		if err := raw.Unmarshal(&fields); err != nil {
+			return err
+		}
+		*m = Money{Amount: fields.Amount, Currency: fields.Currency}
+	case bsontype.Int32:
+		*m = Money{Amount: int64(raw.Int32()), Currency: DefaultCurrency()}
+	case bsontype.Int64:
+		*m = Money{Amount: raw.Int64(), Currency: DefaultCurrency()}
+	case bsontype.Double:
+		exact := new(big.Rat).SetFloat64(raw.Double())
+		if exact == nil {
+			return fmt.Errorf("cannot read %v as money", raw.Double())
+		}
+		*m = Money{Amount: roundHalfEven(exact), Currency: DefaultCurrency()}
+	case bsontype.Null, bsontype.Undefined:
+		*m = Money{}
+	default:
+		return fmt.Errorf("cannot read bson %s as money", valueType)
+	}
+	return nil
+}
+
+/*
+safe to run every start: every item whose cost is still a bare number gets it rewritten as
+{amount, currency} in currency, treating the old number as minor units.
+*/
+func MigrateCosts(iCollection *mongo.Collection, currency string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := iCollection.UpdateMany(ctx,
+		bson.D{{Key: "cost", Value: bson.D{{Key: "$type", Value: "number"}}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.D{{Key: "cost", Value: bson.D{
+			{Key: "amount", Value: bson.D{{Key: "$toLong", Value: bson.D{
+				{Key: "$round", Value: bson.A{"$cost", 0}}}}}},
+			{Key: "currency", Value: currency},
+		}}}}}})
+	return err
+}
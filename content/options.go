@@ -0,0 +1,245 @@
+package content
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+sizes and extras. an item may declare variants (pick exactly one, e.g. small/large) and
+modifier groups (pick between MinSelect and MaxSelect options, e.g. up to 3 toppings).
+prices are deltas on Item.Cost (same currency) so changing the base price moves every
+combination.
+clients only ever send ids; names and prices always come from the item on the server.
+*/
+type Variant struct {
+	ID         string   `bson:"id" json:"id"`
+	Name       string   `bson:"name" json:"name"`
+	PriceDelta Money    `bson:"priceDelta" json:"priceDelta"`
+	Available  bool     `bson:"available" json:"available"`
+	Allergens  []string `bson:"allergens" json:"allergens"` // added to the item's
+}
+
+type ModifierOption struct {
+	ID         string   `bson:"id" json:"id"`
+	Name       string   `bson:"name" json:"name"`
+	PriceDelta Money    `bson:"priceDelta" json:"priceDelta"`
+	Available  bool     `bson:"available" json:"available"`
+	Allergens  []string `bson:"allergens" json:"allergens"` // added to the item's
+}
+
+type ModifierGroup struct {
+	ID        string           `bson:"id" json:"id"`
+	Name      string           `bson:"name" json:"name"`
+	MinSelect int              `bson:"minSelect" json:"minSelect"`
+	MaxSelect int              `bson:"maxSelect" json:"maxSelect"`
+	Options   []ModifierOption `bson:"options" json:"options"`
+}
+
+// what the client picked for one group
+type SelectedModifiers struct {
+	GroupID   string   `bson:"groupId" json:"groupId"`
+	OptionIDs []string `bson:"optionIds" json:"optionIds"`
+}
+
+// one row of a cart as stored: client's choices plus server computed names and prices
+type CartLine struct {
+	ItemID    primitive.ObjectID  `bson:"itemId" json:"itemId"`
+	Name      string              `bson:"name" json:"name"`
+	VariantID string              `bson:"variantId,omitempty" json:"variantId,omitempty"`
+	Modifiers []SelectedModifiers `bson:"modifiers" json:"modifiers"`
+	Quantity  int                 `bson:"quantity" json:"quantity"`
+	UnitPrice Money               `bson:"unitPrice" json:"unitPrice"`
+	LinePrice Money               `bson:"linePrice" json:"linePrice"`
+	// everything in it: the item's allergens plus those of the variant and options chosen
+	Allergens []string `bson:"allergens" json:"allergens"`
+	// bundles only: what the client put in each slot, and the server's line per slot for
+	// stock, see priceBundleLine
+	Slots      []SelectedSlot `bson:"slots,omitempty" json:"slots,omitempty"`
+	Components []CartLine     `bson:"components,omitempty" json:"components,omitempty"`
+	// when the line went in at UnitPrice, which it keeps for PriceHold, see prices.go
+	AddedAt time.Time `bson:"addedAt,omitempty" json:"addedAt,omitempty"`
+}
+
+const maxLineQuantity = 99
+
+// shape checks on what staff declare, done when an item is written
+func ValidateItemOptions(item Item, fieldErrs auth.FieldErrors) {
+	// delta of the cheapest variant, then of the cheapest choices in every group
+	var cheapestVariant int64
+	pricedVariant := false
+	variantIDs := make(map[string]bool)
+	for idx, variant := range item.Variants {
+		field := fmt.Sprintf("variants[%d]", idx)
+		if len(variant.ID) == 0 || len(variant.Name) == 0 {
+			fieldErrs.Add(field, "id and name required")
+		}
+		if variantIDs[variant.ID] {
+			fieldErrs.Add(field, fmt.Sprintf("duplicate variant id %s", variant.ID))
+		}
+		if variant.PriceDelta.Currency != item.Cost.Currency {
+			fieldErrs.Add(field, fmt.Sprintf("price delta must be in %s", item.Cost.Currency))
+		} else if item.Cost.Amount+variant.PriceDelta.Amount < 0 {
+			fieldErrs.Add(field, "price delta makes the item cost less than nothing")
+		} else if !pricedVariant || variant.PriceDelta.Amount < cheapestVariant {
+			cheapestVariant, pricedVariant = variant.PriceDelta.Amount, true
+		}
+		variantIDs[variant.ID] = true
+	}
+	var cheapestOptions int64
+	groupIDs := make(map[string]bool)
+	for idx, group := range item.ModifierGroups {
+		field := fmt.Sprintf("modifierGroups[%d]", idx)
+		if len(group.ID) == 0 || len(group.Name) == 0 {
+			fieldErrs.Add(field, "id and name required")
+		}
+		if groupIDs[group.ID] {
+			fieldErrs.Add(field, fmt.Sprintf("duplicate group id %s", group.ID))
+		}
+		groupIDs[group.ID] = true
+		if group.MinSelect < 0 || group.MaxSelect < group.MinSelect {
+			fieldErrs.Add(field, "need 0 <= minSelect <= maxSelect")
+		}
+		if group.MaxSelect > len(group.Options) {
+			fieldErrs.Add(field, "maxSelect is more than the number of options")
+		}
+		optionIDs := make(map[string]bool)
+		for _, option := range group.Options {
+			if len(option.ID) == 0 || len(option.Name) == 0 {
+				fieldErrs.Add(field, "every option needs an id and name")
+			}
+			if optionIDs[option.ID] {
+				fieldErrs.Add(field, fmt.Sprintf("duplicate option id %s", option.ID))
+			}
+			if option.PriceDelta.Currency != item.Cost.Currency {
+				fieldErrs.Add(field, fmt.Sprintf("option %s price delta must be in %s",
+					option.ID, item.Cost.Currency))
+			}
+			optionIDs[option.ID] = true
+		}
+		// a line may take every discounting option up to maxSelect, on the cheapest variant
+		// and with every other group at its cheapest too
+		cheapest := cheapestSelection(group)
+		if item.Cost.Amount+cheapestVariant+cheapestOptions+cheapest < 0 {
+			fieldErrs.Add(field, "option price deltas can make the item cost less than nothing")
+		} else {
+			cheapestOptions += cheapest
+		}
+	}
+}
+
+// lowest total delta a valid pick from the group adds: the minSelect cheapest options,
+// then any further ones that take money off, up to maxSelect
+func cheapestSelection(group ModifierGroup) int64 {
+	deltas := make([]int64, 0, len(group.Options))
+	for _, option := range group.Options {
+		deltas = append(deltas, option.PriceDelta.Amount)
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] })
+	var total int64
+	for idx, delta := range deltas {
+		if idx >= group.MaxSelect || (idx >= group.MinSelect && delta >= 0) {
+			break
+		}
+		total += delta
+	}
+	return total
+}
+
+/*
+checks a client's choices against the item and prices them. field is the prefix for
+errors, e.g. lines[2], so the client knows which cart row is wrong. returns the line
+with Name, UnitPrice and LinePrice filled in from the item.
+*/
+func PriceCartLine(line CartLine, item Item, field string, fieldErrs auth.FieldErrors) CartLine {
+	line.Name = item.Name
+	if !item.Availability || item.Deleted {
+		fieldErrs.Add(field, fmt.Sprintf("%s is not available", item.Name))
+	}
+	if line.Quantity < 1 || line.Quantity > maxLineQuantity {
+		fieldErrs.Add(field+".quantity", fmt.Sprintf("must be from 1 to %d", maxLineQuantity))
+	}
+	unitPrice := item.Cost
+	var chosenVariant *Variant
+	chosenOptions := make([]*ModifierOption, 0)
+
+	switch {
+	case len(item.Variants) == 0 && len(line.VariantID) > 0:
+		fieldErrs.Add(field+".variantId", "item has no variants")
+	case len(item.Variants) > 0 && len(line.VariantID) == 0:
+		fieldErrs.Add(field+".variantId", "choose a variant")
+	case len(item.Variants) > 0:
+		for idx := range item.Variants {
+			if item.Variants[idx].ID == line.VariantID {
+				chosenVariant = &item.Variants[idx]
+			}
+		}
+		if chosenVariant == nil || !chosenVariant.Available {
+			fieldErrs.Add(field+".variantId", fmt.Sprintf("%s is not available", line.VariantID))
+		} else {
+			unitPrice = addDelta(unitPrice, chosenVariant.PriceDelta, field+".variantId", fieldErrs)
+		}
+	}
+
+	picked := make(map[string][]string)
+	for _, selected := range line.Modifiers {
+		if _, repeated := picked[selected.GroupID]; repeated {
+			fieldErrs.Add(field+".modifiers", fmt.Sprintf("group %s listed twice", selected.GroupID))
+		}
+		picked[selected.GroupID] = append(picked[selected.GroupID], selected.OptionIDs...)
+	}
+	knownGroups := make(map[string]bool)
+	for _, group := range item.ModifierGroups {
+		knownGroups[group.ID] = true
+		groupField := fmt.Sprintf("%s.modifiers.%s", field, group.ID)
+		optionIDs := picked[group.ID]
+		if len(optionIDs) < group.MinSelect || len(optionIDs) > group.MaxSelect {
+			fieldErrs.Add(groupField, fmt.Sprintf("choose between %d and %d",
+				group.MinSelect, group.MaxSelect))
+		}
+		seen := make(map[string]bool)
+		for _, optionID := range optionIDs {
+			if seen[optionID] {
+				fieldErrs.Add(groupField, fmt.Sprintf("%s chosen twice", optionID))
+				continue
+			}
+			seen[optionID] = true
+			var chosen *ModifierOption
+			for idx := range group.Options {
+				if group.Options[idx].ID == optionID {
+					chosen = &group.Options[idx]
+				}
+			}
+			if chosen == nil || !chosen.Available {
+				fieldErrs.Add(groupField, fmt.Sprintf("%s is not available", optionID))
+				continue
+			}
+			unitPrice = addDelta(unitPrice, chosen.PriceDelta, groupField, fieldErrs)
+			chosenOptions = append(chosenOptions, chosen)
+		}
+	}
+	for groupID := range picked {
+		if !knownGroups[groupID] {
+			fieldErrs.Add(field+".modifiers", fmt.Sprintf("item has no group %s", groupID))
+		}
+	}
+
+	line.Allergens = lineAllergens(item, chosenVariant, chosenOptions)
+	line.UnitPrice = unitPrice
+	line.LinePrice = unitPrice.Mul(int64(line.Quantity))
+	return line
+}
+
+// ValidateItemOptions keeps deltas in the item's currency, this catches items stored before it
+func addDelta(price, delta Money, field string, fieldErrs auth.FieldErrors) Money {
+	sum, err := price.Add(delta)
+	if err != nil {
+		fieldErrs.Add(field, fmt.Sprintf("priced in %s, item is in %s", delta.Currency, price.Currency))
+	}
+	return sum
+}
@@ -0,0 +1,189 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+an order is a cart frozen at checkout: lines are priced again against current items
+(the cart may be hours old), stock is taken, and the order keeps its own copy of names
+and prices so later menu edits never change what someone was charged.
+*/
+type Order struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	User     string             `bson:"user" json:"user"`
+	Session  string             `bson:"session" json:"-"`
+	Lines    []CartLine         `bson:"lines" json:"lines"`
+	Total    Money              `bson:"total" json:"total"`
+	Status   string             `bson:"status" json:"status"`
+	PlacedAt time.Time          `bson:"placedAt" json:"placedAt"`
+}
+
+const OrderPlaced = "placed"
+
+func loadCart(sessionID string, cCollection *mongo.Collection) (Cart, error) {
+	findCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var cart Cart
+	err := cCollection.FindOne(findCtx, bson.D{{Key: "session", Value: sessionID}}).Decode(&cart)
+	return cart, err
+}
+
+/*
+empties the session's cart in one write and returns what it held, so of two checkouts of
+the same cart only one gets the lines; the other finds it empty. restoreCart undoes it
+when the order then can't be placed.
+*/
+func claimCart(sessionID string, cCollection *mongo.Collection) (Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var cart Cart
+	err := cCollection.FindOneAndUpdate(ctx,
+		bson.D{
+			{Key: "session", Value: sessionID},
+			{Key: "lines.0", Value: bson.D{{Key: "$exists", Value: true}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "lines", Value: []CartLine{}},
+			{Key: "total.amount", Value: 0},
+			{Key: "lastUpdate", Value: time.Now().Unix()},
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&cart)
+	return cart, err
+}
+
+// puts claimed lines back. lines added while the checkout ran stay, after them
+func restoreCart(cart Cart, cCollection *mongo.Collection) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := cCollection.UpdateOne(ctx,
+		bson.D{
+			{Key: "session", Value: cart.Session},
+			{Key: "lines", Value: bson.D{{Key: "$size", Value: 0}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "lines", Value: cart.Lines},
+			{Key: "total", Value: cart.Total},
+		}}})
+	if err == nil && result.MatchedCount == 0 {
+		// the next cart write prices it again, total included
+		_, err = cCollection.UpdateOne(ctx, bson.D{{Key: "session", Value: cart.Session}},
+			bson.D{{Key: "$push", Value: bson.D{{Key: "lines", Value: bson.D{
+				{Key: "$each", Value: cart.Lines},
+				{Key: "$position", Value: 0},
+			}}}}})
+	}
+	if err != nil {
+		fmt.Printf("could not restore cart of failed checkout: %v\n", err)
+	}
+}
+
+// 409 with the same {"errors": ...} shape as a 400, for carts the menu moved under
+func respondCartConflict(w http.ResponseWriter, fieldErrs auth.FieldErrors) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": fieldErrs})
+}
+
+// POST /content/checkout, places the session's cart as an order. the cart is emptied
+// first and given back if the order fails
+func PlaceOrder(menu MenuSource, events StockEvents,
+	collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is carts collections[2] is categories
+	// collections[3] is sessions collections[4] is reservations collections[5] is orders
+	// collections[6] is priceChanges
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		sessionID := auth.SessionIDFromCookies(r)
+		cart, err := claimCart(sessionID, collections[1])
+		if err == mongo.ErrNoDocuments {
+			// or another checkout of it is running
+			auth.RespondError(w, http.StatusBadRequest, "cart is empty")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load cart")
+			return
+		}
+		placed := false
+		defer func() {
+			if !placed {
+				restoreCart(cart, collections[1])
+			}
+		}()
+		// a cart filled at breakfast may no longer be orderable at lunch, or a new menu
+		// may have been published since
+		live, err := menu.Menu(r.Context())
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load menu")
+			return
+		}
+		tree, err := LoadCategoryTree(live.Categories)
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load categories")
+			return
+		}
+		prices, err := LivePrices(r.Context(), live, collections[6])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load prices")
+			return
+		}
+		// the order is at the prices the lines went in at, while they're held
+		fieldErrs := make(auth.FieldErrors)
+		lines, total, err := PriceCart(cart.Lines, cart.Lines, tree, live.Items, prices,
+			fieldErrs)
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load items for cart")
+			return
+		}
+		if len(fieldErrs) > 0 {
+			respondCartConflict(w, fieldErrs)
+			return
+		}
+		quantities := lineQuantities(lines)
+		putBack, err := DecrementStock(sessionID, quantities, collections[0], collections[4],
+			events, fieldErrs)
+		if err == errOutOfStock {
+			respondCartConflict(w, fieldErrs)
+			return
+		}
+		if err != nil {
+			fmt.Printf("could not take stock for order: %v\n", err)
+			auth.RespondError(w, http.StatusInternalServerError, "could not place order")
+			return
+		}
+
+		user, _ := auth.SessionUser(r, collections[3])
+		order := Order{User: user, Session: sessionID, Lines: lines, Total: total,
+			Status: OrderPlaced, PlacedAt: time.Now().UTC()}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		inserted, err := collections[5].InsertOne(ctx, order)
+		if err != nil {
+			// stock is already gone; put it and the cart's reservations back so the
+			// failed order doesn't leak it
+			putBack()
+			auth.RespondError(w, http.StatusInternalServerError, "could not place order")
+			return
+		}
+		order.ID = inserted.InsertedID.(primitive.ObjectID)
+		placed = true
+
+		for itemID, quantity := range quantities {
+			collections[0].UpdateOne(ctx, bson.D{{Key: "_id", Value: itemID}},
+				bson.D{{Key: "$inc", Value: bson.D{{Key: "popularity", Value: quantity}}}})
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order)
+	})
+}
@@ -0,0 +1,266 @@
+package content
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+keyset pagination for the menu: sort on one field with _id as tie breaker, and the cursor
+remembers where the last page stopped rather than how many items to skip. inserts and
+deletes between requests therefore never shift items across page boundaries.
+*/
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// sort parameter -> field in items collection. prefix "-" for descending e.g. sort=-cost
+var sortableFields = map[string]string{
+	"cost":       "cost.amount",
+	"name":       "name",
+	"popularity": "popularity",
+}
+
+type MenuPage struct {
+	Limit     int
+	SortField string
+	Desc      bool
+	After     *menuCursor
+}
+
+// what an opaque cursor decodes to. carries the sort it was made for so a
+// cursor from a cost sorted page can't be replayed against a name sort
+type menuCursor struct {
+	SortField string             `json:"s"`
+	Desc      bool               `json:"d"`
+	Value     interface{}        `json:"v"`
+	ID        primitive.ObjectID `json:"i"`
+}
+
+type MenuResponse struct {
+	Items      []Item  `json:"items"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+func encodeCursor(cursor menuCursor) string {
+	cursorJSON, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(cursorJSON)
+}
+
+func decodeCursor(encoded string) (*menuCursor, error) {
+	cursorJSON, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var cursor menuCursor
+	if err = json.Unmarshal(cursorJSON, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// limit, sort and cursor query parameters. problems are added to fieldErrs
+func ParseMenuPage(query url.Values, fieldErrs auth.FieldErrors) MenuPage {
+	page := MenuPage{Limit: defaultPageLimit, SortField: "name"}
+	if rawLimit := query.Get("limit"); len(rawLimit) > 0 {
+		limit, err := strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			fieldErrs.Add("limit", fmt.Sprintf("must be a whole number from 1 to %d", maxPageLimit))
+		} else {
+			page.Limit = limit
+		}
+	}
+	if rawSort := query.Get("sort"); len(rawSort) > 0 {
+		page.Desc = strings.HasPrefix(rawSort, "-")
+		field, found := sortableFields[strings.TrimPrefix(rawSort, "-")]
+		if !found {
+			fieldErrs.Add("sort", "must be one of cost, name, popularity (prefix - for descending)")
+		} else {
+			page.SortField = field
+		}
+	}
+	if rawCursor := query.Get("cursor"); len(rawCursor) > 0 {
+		cursor, err := decodeCursor(rawCursor)
+		switch {
+		case err != nil:
+			fieldErrs.Add("cursor", "not a cursor returned by this api")
+		case cursor.SortField != page.SortField || cursor.Desc != page.Desc:
+			fieldErrs.Add("cursor", "was made for a different sort")
+		default:
+			page.After = cursor
+		}
+	}
+	return page
+}
+
+func (page MenuPage) sortSpec() bson.D {
+	direction := 1
+	if page.Desc {
+		direction = -1
+	}
+	return bson.D{{Key: page.SortField, Value: direction}, {Key: "_id", Value: direction}}
+}
+
+// everything strictly after the cursor in sort order
+func (page MenuPage) afterFilter() bson.D {
+	comparison := "$gt"
+	if page.Desc {
+		comparison = "$lt"
+	}
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: page.SortField, Value: bson.D{{Key: comparison, Value: page.After.Value}}}},
+		bson.D{
+			{Key: page.SortField, Value: page.After.Value},
+			{Key: "_id", Value: bson.D{{Key: comparison, Value: page.After.ID}}},
+		},
+	}}}
+}
+
+func sortValue(item Item, field string) interface{} {
+	switch field {
+	case "cost.amount":
+		return item.Cost.Amount
+	case "popularity":
+		return item.Popularity
+	}
+	return item.Name
+}
+
+// sortValue against a cursor value, which comes back from JSON as float64 for numbers
+func compareSortValue(value interface{}, cursorValue interface{}) int {
+	if text, isText := value.(string); isText {
+		cursorText, _ := cursorValue.(string)
+		return strings.Compare(text, cursorText)
+	}
+	number, _ := value.(int64)
+	var cursorNumber float64
+	switch typed := cursorValue.(type) {
+	case float64:
+		cursorNumber = typed
+	case int64:
+		cursorNumber = float64(typed)
+	}
+	switch {
+	case float64(number) < cursorNumber:
+		return -1
+	case float64(number) > cursorNumber:
+		return 1
+	}
+	return 0
+}
+
+// sort order of sortSpec: field then _id, both flipped for descending
+func (page MenuPage) compare(item Item, value interface{}, id primitive.ObjectID) int {
+	order := compareSortValue(sortValue(item, page.SortField), value)
+	if order == 0 {
+		order = bytes.Compare(item.ID[:], id[:])
+	}
+	if page.Desc {
+		return -order
+	}
+	return order
+}
+
+// GetMenuPage over items already in memory, same order and cursors
+func pageItems(items []Item, page MenuPage) ([]Item, string) {
+	sorted := make([]Item, 0, len(items))
+	for _, item := range items {
+		if page.After == nil || page.compare(item, page.After.Value, page.After.ID) > 0 {
+			sorted = append(sorted, item)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return page.compare(sorted[i], sortValue(sorted[j], page.SortField), sorted[j].ID) < 0
+	})
+	return trimPage(sorted, page)
+}
+
+// sorted items after the cursor, at least page.Limit+1 of them when there is a next page.
+// next cursor is empty on the last page
+func trimPage(sorted []Item, page MenuPage) ([]Item, string) {
+	if len(sorted) <= page.Limit {
+		return sorted, ""
+	}
+	sorted = sorted[:page.Limit]
+	last := sorted[len(sorted)-1]
+	return sorted, encodeCursor(menuCursor{
+		SortField: page.SortField,
+		Desc:      page.Desc,
+		Value:     sortValue(last, page.SortField),
+		ID:        last.ID,
+	})
+}
+
+// one page of items matching filter. next cursor is empty on the last page
+func GetMenuPage(filter bson.D, page MenuPage, iCollection *mongo.Collection) ([]Item, string, error) {
+	findCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if page.After != nil {
+		filter = bson.D{{Key: "$and", Value: bson.A{filter, page.afterFilter()}}}
+	}
+	// one extra tells whether there is a next page without a second query
+	findOptions := options.Find().SetSort(page.sortSpec()).SetLimit(int64(page.Limit + 1))
+	resultCursor, err := iCollection.Find(findCtx, filter, findOptions)
+	if err != nil {
+		return nil, "", err
+	}
+	items := make([]Item, 0, page.Limit+1)
+	if err = resultCursor.All(findCtx, &items); err != nil {
+		return nil, "", err
+	}
+	items, nextCursor := trimPage(items, page)
+	return items, nextCursor, nil
+}
+
+/*
+safe to run every start: items from before popularity was counted (missing or null) get
+0. otherwise paging by popularity skips them, because the cursor's next page asks for
+popularity equal to the last value, which a missing field never is, and mongo sorts a
+missing field before 0 where pageItems reads it as 0.
+*/
+func MigratePopularity(iCollection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := iCollection.UpdateMany(ctx,
+		bson.D{{Key: "popularity", Value: bson.D{{Key: "$not",
+			Value: bson.D{{Key: "$type", Value: "number"}}}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "popularity", Value: 0}}}})
+	return err
+}
+
+// one compound index per sortable field so every page is an index range scan
+func EnsureItemIndexes(iCollection *mongo.Collection) error {
+	models := make([]mongo.IndexModel, 0, len(sortableFields))
+	for _, field := range sortableFields {
+		models = append(models, mongo.IndexModel{
+			Keys: bson.D{{Key: field, Value: 1}, {Key: "_id", Value: 1}},
+		})
+	}
+	// multikey, for filtering by category
+	models = append(models, mongo.IndexModel{Keys: bson.D{{Key: "categoryIds", Value: 1}}})
+	// items without a sku (empty string) don't take part
+	models = append(models, mongo.IndexModel{
+		Keys: bson.D{{Key: "sku", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(
+			bson.D{{Key: "sku", Value: bson.D{{Key: "$gt", Value: ""}}}}),
+	})
+	_, err := iCollection.Indexes().CreateMany(context.TODO(), models)
+	return err
+}
@@ -0,0 +1,508 @@
+package content
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+price history and scheduled price changes, in the priceChanges collection.
+  - every cost an item has had is an applied change. staff edits and imports change the
+    draft, so they record a pending change; it's applied, effective from then, when a
+    version carrying it goes live (ApplyPendingPrices). history starts with the first
+    edit after this shipped
+  - POST /admin/items/{id}/prices schedules a cost for later. ApplyPriceChangesEvery sets
+    it on the draft item when it's due
+  - customers get a scheduled price as soon as it applies, without waiting for a publish:
+    LivePrices lays changes applied since the live version was copied over its costs,
+    the way sold out ids are laid over it. the next publish carries the new cost itself.
+    edits by hand still wait for a publish, like any other draft edit
+  - cart lines keep the price they were added at for PRICE_HOLD_HOURS (default 24), so a
+    price rise between adding and checking out doesn't change what the customer agreed to
+*/
+
+const (
+	PriceScheduled = "scheduled"
+	PricePending   = "pending" // edited in the draft, not published yet
+	PriceApplied   = "applied"
+	PriceCancelled = "cancelled"
+
+	// where an applied change came from
+	PriceFromEdit     = "edit"
+	PriceFromImport   = "import"
+	PriceFromSchedule = "schedule"
+)
+
+type PriceChange struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ItemID primitive.ObjectID `bson:"itemId" json:"itemId"`
+	Cost   Money              `bson:"cost" json:"cost"`
+	// zero while pending, set when its version goes live
+	EffectiveFrom time.Time  `bson:"effectiveFrom" json:"effectiveFrom"`
+	Status        string     `bson:"status" json:"status"`
+	Source        string     `bson:"source" json:"source"`
+	CreatedBy     string     `bson:"createdBy,omitempty" json:"createdBy,omitempty"`
+	CreatedAt     time.Time  `bson:"createdAt" json:"createdAt"`
+	AppliedAt     *time.Time `bson:"appliedAt,omitempty" json:"appliedAt,omitempty"`
+	// why a scheduled change never applied
+	Reason string `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+type PriceHistory struct {
+	History   []PriceChange `json:"history"`   // applied, newest first
+	Pending   []PriceChange `json:"pending"`   // waiting for a publish, oldest first
+	Scheduled []PriceChange `json:"scheduled"` // soonest first
+}
+
+func EnsurePriceIndexes(pCollection *mongo.Collection) error {
+	_, err := pCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "itemId", Value: 1}, {Key: "effectiveFrom", Value: -1}}},
+		// ApplyDuePriceChanges
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "effectiveFrom", Value: 1}}},
+		// LivePrices
+		{Keys: bson.D{{Key: "source", Value: 1}, {Key: "appliedAt", Value: 1}}},
+		// ApplyPendingPrices
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+	})
+	return err
+}
+
+// PRICE_HOLD_HOURS in ./.env
+func PriceHold() time.Duration {
+	if hours, err := strconv.Atoi(os.Getenv("PRICE_HOLD_HOURS")); err == nil && hours >= 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+/*
+adds cost to the item's history as pending, to apply when the draft it was saved in is
+published. skipped when it's what the item already costs, pending or applied. called
+after a write has saved the cost, so a failure here is only logged: the item is right,
+its history is a step short.
+*/
+func RecordPrice(ctx context.Context, itemID primitive.ObjectID, cost Money, source string,
+	pCollection *mongo.Collection) {
+	var latest PriceChange
+	err := pCollection.FindOne(ctx,
+		bson.D{
+			{Key: "itemId", Value: itemID},
+			{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{PricePending, PriceApplied}}}},
+		},
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})).Decode(&latest)
+	if err == nil && latest.Cost == cost {
+		return
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		fmt.Printf("could not read price history of %s: %v\n", itemID.Hex(), err)
+		return
+	}
+	_, err = pCollection.InsertOne(ctx, PriceChange{ItemID: itemID, Cost: cost,
+		Status: PricePending, Source: source, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		fmt.Printf("could not record price of %s: %v\n", itemID.Hex(), err)
+	}
+}
+
+/*
+a version copied from the draft at copiedAt went live at now, so pending changes made
+before the copy are what customers pay from now on. per item only the last of them is in
+the version: earlier ones are cancelled, and so is the last when a scheduled price
+applied after it (the draft moved on) or it's the cost the history already ends with.
+pCollection can be nil, for no price history.
+*/
+func ApplyPendingPrices(ctx context.Context, pCollection *mongo.Collection, copiedAt time.Time,
+	now time.Time) error {
+	if pCollection == nil {
+		return nil
+	}
+	resultCursor, err := pCollection.Find(ctx,
+		bson.D{
+			{Key: "status", Value: PricePending},
+			{Key: "createdAt", Value: bson.D{{Key: "$lte", Value: copiedAt}}},
+		},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var pending []PriceChange
+	if err = resultCursor.All(ctx, &pending); err != nil {
+		return err
+	}
+	last := make(map[primitive.ObjectID]primitive.ObjectID, len(pending))
+	for _, change := range pending {
+		last[change.ItemID] = change.ID
+	}
+	cancelPending := func(change PriceChange, reason string) error {
+		_, err := pCollection.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: change.ID}, {Key: "status", Value: PricePending}},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "status", Value: PriceCancelled},
+				{Key: "reason", Value: reason},
+			}}})
+		return err
+	}
+	for _, change := range pending {
+		if last[change.ItemID] != change.ID {
+			if err = cancelPending(change, "edited again before it was published"); err != nil {
+				return err
+			}
+			continue
+		}
+		var applied PriceChange
+		err = pCollection.FindOne(ctx,
+			bson.D{{Key: "itemId", Value: change.ItemID}, {Key: "status", Value: PriceApplied}},
+			options.FindOne().SetSort(bson.D{{Key: "effectiveFrom", Value: -1}})).Decode(&applied)
+		switch {
+		case err != nil && err != mongo.ErrNoDocuments:
+			return err
+		case err == nil && applied.AppliedAt != nil && applied.AppliedAt.After(change.CreatedAt):
+			err = cancelPending(change, "a scheduled price applied after it")
+		case err == nil && applied.Cost == change.Cost:
+			err = cancelPending(change, "the item already cost this")
+		default:
+			// claimed by status, two processes publishing at once apply it once
+			_, err = pCollection.UpdateOne(ctx,
+				bson.D{{Key: "_id", Value: change.ID}, {Key: "status", Value: PricePending}},
+				bson.D{{Key: "$set", Value: bson.D{
+					{Key: "status", Value: PriceApplied},
+					{Key: "effectiveFrom", Value: now},
+					{Key: "appliedAt", Value: now},
+				}}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+applies scheduled changes that are due, oldest first. each is claimed before the item is
+written so two api processes never apply one twice. a change whose item has gone, or
+now costs another currency, is cancelled with the reason rather than retried forever.
+*/
+func ApplyDuePriceChanges(ctx context.Context, iCollection, pCollection *mongo.Collection) error {
+	for {
+		now := time.Now().UTC()
+		var change PriceChange
+		err := pCollection.FindOneAndUpdate(ctx,
+			bson.D{
+				{Key: "status", Value: PriceScheduled},
+				{Key: "effectiveFrom", Value: bson.D{{Key: "$lte", Value: now}}},
+			},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "status", Value: PriceApplied},
+				{Key: "appliedAt", Value: now},
+			}}},
+			options.FindOneAndUpdate().SetSort(bson.D{{Key: "effectiveFrom", Value: 1}}).
+				SetReturnDocument(options.After)).Decode(&change)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		updateResult, err := iCollection.UpdateOne(ctx,
+			bson.D{
+				{Key: "_id", Value: change.ItemID},
+				{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+				{Key: "cost.currency", Value: change.Cost.Currency},
+			},
+			bson.D{
+				{Key: "$set", Value: bson.D{{Key: "cost", Value: change.Cost}}},
+				{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+			})
+		if err != nil {
+			// unclaim, the next run tries again
+			pCollection.UpdateByID(ctx, change.ID, bson.D{
+				{Key: "$set", Value: bson.D{{Key: "status", Value: PriceScheduled}}},
+				{Key: "$unset", Value: bson.D{{Key: "appliedAt", Value: ""}}},
+			})
+			return err
+		}
+		if updateResult.MatchedCount == 0 {
+			pCollection.UpdateByID(ctx, change.ID, bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "status", Value: PriceCancelled},
+					{Key: "reason", Value: "item was deleted or is priced in another currency"},
+				}},
+				{Key: "$unset", Value: bson.D{{Key: "appliedAt", Value: ""}}},
+			})
+			continue
+		}
+		fmt.Printf("applied scheduled price %s to item %s\n", change.Cost, change.ItemID.Hex())
+	}
+}
+
+func ApplyPriceChangesEvery(ctx context.Context, interval time.Duration,
+	iCollection, pCollection *mongo.Collection) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := ApplyDuePriceChanges(ctx, iCollection, pCollection); err != nil {
+			fmt.Printf("applying scheduled prices failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+item id -> cost for items whose scheduled price applied after live was copied from the
+draft, so isn't in it. empty for the draft itself, which has every applied price.
+pCollection can be nil, for no overrides.
+*/
+func LivePrices(ctx context.Context, live LiveMenu,
+	pCollection *mongo.Collection) (map[primitive.ObjectID]Money, error) {
+	prices := make(map[primitive.ObjectID]Money)
+	if pCollection == nil || live.Version == 0 {
+		return prices, nil
+	}
+	resultCursor, err := pCollection.Find(ctx,
+		bson.D{
+			{Key: "source", Value: PriceFromSchedule},
+			{Key: "status", Value: PriceApplied},
+			{Key: "appliedAt", Value: bson.D{{Key: "$gt", Value: live.CopiedAt}}},
+		},
+		options.Find().SetSort(bson.D{{Key: "appliedAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var changes []PriceChange
+	if err = resultCursor.All(ctx, &changes); err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		prices[change.ItemID] = change.Cost // later ones win
+	}
+	return prices, nil
+}
+
+// stands in for every override in the ETag, like ratingsDigest
+func pricesDigest(prices map[primitive.ObjectID]Money) string {
+	lines := make([]string, 0, len(prices))
+	for itemID, cost := range prices {
+		lines = append(lines, fmt.Sprintf("%s %d %s", itemID.Hex(), cost.Amount, cost.Currency))
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// what makes two cart lines the same thing to buy, whatever order choices were sent in
+func lineKey(line CartLine) string {
+	normalize := func(modifiers []SelectedModifiers) []SelectedModifiers {
+		sorted := make([]SelectedModifiers, 0, len(modifiers))
+		for _, selected := range modifiers {
+			optionIDs := append([]string{}, selected.OptionIDs...)
+			sort.Strings(optionIDs)
+			sorted = append(sorted, SelectedModifiers{GroupID: selected.GroupID, OptionIDs: optionIDs})
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].GroupID < sorted[j].GroupID })
+		return sorted
+	}
+	slots := make([]SelectedSlot, 0, len(line.Slots))
+	for _, selected := range line.Slots {
+		selected.Modifiers = normalize(selected.Modifiers)
+		slots = append(slots, selected)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].SlotID < slots[j].SlotID })
+	key, _ := json.Marshal(CartLine{ItemID: line.ItemID, VariantID: line.VariantID,
+		Modifiers: normalize(line.Modifiers), Slots: slots})
+	return string(key)
+}
+
+/*
+line just priced keeps the prices of the same line in held (the cart as saved) if that
+was added less than PriceHold ago; otherwise it's added now at today's price. held comes
+from the server, never the client, so a client can't send itself an old price.
+*/
+func holdPrice(line CartLine, held map[string]CartLine, now time.Time) CartLine {
+	line.AddedAt = now
+	previous, found := held[lineKey(line)]
+	if !found || previous.AddedAt.IsZero() || now.Sub(previous.AddedAt) >= PriceHold() ||
+		previous.UnitPrice.Currency != line.UnitPrice.Currency ||
+		len(previous.Components) != len(line.Components) {
+		return line
+	}
+	line.AddedAt = previous.AddedAt
+	line.UnitPrice = previous.UnitPrice
+	line.LinePrice = line.UnitPrice.Mul(int64(line.Quantity))
+	components := make([]CartLine, 0, len(line.Components))
+	for idx, component := range line.Components {
+		component.UnitPrice = previous.Components[idx].UnitPrice
+		component.LinePrice = component.UnitPrice.Mul(int64(line.Quantity))
+		components = append(components, component)
+	}
+	line.Components = components
+	return line
+}
+
+func heldLines(lines []CartLine) map[string]CartLine {
+	held := make(map[string]CartLine, len(lines))
+	for _, line := range lines {
+		held[lineKey(line)] = line
+	}
+	return held
+}
+
+// GET /admin/items/{id}/prices
+func ItemPricesHandler(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is priceChanges
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		history := PriceHistory{History: make([]PriceChange, 0), Pending: make([]PriceChange, 0),
+			Scheduled: make([]PriceChange, 0)}
+		resultCursor, err := collections[0].Find(ctx,
+			bson.D{{Key: "itemId", Value: itemID}, {Key: "status", Value: PriceApplied}},
+			options.Find().SetSort(bson.D{{Key: "effectiveFrom", Value: -1}}))
+		if err == nil {
+			err = resultCursor.All(ctx, &history.History)
+		}
+		if err == nil {
+			resultCursor, err = collections[0].Find(ctx,
+				bson.D{{Key: "itemId", Value: itemID}, {Key: "status", Value: PricePending}},
+				options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+		}
+		if err == nil {
+			err = resultCursor.All(ctx, &history.Pending)
+		}
+		if err == nil {
+			resultCursor, err = collections[0].Find(ctx,
+				bson.D{{Key: "itemId", Value: itemID}, {Key: "status", Value: PriceScheduled}},
+				options.Find().SetSort(bson.D{{Key: "effectiveFrom", Value: 1}}))
+		}
+		if err == nil {
+			err = resultCursor.All(ctx, &history.Scheduled)
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load prices")
+			return
+		}
+		json.NewEncoder(w).Encode(history)
+	})
+}
+
+// POST /admin/items/{id}/prices {"cost", "effectiveFrom"}, a price for later. responds 201
+func SchedulePriceChange(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is items collections[1] is priceChanges collections[2] is sessions
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		var input struct {
+			Cost          *Money     `json:"cost"`
+			EffectiveFrom *time.Time `json:"effectiveFrom"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&input); err != nil {
+			auth.RespondError(w, http.StatusBadRequest, "body must be {\"cost\", \"effectiveFrom\"}")
+			return
+		}
+		item, err := FindItemByID(itemID, collections[0])
+		if err == mongo.ErrNoDocuments || (err == nil && item.Deleted) {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not schedule price")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		switch {
+		case input.Cost == nil:
+			fieldErrs.Add("cost", "required")
+		case input.Cost.Amount < 0:
+			fieldErrs.Add("cost", "must not be negative")
+		case input.Cost.Currency != item.Cost.Currency:
+			// variant and modifier deltas are in the item's currency
+			fieldErrs.Add("cost", fmt.Sprintf("must be in %s like the item", item.Cost.Currency))
+		}
+		if input.EffectiveFrom == nil || !input.EffectiveFrom.After(time.Now()) {
+			fieldErrs.Add("effectiveFrom", "required and in the future, edit the item's cost to change it now")
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		createdBy, _ := auth.SessionUser(r, collections[2])
+		change := PriceChange{ItemID: itemID, Cost: *input.Cost,
+			EffectiveFrom: input.EffectiveFrom.UTC(), Status: PriceScheduled,
+			Source: PriceFromSchedule, CreatedBy: createdBy, CreatedAt: time.Now().UTC()}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		inserted, err := collections[1].InsertOne(ctx, change)
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not schedule price")
+			return
+		}
+		change.ID = inserted.InsertedID.(primitive.ObjectID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(change)
+	})
+}
+
+// DELETE /admin/items/{id}/prices/{changeId}, only while it's still scheduled
+func CancelPriceChange(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is priceChanges
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		changeID, changeErr := primitive.ObjectIDFromHex(mux.Vars(r)["changeId"])
+		if err != nil || changeErr != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such scheduled price")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		updateResult, err := collections[0].UpdateOne(ctx,
+			bson.D{
+				{Key: "_id", Value: changeID},
+				{Key: "itemId", Value: itemID},
+				{Key: "status", Value: PriceScheduled},
+			},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "status", Value: PriceCancelled},
+				{Key: "reason", Value: "cancelled by staff"},
+			}}})
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not cancel price")
+			return
+		}
+		if updateResult.MatchedCount == 0 {
+			auth.RespondError(w, http.StatusNotFound, "no such scheduled price")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
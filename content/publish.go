@@ -0,0 +1,461 @@
+package content
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+staff edit a draft, customers see a published version. the items and categories
+collections are the draft: every /admin write lands there and nowhere else. publishing
+copies both into a new pair of collections (menu_v<n>_items, menu_v<n>_categories) that
+are never written again, then flips the single menuState pointer to n, so customers switch
+from one whole menu to the next in one write. rolling back is pointing at an older n.
+stock is live, not part of a version: copies leave it out, and sold out items are hidden
+from the published menu by asking the items collection (soldOutIDs). popularity is live
+the same way, checkout counts it on the items collection and the version's copy only
+says how popular an item was when it was published (livePopularity).
+*/
+
+const (
+	MenuVersionScheduled = "scheduled" // snapshot taken, goes live at PublishAt
+	MenuVersionPublished = "published" // live now or has been
+	MenuVersionCancelled = "cancelled" // was scheduled, never went live
+)
+
+var errNoMenuVersion = errors.New("no such menu version")
+
+type MenuVersion struct {
+	Number      int64      `bson:"_id" json:"version"`
+	Status      string     `bson:"status" json:"status"`
+	Note        string     `bson:"note" json:"note"`
+	CreatedBy   string     `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time  `bson:"createdAt" json:"createdAt"`
+	PublishAt   *time.Time `bson:"publishAt,omitempty" json:"publishAt,omitempty"`
+	PublishedAt *time.Time `bson:"publishedAt,omitempty" json:"publishedAt,omitempty"`
+	ItemCount   int64      `bson:"itemCount" json:"itemCount"`
+}
+
+// the menu a request should read, and which version of it that is (0 for a draft)
+type LiveMenu struct {
+	Version     int64
+	PublishedAt time.Time
+	// when the version was copied from the draft, see LivePrices
+	CopiedAt   time.Time
+	Items      *mongo.Collection
+	Categories *mongo.Collection
+}
+
+// what GetMenuHandler, carts and search read from
+type MenuSource interface {
+	Menu(ctx context.Context) (LiveMenu, error)
+}
+
+// the draft itself, for staff preview
+type DraftMenu struct {
+	Items      *mongo.Collection
+	Categories *mongo.Collection
+}
+
+func (draft DraftMenu) Menu(ctx context.Context) (LiveMenu, error) {
+	return LiveMenu{Items: draft.Items, Categories: draft.Categories}, nil
+}
+
+type MenuPublisher struct {
+	Drafts          *mongo.Collection // items
+	DraftCategories *mongo.Collection // categories
+	Versions        *mongo.Collection // menuVersions, one document per version
+	State           *mongo.Collection // menuState, the pointer to the live version
+	// priceChanges, whose pending edits go live with a version. can be nil
+	Prices *mongo.Collection
+	// also build the text index on every version, for MongoSearcher
+	TextIndex bool
+}
+
+type menuState struct {
+	Current     int64     `bson:"current"`
+	LastVersion int64     `bson:"lastVersion"`
+	PublishedAt time.Time `bson:"publishedAt"`
+	// zero for state written before prices were scheduled, publishedAt stands in
+	CopiedAt time.Time `bson:"copiedAt"`
+}
+
+var menuStateID = bson.D{{Key: "_id", Value: "menu"}}
+
+func (publisher *MenuPublisher) collections(version int64) (*mongo.Collection, *mongo.Collection) {
+	db := publisher.Drafts.Database()
+	return db.Collection(fmt.Sprintf("menu_v%d_items", version)),
+		db.Collection(fmt.Sprintf("menu_v%d_categories", version))
+}
+
+func (publisher *MenuPublisher) Menu(ctx context.Context) (LiveMenu, error) {
+	var state menuState
+	err := publisher.State.FindOne(ctx, menuStateID).Decode(&state)
+	if err == mongo.ErrNoDocuments || (err == nil && state.Current == 0) {
+		return LiveMenu{}, errNoMenuVersion
+	}
+	if err != nil {
+		return LiveMenu{}, err
+	}
+	items, categories := publisher.collections(state.Current)
+	if state.CopiedAt.IsZero() {
+		state.CopiedAt = state.PublishedAt
+	}
+	return LiveMenu{Version: state.Current, PublishedAt: state.PublishedAt,
+		CopiedAt: state.CopiedAt, Items: items, Categories: categories}, nil
+}
+
+/*
+copies the draft into a new immutable version. publishAt nil publishes it straight away,
+otherwise it waits for PublishDue. the copy is taken now either way, so draft edits made
+between scheduling and publishing are not in it.
+*/
+func (publisher *MenuPublisher) Snapshot(ctx context.Context, createdBy string, note string,
+	publishAt *time.Time) (MenuVersion, error) {
+	var state menuState
+	err := publisher.State.FindOneAndUpdate(ctx, menuStateID,
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "lastVersion", Value: 1}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).
+		Decode(&state)
+	if err != nil {
+		return MenuVersion{}, err
+	}
+	version := MenuVersion{Number: state.LastVersion, Status: MenuVersionScheduled, Note: note,
+		CreatedBy: createdBy, CreatedAt: time.Now().UTC(), PublishAt: publishAt}
+	items, categories := publisher.collections(version.Number)
+
+	// $out swaps the target in whole, so a half copied version is never visible.
+	// sold out items go in as available, soldOutIDs hides them for as long as they are
+	_, err = publisher.Drafts.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{{Key: "availability", Value: bson.D{{Key: "$or",
+			Value: bson.A{"$availability", bson.D{{Key: "$eq", Value: bson.A{"$soldOut", true}}}}}}}}}},
+		{{Key: "$unset", Value: bson.A{"stock", "reserved", "lowStockThreshold", "soldOut"}}},
+		// see MigratePopularity, in case a write slipped one past it
+		{{Key: "$set", Value: bson.D{{Key: "popularity", Value: bson.D{{Key: "$ifNull",
+			Value: bson.A{"$popularity", 0}}}}}}},
+		{{Key: "$out", Value: items.Name()}},
+	})
+	if err != nil {
+		return MenuVersion{}, err
+	}
+	_, err = publisher.DraftCategories.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$out", Value: categories.Name()}},
+	})
+	if err != nil {
+		return MenuVersion{}, err
+	}
+	if err = EnsureItemIndexes(items); err != nil {
+		return MenuVersion{}, err
+	}
+	if publisher.TextIndex {
+		if err = EnsureTextIndex(items); err != nil {
+			return MenuVersion{}, err
+		}
+	}
+	if version.ItemCount, err = items.CountDocuments(ctx, bson.D{}); err != nil {
+		return MenuVersion{}, err
+	}
+	if _, err = publisher.Versions.InsertOne(ctx, version); err != nil {
+		return MenuVersion{}, err
+	}
+	if publishAt == nil {
+		return publisher.Activate(ctx, version.Number)
+	}
+	return version, nil
+}
+
+// makes version the live menu: publishing, rolling back and rolling forward are all this.
+// scheduled versions older than it are cancelled
+func (publisher *MenuPublisher) Activate(ctx context.Context, number int64) (MenuVersion, error) {
+	now := time.Now().UTC()
+	var version MenuVersion
+	err := publisher.Versions.FindOneAndUpdate(ctx,
+		bson.D{
+			{Key: "_id", Value: number},
+			{Key: "status", Value: bson.D{{Key: "$ne", Value: MenuVersionCancelled}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: MenuVersionPublished},
+			{Key: "publishedAt", Value: now},
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&version)
+	if err == mongo.ErrNoDocuments {
+		return version, errNoMenuVersion
+	}
+	if err != nil {
+		return version, err
+	}
+	_, err = publisher.State.UpdateOne(ctx, menuStateID, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "current", Value: number},
+		{Key: "publishedAt", Value: now},
+		{Key: "copiedAt", Value: version.CreatedAt},
+	}}})
+	if err != nil {
+		return version, err
+	}
+	if err = ApplyPendingPrices(ctx, publisher.Prices, version.CreatedAt, now); err != nil {
+		// the version is live, only its price history is behind
+		fmt.Printf("could not apply pending prices of version %d: %v\n", number, err)
+	}
+	// a version copied before this one and still waiting would undo it when it fell due.
+	// rolling back doesn't cancel anything, what's scheduled is newer than the old version
+	_, err = publisher.Versions.UpdateMany(ctx,
+		bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$lt", Value: number}}},
+			{Key: "status", Value: MenuVersionScheduled},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: MenuVersionCancelled}}}})
+	return version, err
+}
+
+// publishes scheduled versions whose time has come, oldest first, so the newest wins
+func (publisher *MenuPublisher) PublishDue(ctx context.Context) error {
+	resultCursor, err := publisher.Versions.Find(ctx,
+		bson.D{
+			{Key: "status", Value: MenuVersionScheduled},
+			{Key: "publishAt", Value: bson.D{{Key: "$lte", Value: time.Now()}}},
+		},
+		options.Find().SetSort(bson.D{{Key: "publishAt", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var due []MenuVersion
+	if err = resultCursor.All(ctx, &due); err != nil {
+		return err
+	}
+	for _, version := range due {
+		_, err = publisher.Activate(ctx, version.Number)
+		if err == errNoMenuVersion {
+			continue // cancelled by a newer version going live earlier in this loop
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("published scheduled menu version %d\n", version.Number)
+	}
+	return nil
+}
+
+func (publisher *MenuPublisher) PublishDueEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := publisher.PublishDue(ctx); err != nil {
+			fmt.Printf("scheduled menu publishing failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// first start (or first start since versioning): publish the draft as it is so customers
+// keep seeing a menu
+func (publisher *MenuPublisher) EnsurePublished(ctx context.Context) error {
+	if _, err := publisher.Menu(ctx); err != errNoMenuVersion {
+		return err
+	}
+	_, err := publisher.Snapshot(ctx, "", "initial version", nil)
+	return err
+}
+
+// versions don't carry stock, so which items it has taken off the menu is asked of the
+// live items collection
+func soldOutIDs(ctx context.Context, iCollection *mongo.Collection) ([]primitive.ObjectID, error) {
+	values, err := iCollection.Distinct(ctx, "_id", bson.D{{Key: "soldOut", Value: true}})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(values))
+	for _, value := range values {
+		if id, isID := value.(primitive.ObjectID); isID {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// how often items have been ordered so far, from the live items collection. ids nil
+// means every item; items never ordered are left out, they are 0
+func livePopularity(ctx context.Context, iCollection *mongo.Collection,
+	ids []primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	filter := bson.D{{Key: "popularity", Value: bson.D{{Key: "$gt", Value: 0}}}}
+	if ids != nil {
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}})
+	}
+	resultCursor, err := iCollection.Find(ctx, filter,
+		options.Find().SetProjection(bson.D{{Key: "popularity", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var counts []struct {
+		ID         primitive.ObjectID `bson:"_id"`
+		Popularity int64              `bson:"popularity"`
+	}
+	if err = resultCursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	popularity := make(map[primitive.ObjectID]int64, len(counts))
+	for _, count := range counts {
+		popularity[count.ID] = count.Popularity
+	}
+	return popularity, nil
+}
+
+// stands in for every item's popularity in the ETag, like ratingsDigest
+func popularityDigest(popularity map[primitive.ObjectID]int64) string {
+	lines := make([]string, 0, len(popularity))
+	for itemID, count := range popularity {
+		lines = append(lines, fmt.Sprintf("%s %d", itemID.Hex(), count))
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// filter plus leaving out sold out items
+func withoutSoldOut(filter bson.D, soldOut []primitive.ObjectID) bson.D {
+	if len(soldOut) == 0 {
+		return filter
+	}
+	return append(filter[:len(filter):len(filter)],
+		bson.E{Key: "_id", Value: bson.D{{Key: "$nin", Value: soldOut}}})
+}
+
+func versionFromPath(r *http.Request) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)["version"], 10, 64)
+}
+
+// GET /admin/menu/versions, newest first, with which one is live
+func ListMenuVersions(publisher *MenuPublisher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		resultCursor, err := publisher.Versions.Find(ctx, bson.D{},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(100))
+		versions := make([]MenuVersion, 0)
+		if err == nil {
+			err = resultCursor.All(ctx, &versions)
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not list menu versions")
+			return
+		}
+		live, _ := publisher.Menu(ctx)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"current": live.Version, "versions": versions,
+		})
+	})
+}
+
+type PublishInput struct {
+	Note      string     `json:"note"`
+	PublishAt *time.Time `json:"publishAt"` // RFC 3339, leave out to publish now
+}
+
+// POST /admin/menu/publish, 201 with the new version, live or scheduled
+func PublishMenu(publisher *MenuPublisher, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is sessions
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var input PublishInput
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err == nil && len(bodyBytes) > 0 {
+			err = json.Unmarshal(bodyBytes, &input)
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusBadRequest, "body must be {\"note\", \"publishAt\"}")
+			return
+		}
+		if input.PublishAt != nil && !input.PublishAt.After(time.Now()) {
+			fieldErrs := make(auth.FieldErrors)
+			fieldErrs.Add("publishAt", "must be in the future, leave out to publish now")
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		user, _ := auth.SessionUser(r, collections[0])
+		ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+		defer cancel()
+		version, err := publisher.Snapshot(ctx, user, input.Note, input.PublishAt)
+		if err != nil {
+			fmt.Printf("menu publish failed: %v\n", err)
+			auth.RespondError(w, http.StatusInternalServerError, "could not publish menu")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(version)
+	})
+}
+
+// POST /admin/menu/versions/{version}/publish, rollback (or forward) to that version now
+func ActivateMenuVersion(publisher *MenuPublisher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		number, err := versionFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such menu version")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		version, err := publisher.Activate(ctx, number)
+		if err == errNoMenuVersion {
+			auth.RespondError(w, http.StatusNotFound, "no such menu version, or it was cancelled")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not publish menu version")
+			return
+		}
+		json.NewEncoder(w).Encode(version)
+	})
+}
+
+// DELETE /admin/menu/versions/{version}, cancels a scheduled version before it goes live
+func CancelMenuVersion(publisher *MenuPublisher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		number, err := versionFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such menu version")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		var version MenuVersion
+		err = publisher.Versions.FindOneAndUpdate(ctx,
+			bson.D{{Key: "_id", Value: number}, {Key: "status", Value: MenuVersionScheduled}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: MenuVersionCancelled}}}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&version)
+		if err == mongo.ErrNoDocuments {
+			auth.RespondError(w, http.StatusConflict, "only a scheduled version can be cancelled")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not cancel menu version")
+			return
+		}
+		json.NewEncoder(w).Encode(version)
+	})
+}
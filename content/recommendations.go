@@ -0,0 +1,345 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+"frequently bought together". every cart and order is a basket; two items in the same
+basket count once towards each other. BuildRecommendations keeps the top
+RECOMMENDATIONS_TOP_N (default 10) per item in the recommendations collection, one
+document per item, rebuilt from scratch on each run. orders empty the cart they came
+from, so a basket isn't counted twice.
+what's recommended is filtered at request time against the menu customers see now:
+unavailable, sold out, closed or unpublished items are skipped, not stored out.
+*/
+
+const (
+	defaultRecommendations = 5
+	maxRecommendations     = 20
+	// a basket of more distinct items than this (a catering order) says little about
+	// what goes together and costs n² pairs, so it's left out
+	maxBasketItems = 30
+)
+
+type Recommendation struct {
+	ItemID primitive.ObjectID `bson:"itemId" json:"itemId"`
+	// baskets with both items
+	Count int64 `bson:"count" json:"count"`
+	// Count over the baskets holding the item this recommends for
+	Confidence float64 `bson:"confidence" json:"confidence"`
+}
+
+type ItemRecommendations struct {
+	ItemID  primitive.ObjectID `bson:"_id" json:"itemId"`
+	Baskets int64              `bson:"baskets" json:"baskets"`
+	Related []Recommendation   `bson:"related" json:"related"`
+	BuiltAt time.Time          `bson:"builtAt" json:"builtAt"`
+}
+
+type RecommendationResponse struct {
+	Items []Item `json:"items"`
+}
+
+// RECOMMENDATIONS_TOP_N in ./.env
+func RecommendationsTopN() int {
+	if topN, err := strconv.Atoi(os.Getenv("RECOMMENDATIONS_TOP_N")); err == nil && topN > 0 {
+		return topN
+	}
+	return 10
+}
+
+// distinct items of every basket in a carts or orders collection; old carts hold items
+func collectBaskets(ctx context.Context, collection *mongo.Collection,
+	baskets [][]primitive.ObjectID) ([][]primitive.ObjectID, error) {
+	resultCursor, err := collection.Find(ctx, bson.D{}, options.Find().SetProjection(
+		bson.D{{Key: "lines.itemId", Value: 1}, {Key: "items._id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer resultCursor.Close(ctx)
+	for resultCursor.Next(ctx) {
+		var basket struct {
+			Lines []struct {
+				ItemID primitive.ObjectID `bson:"itemId"`
+			} `bson:"lines"`
+			Items []struct {
+				ID primitive.ObjectID `bson:"_id"`
+			} `bson:"items"`
+		}
+		if err = resultCursor.Decode(&basket); err != nil {
+			return nil, err
+		}
+		seen := make(map[primitive.ObjectID]bool)
+		itemIDs := make([]primitive.ObjectID, 0, len(basket.Lines)+len(basket.Items))
+		add := func(itemID primitive.ObjectID) {
+			if !itemID.IsZero() && !seen[itemID] {
+				seen[itemID] = true
+				itemIDs = append(itemIDs, itemID)
+			}
+		}
+		for _, line := range basket.Lines {
+			add(line.ItemID)
+		}
+		for _, item := range basket.Items {
+			add(item.ID)
+		}
+		if len(itemIDs) > 1 && len(itemIDs) <= maxBasketItems {
+			baskets = append(baskets, itemIDs)
+		}
+	}
+	return baskets, resultCursor.Err()
+}
+
+// item -> its topN items by how often they share a basket, most first
+func coOccurrences(baskets [][]primitive.ObjectID, topN int,
+	builtAt time.Time) []ItemRecommendations {
+	basketCounts := make(map[primitive.ObjectID]int64)
+	pairCounts := make(map[primitive.ObjectID]map[primitive.ObjectID]int64)
+	for _, basket := range baskets {
+		for _, itemID := range basket {
+			basketCounts[itemID]++
+			if pairCounts[itemID] == nil {
+				pairCounts[itemID] = make(map[primitive.ObjectID]int64)
+			}
+			for _, otherID := range basket {
+				if otherID != itemID {
+					pairCounts[itemID][otherID]++
+				}
+			}
+		}
+	}
+	models := make([]ItemRecommendations, 0, len(pairCounts))
+	for itemID, counts := range pairCounts {
+		related := make([]Recommendation, 0, len(counts))
+		for otherID, count := range counts {
+			related = append(related, Recommendation{ItemID: otherID, Count: count,
+				Confidence: float64(count) / float64(basketCounts[itemID])})
+		}
+		// ties broken by id so rebuilds over the same baskets agree
+		sort.Slice(related, func(i, j int) bool {
+			if related[i].Count != related[j].Count {
+				return related[i].Count > related[j].Count
+			}
+			return related[i].ItemID.Hex() < related[j].ItemID.Hex()
+		})
+		if len(related) > topN {
+			related = related[:topN]
+		}
+		models = append(models, ItemRecommendations{ItemID: itemID,
+			Baskets: basketCounts[itemID], Related: related, BuiltAt: builtAt})
+	}
+	return models
+}
+
+// rebuilds the recommendations collection from every cart and order, returns how many
+// items got recommendations
+func BuildRecommendations(ctx context.Context, topN int,
+	recCollection *mongo.Collection, basketCollections ...*mongo.Collection) (int, error) {
+	builtAt := time.Now().UTC()
+	var baskets [][]primitive.ObjectID
+	var err error
+	for _, collection := range basketCollections {
+		if baskets, err = collectBaskets(ctx, collection, baskets); err != nil {
+			return 0, err
+		}
+	}
+	models := coOccurrences(baskets, topN, builtAt)
+	if len(models) > 0 {
+		writes := make([]mongo.WriteModel, 0, len(models))
+		for _, model := range models {
+			writes = append(writes, mongo.NewReplaceOneModel().
+				SetFilter(bson.D{{Key: "_id", Value: model.ItemID}}).
+				SetReplacement(model).SetUpsert(true))
+		}
+		_, err = recCollection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return 0, err
+		}
+	}
+	// items no basket holds any more
+	_, err = recCollection.DeleteMany(ctx,
+		bson.D{{Key: "builtAt", Value: bson.D{{Key: "$lt", Value: builtAt}}}})
+	return len(models), err
+}
+
+func BuildRecommendationsEvery(ctx context.Context, interval time.Duration,
+	recCollection *mongo.Collection, basketCollections ...*mongo.Collection) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		buildCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		_, err := BuildRecommendations(buildCtx, RecommendationsTopN(), recCollection,
+			basketCollections...)
+		cancel()
+		if err != nil {
+			fmt.Printf("building recommendations failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func parseRecommendationLimit(r *http.Request, fieldErrs auth.FieldErrors) int {
+	text := r.URL.Query().Get("limit")
+	if len(text) == 0 {
+		return defaultRecommendations
+	}
+	limit, err := strconv.Atoi(text)
+	if err != nil || limit < 1 || limit > maxRecommendations {
+		fieldErrs.Add("limit", fmt.Sprintf("must be a whole number from 1 to %d", maxRecommendations))
+	}
+	return limit
+}
+
+// what a customer can order right now, the same items GET /content/menu lists unfiltered
+func orderableNow(snapshot *MenuSnapshot, now time.Time) MenuFilter {
+	available := true
+	return MenuFilter{Availability: &available, OpenAt: &now,
+		ClosedCategoryIDs: snapshot.Tree.ClosedAt(now.In(StoreLocation()))}
+}
+
+// the first limit of ids that can be ordered, rated and in the caller's language
+func respondRecommended(w http.ResponseWriter, r *http.Request, cache MenuCache,
+	ids []primitive.ObjectID, limit int, chain []string) {
+	snapshot, err := cache.Current(r.Context())
+	if err != nil {
+		fmt.Printf("no menu to serve: %v\n", err)
+		auth.RespondError(w, http.StatusInternalServerError, "could not load menu")
+		return
+	}
+	orderable := orderableNow(snapshot, time.Now())
+	items, err := snapshot.Lookup(ids, orderable)
+	if err != nil {
+		auth.RespondError(w, http.StatusInternalServerError, "could not load recommendations")
+		return
+	}
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	for idx := range items {
+		items[idx] = localizeItem(snapshot.Rated(items[idx]), chain)
+	}
+	if err = snapshot.describeChoices(items, chain, orderable); err != nil {
+		auth.RespondError(w, http.StatusInternalServerError, "could not load recommendations")
+		return
+	}
+	w.Header().Set("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", contentLanguage(chain))
+	json.NewEncoder(w).Encode(RecommendationResponse{Items: items})
+}
+
+// GET /content/menu/{id}/recommendations?limit=5, items often bought with this one
+func ItemRecommendationsHandler(cache MenuCache, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is recommendations
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		limit := parseRecommendationLimit(r, fieldErrs)
+		chain := RequestLanguages(r, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		var model ItemRecommendations
+		err = collections[0].FindOne(ctx, bson.D{{Key: "_id", Value: itemID}}).Decode(&model)
+		if err != nil && err != mongo.ErrNoDocuments {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load recommendations")
+			return
+		}
+		ids := make([]primitive.ObjectID, 0, len(model.Related))
+		for _, related := range model.Related {
+			ids = append(ids, related.ItemID)
+		}
+		respondRecommended(w, r, cache, ids, limit, chain)
+	})
+}
+
+/*
+GET /content/cart/recommendations?limit=5, items often bought with what's in the
+session's cart and not in it already. each cart item's recommendations add up, so an
+item that goes with several things in the cart comes first
+*/
+func CartRecommendationsHandler(cache MenuCache, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is recommendations collections[1] is carts
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fieldErrs := make(auth.FieldErrors)
+		limit := parseRecommendationLimit(r, fieldErrs)
+		chain := RequestLanguages(r, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		cart, err := loadCart(auth.SessionIDFromCookies(r), collections[1])
+		if err != nil && err != mongo.ErrNoDocuments {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load cart")
+			return
+		}
+		inCart := make(map[primitive.ObjectID]bool)
+		cartIDs := make([]primitive.ObjectID, 0, len(cart.Lines))
+		for _, line := range cart.Lines {
+			if !inCart[line.ItemID] {
+				inCart[line.ItemID] = true
+				cartIDs = append(cartIDs, line.ItemID)
+			}
+		}
+		scores := make(map[primitive.ObjectID]int64)
+		if len(cartIDs) > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+			defer cancel()
+			var models []ItemRecommendations
+			resultCursor, err := collections[0].Find(ctx,
+				bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: cartIDs}}}})
+			if err == nil {
+				err = resultCursor.All(ctx, &models)
+			}
+			if err != nil {
+				auth.RespondError(w, http.StatusInternalServerError, "could not load recommendations")
+				return
+			}
+			for _, model := range models {
+				for _, related := range model.Related {
+					if !inCart[related.ItemID] {
+						scores[related.ItemID] += related.Count
+					}
+				}
+			}
+		}
+		ids := make([]primitive.ObjectID, 0, len(scores))
+		for itemID := range scores {
+			ids = append(ids, itemID)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if scores[ids[i]] != scores[ids[j]] {
+				return scores[ids[i]] > scores[ids[j]]
+			}
+			return ids[i].Hex() < ids[j].Hex()
+		})
+		respondRecommended(w, r, cache, ids, limit, chain)
+	})
+}
@@ -0,0 +1,509 @@
+package content
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+ratings and reviews. only customers with an order containing the item can review it, one
+review per customer per item. reviews are moderated before they show: new and edited
+reviews are pending until staff approve or hide them from /admin/reviews. only approved
+reviews are listed and counted in an item's rating, which the menu cache works out from
+this collection (see MenuSnapshot.Ratings) rather than it being stored on items.
+*/
+
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewHidden   = "hidden"
+)
+
+const (
+	maxReviewTitle    = 120
+	maxReviewBody     = 2000
+	defaultReviewPage = 20
+	maxReviewPage     = 100
+)
+
+type Review struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ItemID primitive.ObjectID `bson:"itemId" json:"itemId"`
+	// left out of what customers see of other people's reviews
+	User      string    `bson:"user" json:"user,omitempty"`
+	Rating    int       `bson:"rating" json:"rating"`
+	Title     string    `bson:"title" json:"title"`
+	Body      string    `bson:"body" json:"body"`
+	Status    string    `bson:"status" json:"status"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	// who approved or hid it last, and why when hidden
+	ModeratedBy  string     `bson:"moderatedBy,omitempty" json:"moderatedBy,omitempty"`
+	ModeratedAt  *time.Time `bson:"moderatedAt,omitempty" json:"moderatedAt,omitempty"`
+	HiddenReason string     `bson:"hiddenReason,omitempty" json:"hiddenReason,omitempty"`
+}
+
+type ReviewInput struct {
+	Rating int    `json:"rating"`
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+}
+
+// approved reviews of an item, average rounded to 2 places
+type RatingSummary struct {
+	Average float64 `json:"average"`
+	Count   int64   `json:"count"`
+}
+
+type ReviewPage struct {
+	Rating  RatingSummary `json:"rating"`
+	Reviews []Review      `json:"reviews"`
+	// the caller's own review of the item whatever its status, so they can edit it
+	Mine       *Review `json:"mine,omitempty"`
+	NextCursor *string `json:"nextCursor,omitempty"`
+}
+
+func EnsureReviewIndexes(rCollection *mongo.Collection) error {
+	_, err := rCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "itemId", Value: 1}, {Key: "user", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// an item's approved reviews newest first
+		{Keys: bson.D{{Key: "itemId", Value: 1}, {Key: "status", Value: 1}, {Key: "_id", Value: -1}}},
+		// the moderation queue oldest first
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	return err
+}
+
+func (input ReviewInput) validate(fieldErrs auth.FieldErrors) ReviewInput {
+	input.Title = strings.TrimSpace(input.Title)
+	input.Body = strings.TrimSpace(input.Body)
+	if input.Rating < 1 || input.Rating > 5 {
+		fieldErrs.Add("rating", "must be a whole number from 1 to 5")
+	}
+	if len([]rune(input.Title)) > maxReviewTitle {
+		fieldErrs.Add("title", fmt.Sprintf("at most %d characters", maxReviewTitle))
+	}
+	if len([]rune(input.Body)) > maxReviewBody {
+		fieldErrs.Add("body", fmt.Sprintf("at most %d characters", maxReviewBody))
+	}
+	return input
+}
+
+func readReviewInput(r *http.Request, fieldErrs auth.FieldErrors) (ReviewInput, bool) {
+	var input ReviewInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return input, false
+	}
+	return input.validate(fieldErrs), true
+}
+
+// item id -> rating, from approved reviews
+func LoadRatings(ctx context.Context,
+	rCollection *mongo.Collection) (map[primitive.ObjectID]RatingSummary, error) {
+	return aggregateRatings(ctx, bson.D{{Key: "status", Value: ReviewApproved}}, rCollection)
+}
+
+func aggregateRatings(ctx context.Context, match bson.D,
+	rCollection *mongo.Collection) (map[primitive.ObjectID]RatingSummary, error) {
+	resultCursor, err := rCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$itemId"},
+			{Key: "average", Value: bson.D{{Key: "$avg", Value: "$rating"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ItemID  primitive.ObjectID `bson:"_id"`
+		Average float64            `bson:"average"`
+		Count   int64              `bson:"count"`
+	}
+	if err = resultCursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	ratings := make(map[primitive.ObjectID]RatingSummary, len(groups))
+	for _, group := range groups {
+		ratings[group.ItemID] = RatingSummary{
+			Average: math.Round(group.Average*100) / 100, Count: group.Count}
+	}
+	return ratings, nil
+}
+
+// stands in for every rating in the ETag, see menuFingerprint
+func ratingsDigest(ratings map[primitive.ObjectID]RatingSummary) string {
+	lines := make([]string, 0, len(ratings))
+	for itemID, rating := range ratings {
+		lines = append(lines, fmt.Sprintf("%s %v %d", itemID.Hex(), rating.Average, rating.Count))
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+func reviewIDFromPath(r *http.Request) (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(mux.Vars(r)["reviewId"])
+}
+
+// limit and cursor (the last review id of the previous page) from the query string
+func parseReviewPage(r *http.Request, fieldErrs auth.FieldErrors) (int64, *primitive.ObjectID) {
+	query := r.URL.Query()
+	limit := defaultReviewPage
+	if text := query.Get("limit"); len(text) > 0 {
+		var err error
+		limit, err = strconv.Atoi(text)
+		if err != nil || limit < 1 || limit > maxReviewPage {
+			fieldErrs.Add("limit", fmt.Sprintf("must be a whole number from 1 to %d", maxReviewPage))
+		}
+	}
+	var after *primitive.ObjectID
+	if text := query.Get("cursor"); len(text) > 0 {
+		cursorID, err := primitive.ObjectIDFromHex(text)
+		if err != nil {
+			fieldErrs.Add("cursor", "not a cursor from a previous page")
+		}
+		after = &cursorID
+	}
+	return int64(limit), after
+}
+
+// one page of reviews matching filter, in _id order (1 or -1); asks for one extra to know
+// whether there's a next page
+func findReviews(ctx context.Context, filter bson.D, order int, limit int64,
+	after *primitive.ObjectID, rCollection *mongo.Collection) ([]Review, *string, error) {
+	if after != nil {
+		direction := "$lt"
+		if order > 0 {
+			direction = "$gt"
+		}
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: direction, Value: *after}}})
+	}
+	resultCursor, err := rCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: order}}).SetLimit(limit+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	reviews := make([]Review, 0)
+	if err = resultCursor.All(ctx, &reviews); err != nil {
+		return nil, nil, err
+	}
+	if int64(len(reviews)) <= limit {
+		return reviews, nil, nil
+	}
+	reviews = reviews[:limit]
+	nextCursor := reviews[limit-1].ID.Hex()
+	return reviews, &nextCursor, nil
+}
+
+// GET /content/menu/{id}/reviews?limit=&cursor=, approved reviews newest first
+func ListItemReviews(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is reviews collections[1] is sessions
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		limit, after := parseReviewPage(r, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		approved := bson.D{{Key: "itemId", Value: itemID}, {Key: "status", Value: ReviewApproved}}
+		reviews, nextCursor, err := findReviews(ctx, approved, -1, limit, after, collections[0])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load reviews")
+			return
+		}
+		for idx := range reviews {
+			reviews[idx].User = ""
+		}
+		response := ReviewPage{Reviews: reviews, NextCursor: nextCursor}
+		// fresher than the menu's copy, which lags the cache by a moment
+		ratings, err := aggregateRatings(ctx, approved, collections[0])
+		response.Rating = ratings[itemID]
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load reviews")
+			return
+		}
+		if user, _ := auth.SessionUser(r, collections[1]); len(user) > 0 {
+			var mine Review
+			err = collections[0].FindOne(ctx, bson.D{{Key: "itemId", Value: itemID},
+				{Key: "user", Value: user}}).Decode(&mine)
+			if err == nil {
+				response.Mine = &mine
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// POST /content/menu/{id}/reviews, for customers who have ordered the item
+func CreateReview(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is reviews collections[1] is items collections[2] is orders
+	// collections[3] is sessions
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		itemID, err := itemIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		user, err := auth.SessionUser(r, collections[3])
+		if err != nil || len(user) == 0 {
+			auth.RespondError(w, http.StatusForbidden, "log in to review items")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		input, ok := readReviewInput(r, fieldErrs)
+		if !ok {
+			auth.RespondError(w, http.StatusBadRequest, "body must be {\"rating\", \"title\", \"body\"}")
+			return
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		item, err := FindItemByID(itemID, collections[1])
+		if err == mongo.ErrNoDocuments || (err == nil && item.Deleted) {
+			auth.RespondError(w, http.StatusNotFound, "no such item")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not save review")
+			return
+		}
+		// a bundle's components count as ordered too
+		ordered, err := collections[2].CountDocuments(ctx, bson.D{{Key: "user", Value: user},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "lines.itemId", Value: itemID}},
+				bson.D{{Key: "lines.components.itemId", Value: itemID}},
+			}}}, options.Count().SetLimit(1))
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not save review")
+			return
+		}
+		if ordered == 0 {
+			auth.RespondError(w, http.StatusForbidden, "only customers who have ordered this item can review it")
+			return
+		}
+		now := time.Now().UTC()
+		review := Review{ItemID: itemID, User: user, Rating: input.Rating, Title: input.Title,
+			Body: input.Body, Status: ReviewPending, CreatedAt: now, UpdatedAt: now}
+		insertResult, err := collections[0].InsertOne(ctx, review)
+		if mongo.IsDuplicateKeyError(err) {
+			auth.RespondError(w, http.StatusConflict, "you have already reviewed this item, edit that review instead")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not save review")
+			return
+		}
+		review.ID = insertResult.InsertedID.(primitive.ObjectID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(review)
+	})
+}
+
+// PUT /content/reviews/{reviewId}, own reviews only; goes back to pending for staff to see
+func UpdateReview(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is reviews collections[1] is sessions
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		reviewID, err := reviewIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such review")
+			return
+		}
+		user, err := auth.SessionUser(r, collections[1])
+		if err != nil || len(user) == 0 {
+			auth.RespondError(w, http.StatusForbidden, "log in to edit reviews")
+			return
+		}
+		fieldErrs := make(auth.FieldErrors)
+		input, ok := readReviewInput(r, fieldErrs)
+		if !ok {
+			auth.RespondError(w, http.StatusBadRequest, "body must be {\"rating\", \"title\", \"body\"}")
+			return
+		}
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		var updated Review
+		// someone else's review is a 404 too, no telling whether it exists
+		err = collections[0].FindOneAndUpdate(ctx,
+			bson.D{{Key: "_id", Value: reviewID}, {Key: "user", Value: user}},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "rating", Value: input.Rating},
+					{Key: "title", Value: input.Title},
+					{Key: "body", Value: input.Body},
+					{Key: "status", Value: ReviewPending},
+					{Key: "updatedAt", Value: time.Now().UTC()},
+				}},
+				{Key: "$unset", Value: bson.D{{Key: "hiddenReason", Value: ""}}},
+			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+		if err == mongo.ErrNoDocuments {
+			auth.RespondError(w, http.StatusNotFound, "no such review")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not save review")
+			return
+		}
+		json.NewEncoder(w).Encode(updated)
+	})
+}
+
+// DELETE /content/reviews/{reviewId}, own reviews only
+func DeleteReview(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is reviews collections[1] is sessions
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		reviewID, err := reviewIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such review")
+			return
+		}
+		user, err := auth.SessionUser(r, collections[1])
+		if err != nil || len(user) == 0 {
+			auth.RespondError(w, http.StatusForbidden, "log in to delete reviews")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		deleteResult, err := collections[0].DeleteOne(ctx,
+			bson.D{{Key: "_id", Value: reviewID}, {Key: "user", Value: user}})
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not delete review")
+			return
+		}
+		if deleteResult.DeletedCount == 0 {
+			auth.RespondError(w, http.StatusNotFound, "no such review")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// GET /admin/reviews?status=pending&limit=&cursor=, the moderation queue oldest first.
+// status defaults to pending
+func ReviewQueue(collections ...*mongo.Collection) http.Handler {
+	// collections[0] is reviews
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fieldErrs := make(auth.FieldErrors)
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "":
+			status = ReviewPending
+		case ReviewPending, ReviewApproved, ReviewHidden:
+		default:
+			fieldErrs.Add("status", "must be pending, approved or hidden")
+		}
+		limit, after := parseReviewPage(r, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		reviews, nextCursor, err := findReviews(ctx, bson.D{{Key: "status", Value: status}},
+			1, limit, after, collections[0])
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not load reviews")
+			return
+		}
+		json.NewEncoder(w).Encode(ReviewPage{Reviews: reviews, NextCursor: nextCursor})
+	})
+}
+
+/*
+POST /admin/reviews/{reviewId}/approve and /hide, status is ReviewApproved or ReviewHidden.
+hide takes an optional {"reason"} kept for staff; customers only see the review go away
+*/
+func ModerateReview(status string, collections ...*mongo.Collection) http.Handler {
+	// collections[0] is reviews collections[1] is sessions
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		reviewID, err := reviewIDFromPath(r)
+		if err != nil {
+			auth.RespondError(w, http.StatusNotFound, "no such review")
+			return
+		}
+		var input struct {
+			Reason string `json:"reason"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&input); err != nil && err != io.EOF {
+			auth.RespondError(w, http.StatusBadRequest, "body must be empty or {\"reason\"}")
+			return
+		}
+		input.Reason = strings.TrimSpace(input.Reason)
+		if len([]rune(input.Reason)) > maxReviewTitle {
+			fieldErrs := make(auth.FieldErrors)
+			fieldErrs.Add("reason", fmt.Sprintf("at most %d characters", maxReviewTitle))
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		moderator, _ := auth.SessionUser(r, collections[1])
+		set := bson.D{
+			{Key: "status", Value: status},
+			{Key: "moderatedBy", Value: moderator},
+			{Key: "moderatedAt", Value: time.Now().UTC()},
+		}
+		update := bson.D{{Key: "$set", Value: set}}
+		if status == ReviewHidden && len(input.Reason) > 0 {
+			update[0].Value = append(set, bson.E{Key: "hiddenReason", Value: input.Reason})
+		} else {
+			update = append(update, bson.E{Key: "$unset",
+				Value: bson.D{{Key: "hiddenReason", Value: ""}}})
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		var updated Review
+		err = collections[0].FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: reviewID}}, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+		if err == mongo.ErrNoDocuments {
+			auth.RespondError(w, http.StatusNotFound, "no such review")
+			return
+		}
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "could not moderate review")
+			return
+		}
+		json.NewEncoder(w).Encode(updated)
+	})
+}
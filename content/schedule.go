@@ -0,0 +1,258 @@
+package content
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // STORE_TIMEZONE works on hosts without a zoneinfo database
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+when items and categories can be ordered, on top of the availability switch. a schedule
+is days of the week, a time window and a date range, all optional, read in the store's
+timezone (STORE_TIMEZONE in ./.env, default UTC). something with several schedules is
+open when any one of them is; with none it is always open.
+
+	{"days": ["mon","tue","wed","thu","fri"], "from": "07:00", "until": "11:00"}
+	{"days": ["sat","sun"], "startDate": "2026-06-01", "endDate": "2026-08-31"}
+	{"from": "22:00", "until": "02:00"} runs past midnight; the early hours belong to the
+	day (and date) the window started on
+
+an item is open when its own schedules are and at least one of its categories is open,
+a category being open when it and every category above it are.
+*/
+type Schedule struct {
+	DayNames  []string `bson:"dayNames" json:"days"`
+	From      string   `bson:"from" json:"from"`
+	Until     string   `bson:"until" json:"until"`
+	StartDate string   `bson:"startDate" json:"startDate"`
+	EndDate   string   `bson:"endDate" json:"endDate"`
+	// worked out from the above by normalizeSchedules so mongo can match on them
+	Days        []int `bson:"days" json:"-"`
+	StartMinute int   `bson:"startMinute" json:"-"`
+	EndMinute   int   `bson:"endMinute" json:"-"`
+	Wraps       bool  `bson:"wraps" json:"-"`
+}
+
+const dateLayout = "2006-01-02"
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func StoreLocation() *time.Location {
+	if location, err := time.LoadLocation(os.Getenv("STORE_TIMEZONE")); err == nil {
+		return location
+	}
+	return time.UTC
+}
+
+func parseClock(clock string) (int, bool) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, false
+	}
+	return parsed.Hour()*60 + parsed.Minute(), true
+}
+
+// checks schedules from a request and fills in the fields mongo matches on
+func normalizeSchedules(schedules []Schedule, field string, fieldErrs auth.FieldErrors) []Schedule {
+	normalized := make([]Schedule, 0, len(schedules))
+	for idx, schedule := range schedules {
+		scheduleField := fmt.Sprintf("%s[%d]", field, idx)
+		schedule.Days = []int{}
+		for _, dayName := range schedule.DayNames {
+			name := strings.ToLower(strings.TrimSpace(dayName))
+			if len(name) > 3 {
+				name = name[:3] // "monday" as well as "mon"
+			}
+			day, known := weekdayNames[name]
+			if !known {
+				fieldErrs.Add(scheduleField+".days", fmt.Sprintf("%q is not a day of the week", dayName))
+				continue
+			}
+			schedule.Days = append(schedule.Days, int(day))
+		}
+
+		schedule.StartMinute, schedule.EndMinute = 0, 24*60
+		if len(schedule.From) > 0 || len(schedule.Until) > 0 {
+			start, startOK := parseClock(schedule.From)
+			end, endOK := parseClock(schedule.Until)
+			switch {
+			case !startOK || !endOK:
+				fieldErrs.Add(scheduleField, "from and until go together, both as HH:MM")
+			case start == end:
+				fieldErrs.Add(scheduleField, "from and until must differ")
+			default:
+				schedule.StartMinute, schedule.EndMinute = start, end
+				schedule.Wraps = end < start
+			}
+		}
+
+		for _, date := range []struct{ name, value string }{
+			{"startDate", schedule.StartDate}, {"endDate", schedule.EndDate},
+		} {
+			if _, err := time.Parse(dateLayout, date.value); len(date.value) > 0 && err != nil {
+				fieldErrs.Add(scheduleField+"."+date.name, "must be YYYY-MM-DD")
+			}
+		}
+		if len(schedule.StartDate) > 0 && len(schedule.EndDate) > 0 &&
+			schedule.StartDate > schedule.EndDate {
+			fieldErrs.Add(scheduleField+".endDate", "must not be before startDate")
+		}
+		normalized = append(normalized, schedule)
+	}
+	return normalized
+}
+
+func (schedule Schedule) onDay(day time.Weekday, date string) bool {
+	if len(schedule.StartDate) > 0 && date < schedule.StartDate {
+		return false
+	}
+	if len(schedule.EndDate) > 0 && date > schedule.EndDate {
+		return false
+	}
+	if len(schedule.Days) == 0 {
+		return true
+	}
+	for _, scheduleDay := range schedule.Days {
+		if time.Weekday(scheduleDay) == day {
+			return true
+		}
+	}
+	return false
+}
+
+// at is converted to the store's timezone by the caller
+func (schedule Schedule) OpenAt(at time.Time) bool {
+	minute := at.Hour()*60 + at.Minute()
+	if schedule.onDay(at.Weekday(), at.Format(dateLayout)) &&
+		schedule.StartMinute <= minute && (minute < schedule.EndMinute || schedule.Wraps) {
+		return true
+	}
+	// early hours of a window that started yesterday
+	yesterday := at.AddDate(0, 0, -1)
+	return schedule.Wraps && minute < schedule.EndMinute &&
+		schedule.onDay(yesterday.Weekday(), yesterday.Format(dateLayout))
+}
+
+func SchedulesOpenAt(schedules []Schedule, at time.Time) bool {
+	if len(schedules) == 0 {
+		return true
+	}
+	for _, schedule := range schedules {
+		if schedule.OpenAt(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// ids of categories closed at at, because of their own schedules or a parent's
+func (tree *CategoryTree) ClosedAt(at time.Time) []primitive.ObjectID {
+	closed := make([]primitive.ObjectID, 0)
+	var walk func(nodes []*CategoryNode, parentClosed bool)
+	walk = func(nodes []*CategoryNode, parentClosed bool) {
+		for _, node := range nodes {
+			isClosed := parentClosed || !SchedulesOpenAt(node.Schedules, at)
+			if isClosed {
+				closed = append(closed, node.ID)
+			}
+			walk(node.Children, isClosed)
+		}
+	}
+	walk(tree.Roots, false)
+	return closed
+}
+
+// Go twin of scheduleBSON for one item, used when re-checking carts
+func ItemOpenAt(item Item, tree *CategoryTree, at time.Time) bool {
+	at = at.In(StoreLocation())
+	if !SchedulesOpenAt(item.Schedules, at) {
+		return false
+	}
+	closed := make(map[primitive.ObjectID]bool)
+	for _, categoryID := range tree.ClosedAt(at) {
+		closed[categoryID] = true
+	}
+	return inOpenCategory(item, closed)
+}
+
+func inOpenCategory(item Item, closed map[primitive.ObjectID]bool) bool {
+	if len(item.CategoryIDs) == 0 {
+		return true
+	}
+	for _, categoryID := range item.CategoryIDs {
+		if !closed[categoryID] {
+			return true
+		}
+	}
+	return false
+}
+
+func daysMatch(day time.Weekday) bson.D {
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "days", Value: bson.D{{Key: "$size", Value: 0}}}},
+		bson.D{{Key: "days", Value: int(day)}},
+	}}}
+}
+
+func datesMatch(date string) bson.D {
+	return bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "startDate", Value: ""}},
+			bson.D{{Key: "startDate", Value: bson.D{{Key: "$lte", Value: date}}}},
+		}}},
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "endDate", Value: ""}},
+			bson.D{{Key: "endDate", Value: bson.D{{Key: "$gte", Value: date}}}},
+		}}},
+	}}}
+}
+
+/*
+mongo filter for items open at at, same rules as ItemOpenAt so pagination still sees
+whole pages. closedCategories comes from CategoryTree.ClosedAt.
+*/
+func scheduleBSON(at time.Time, closedCategories []primitive.ObjectID) bson.D {
+	at = at.In(StoreLocation())
+	minute := at.Hour()*60 + at.Minute()
+	yesterday := at.AddDate(0, 0, -1)
+	today := bson.D{{Key: "$and", Value: bson.A{
+		daysMatch(at.Weekday()),
+		datesMatch(at.Format(dateLayout)),
+		bson.D{{Key: "startMinute", Value: bson.D{{Key: "$lte", Value: minute}}}},
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "endMinute", Value: bson.D{{Key: "$gt", Value: minute}}}},
+			bson.D{{Key: "wraps", Value: true}},
+		}}},
+	}}}
+	spilledOver := bson.D{{Key: "$and", Value: bson.A{
+		daysMatch(yesterday.Weekday()),
+		datesMatch(yesterday.Format(dateLayout)),
+		bson.D{{Key: "wraps", Value: true}},
+		bson.D{{Key: "endMinute", Value: bson.D{{Key: "$gt", Value: minute}}}},
+	}}}
+	clauses := bson.A{
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "schedules", Value: bson.D{{Key: "$in", Value: bson.A{nil, bson.A{}}}}}},
+			bson.D{{Key: "schedules", Value: bson.D{{Key: "$elemMatch",
+				Value: bson.D{{Key: "$or", Value: bson.A{today, spilledOver}}}}}}},
+		}}},
+	}
+	if len(closedCategories) > 0 {
+		clauses = append(clauses, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "categoryIds", Value: bson.D{{Key: "$in", Value: bson.A{nil, bson.A{}}}}}},
+			bson.D{{Key: "categoryIds", Value: bson.D{{Key: "$elemMatch",
+				Value: bson.D{{Key: "$nin", Value: closedCategories}}}}}},
+		}}})
+	}
+	return bson.D{{Key: "$and", Value: clauses}}
+}
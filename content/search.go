@@ -0,0 +1,385 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	auth "gorilla-mongo-api/auth"
+)
+
+/*
+free text search over item name, tags and description, plus name autocomplete.
+handlers only know the MenuSearcher interface: MongoSearcher needs the text index from
+EnsureTextIndex, MemorySearcher keeps its own index so works against any mongo (or none).
+both weigh a hit in name over tags over description and only return items customers
+could order (available and not deleted). autocomplete puts the most ordered first, by
+the live popularity count rather than the version's.
+*/
+
+const (
+	nameWeight        = 10
+	tagWeight         = 5
+	descriptionWeight = 1
+
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+)
+
+type SearchHit struct {
+	Item  `bson:",inline"`
+	Score float64 `bson:"score" json:"score"`
+}
+
+type MenuSearcher interface {
+	Search(ctx context.Context, query string, limit int) ([]SearchHit, error)
+	Autocomplete(ctx context.Context, prefix string, limit int) ([]string, error)
+}
+
+// only one text index allowed per collection, this is it
+func EnsureTextIndex(iCollection *mongo.Collection) error {
+	_, err := iCollection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "name", Value: "text"},
+			{Key: "tags", Value: "text"},
+			{Key: "description", Value: "text"},
+		},
+		Options: options.Index().SetName("item_text").SetWeights(bson.D{
+			{Key: "name", Value: nameWeight},
+			{Key: "tags", Value: tagWeight},
+			{Key: "description", Value: descriptionWeight},
+		}),
+	})
+	return err
+}
+
+// searches the published menu; Items is the live items collection, for what's sold out
+type MongoSearcher struct {
+	Menu  MenuSource
+	Items *mongo.Collection
+}
+
+func (searcher MongoSearcher) orderable(ctx context.Context) (*mongo.Collection, bson.D, error) {
+	live, err := searcher.Menu.Menu(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	soldOut, err := soldOutIDs(ctx, searcher.Items)
+	if err != nil {
+		return nil, nil, err
+	}
+	return live.Items, withoutSoldOut(orderableFilter, soldOut), nil
+}
+
+var orderableFilter = bson.D{
+	{Key: "availability", Value: true},
+	{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+}
+
+// with their live popularity
+func (searcher MongoSearcher) orderableItems(ctx context.Context) ([]Item, error) {
+	iCollection, orderable, err := searcher.orderable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := GetMenu(orderable, iCollection)
+	if err != nil {
+		return nil, err
+	}
+	popularity, err := livePopularity(ctx, searcher.Items, nil)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range items {
+		items[idx].Popularity = popularity[items[idx].ID]
+	}
+	return items, nil
+}
+
+// most ordered first, then by name
+func sortByPopularity(items []Item) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Popularity != items[j].Popularity {
+			return items[i].Popularity > items[j].Popularity
+		}
+		return items[i].Name < items[j].Name
+	})
+}
+
+func (searcher MongoSearcher) Search(ctx context.Context, query string,
+	limit int) ([]SearchHit, error) {
+	iCollection, orderable, err := searcher.orderable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := append(bson.D{{Key: "$text", Value: bson.D{{Key: "$search", Value: query}}}},
+		orderable...)
+	score := bson.D{{Key: "score", Value: bson.D{{Key: "$meta", Value: "textScore"}}}}
+	resultCursor, err := iCollection.Find(ctx, filter,
+		options.Find().SetProjection(score).SetSort(score).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]SearchHit, 0)
+	err = resultCursor.All(ctx, &hits)
+	return hits, err
+}
+
+func (searcher MongoSearcher) Autocomplete(ctx context.Context, prefix string,
+	limit int) ([]string, error) {
+	iCollection, orderable, err := searcher.orderable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// start of any word in the name, so "bur" finds "cheese burger" too
+	pattern := `(^|\s)` + regexp.QuoteMeta(prefix)
+	nameRegex := primitive.Regex{Pattern: pattern, Options: "i"}
+	filter := append(bson.D{{Key: "name", Value: nameRegex}}, orderable...)
+	// every match, the version's popularity is stale so the order and limit are done here
+	resultCursor, err := iCollection.Find(ctx, filter,
+		options.Find().SetProjection(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var items []Item
+	if err = resultCursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	popularity, err := livePopularity(ctx, searcher.Items, ids)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range items {
+		items[idx].Popularity = popularity[items[idx].ID]
+	}
+	sortByPopularity(items)
+	names := make([]string, 0, limit)
+	for idx := 0; idx < len(items) && idx < limit; idx++ {
+		names = append(names, items[idx].Name)
+	}
+	return names, nil
+}
+
+/*
+in memory index for tests and for mongo deployments without text indexes. holds a
+snapshot of orderable items; Refresh swaps in a new snapshot (RefreshEvery does that
+on a timer from the published menu).
+*/
+type MemorySearcher struct {
+	mutex sync.RWMutex
+	items []indexedItem
+}
+
+type indexedItem struct {
+	item        Item
+	name        []string
+	tags        []string
+	description []string
+}
+
+func tokenise(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(char rune) bool {
+		return !unicode.IsLetter(char) && !unicode.IsDigit(char)
+	})
+}
+
+func NewMemorySearcher(items []Item) *MemorySearcher {
+	searcher := &MemorySearcher{}
+	searcher.Refresh(items)
+	return searcher
+}
+
+func (searcher *MemorySearcher) Refresh(items []Item) {
+	indexed := make([]indexedItem, 0, len(items))
+	for _, item := range items {
+		if !item.Availability || item.Deleted {
+			continue
+		}
+		entry := indexedItem{item: item, name: tokenise(item.Name),
+			description: tokenise(item.Description)}
+		for _, tag := range item.Tags {
+			entry.tags = append(entry.tags, tokenise(tag)...)
+		}
+		indexed = append(indexed, entry)
+	}
+	searcher.mutex.Lock()
+	searcher.items = indexed
+	searcher.mutex.Unlock()
+}
+
+// reloads from the published menu until ctx is cancelled, iCollection (live items) says
+// what's sold out and how popular items are. failed reloads keep old snapshot
+func (searcher *MemorySearcher) RefreshEvery(ctx context.Context, interval time.Duration,
+	menu MenuSource, iCollection *mongo.Collection) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		items, err := MongoSearcher{Menu: menu, Items: iCollection}.orderableItems(ctx)
+		if err != nil {
+			fmt.Printf("memory search refresh failed: %v\n", err)
+		} else {
+			searcher.Refresh(items)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// whole word match counts fully, a word merely starting with the term counts half
+func termScore(term string, tokens []string, weight float64) float64 {
+	var score float64
+	for _, token := range tokens {
+		switch {
+		case token == term:
+			score += weight
+		case strings.HasPrefix(token, term):
+			score += weight / 2
+		}
+	}
+	return score
+}
+
+func (searcher *MemorySearcher) Search(ctx context.Context, query string,
+	limit int) ([]SearchHit, error) {
+	terms := tokenise(query)
+	searcher.mutex.RLock()
+	defer searcher.mutex.RUnlock()
+	hits := make([]SearchHit, 0)
+	for _, entry := range searcher.items {
+		var score float64
+		for _, term := range terms {
+			score += termScore(term, entry.name, nameWeight)
+			score += termScore(term, entry.tags, tagWeight)
+			score += termScore(term, entry.description, descriptionWeight)
+		}
+		if score > 0 {
+			hits = append(hits, SearchHit{Item: entry.item, Score: score})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Name < hits[j].Name
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+func (searcher *MemorySearcher) Autocomplete(ctx context.Context, prefix string,
+	limit int) ([]string, error) {
+	prefix = strings.ToLower(prefix)
+	searcher.mutex.RLock()
+	matches := make([]Item, 0)
+	for _, entry := range searcher.items {
+		lowerName := strings.ToLower(entry.item.Name)
+		if strings.HasPrefix(lowerName, prefix) || strings.Contains(lowerName, " "+prefix) {
+			matches = append(matches, entry.item)
+		}
+	}
+	searcher.mutex.RUnlock()
+	sortByPopularity(matches)
+	names := make([]string, 0, limit)
+	for idx := 0; idx < len(matches) && idx < limit; idx++ {
+		names = append(names, matches[idx].Name)
+	}
+	return names, nil
+}
+
+func parseSearchLimit(query map[string][]string, fieldErrs auth.FieldErrors) int {
+	values := query["limit"]
+	if len(values) == 0 || len(values[0]) == 0 {
+		return defaultSearchLimit
+	}
+	limit, err := strconv.Atoi(values[0])
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		fieldErrs.Add("limit", fmt.Sprintf("must be a whole number from 1 to %d", maxSearchLimit))
+	}
+	return limit
+}
+
+// GET /content/menu/search?q=...&limit=..., best match first. hits come from the search
+// index, cache adds what isn't in it: prices scheduled since the publish, popularity and
+// ratings
+func SearchMenuHandler(searcher MenuSearcher, cache MenuCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		query := r.URL.Query()
+		fieldErrs := make(auth.FieldErrors)
+		searchText := strings.TrimSpace(query.Get("q"))
+		if len(searchText) == 0 || len(searchText) > 200 {
+			fieldErrs.Add("q", "required, at most 200 characters")
+		}
+		limit := parseSearchLimit(query, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		hits, err := searcher.Search(ctx, searchText, limit)
+		if err != nil {
+			fmt.Printf("menu search failed: %v\n", err)
+			auth.RespondError(w, http.StatusInternalServerError, "search failed")
+			return
+		}
+		snapshot, err := cache.Current(ctx)
+		if err != nil {
+			auth.RespondError(w, http.StatusInternalServerError, "search failed")
+			return
+		}
+		for idx := range hits {
+			hits[idx].Item = snapshot.Rated(snapshot.Popular(snapshot.Priced(hits[idx].Item)))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": hits})
+	})
+}
+
+// GET /content/menu/autocomplete?prefix=..., item names for a search box dropdown
+func AutocompleteMenuHandler(searcher MenuSearcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		query := r.URL.Query()
+		fieldErrs := make(auth.FieldErrors)
+		prefix := strings.TrimSpace(query.Get("prefix"))
+		if len(prefix) == 0 || len(prefix) > 50 {
+			fieldErrs.Add("prefix", "required, at most 50 characters")
+		}
+		limit := parseSearchLimit(query, fieldErrs)
+		if len(fieldErrs) > 0 {
+			auth.RespondFieldErrors(w, fieldErrs)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		names, err := searcher.Autocomplete(ctx, prefix, limit)
+		if err != nil {
+			fmt.Printf("menu autocomplete failed: %v\n", err)
+			auth.RespondError(w, http.StatusInternalServerError, "autocomplete failed")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"suggestions": names})
+	})
+}
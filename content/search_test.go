@@ -0,0 +1,143 @@
+package content
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func searchItems() []Item {
+	return []Item{
+		{Name: "Cheese Burger", Tags: []string{"beef"}, Description: "grilled patty",
+			Availability: true, Popularity: 5},
+		{Name: "Burgers Deluxe", Description: "two patties", Availability: true, Popularity: 9},
+		{Name: "Chicken Wrap", Tags: []string{"burger"}, Availability: true, Popularity: 9},
+		{Name: "Garden Salad", Description: "goes well with a burger", Availability: true},
+		{Name: "Hamburger Platter", Availability: true, Popularity: 100},
+		{Name: "Burger Special", Availability: false, Popularity: 50},
+		{Name: "Old Burger", Availability: true, Deleted: true, Popularity: 50},
+		{Name: "Fries", Tags: []string{"side"}, Availability: true},
+	}
+}
+
+func hitNames(hits []SearchHit) []string {
+	names := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		names = append(names, hit.Name)
+	}
+	return names
+}
+
+func TestMemorySearchRanking(t *testing.T) {
+	searcher := NewMemorySearcher(searchItems())
+	tests := []struct {
+		name   string
+		query  string
+		limit  int
+		want   []string
+		scores []float64
+	}{
+		// whole word in name, word starting with it in name, tag (tie on score goes by
+		// name), description. a word merely containing it doesn't count
+		{"name over tags over description", "burger", 10,
+			[]string{"Cheese Burger", "Burgers Deluxe", "Chicken Wrap", "Garden Salad"},
+			[]float64{nameWeight, nameWeight / 2, tagWeight, descriptionWeight}},
+		{"every term adds up", "cheese burger", 10,
+			[]string{"Cheese Burger", "Burgers Deluxe", "Chicken Wrap", "Garden Salad"},
+			[]float64{2 * nameWeight, nameWeight / 2, tagWeight, descriptionWeight}},
+		{"case and punctuation ignored", "PATTY!", 10,
+			[]string{"Cheese Burger"}, []float64{descriptionWeight}},
+		{"limit keeps the best", "burger", 2,
+			[]string{"Cheese Burger", "Burgers Deluxe"}, []float64{nameWeight, nameWeight / 2}},
+		{"no match", "pizza", 10, []string{}, []float64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits, err := searcher.Search(context.Background(), test.query, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hitNames(hits); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for idx, hit := range hits {
+				if hit.Score != test.scores[idx] {
+					t.Errorf("%s scored %v, want %v", hit.Name, hit.Score, test.scores[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryAutocomplete(t *testing.T) {
+	searcher := NewMemorySearcher(searchItems())
+	tests := []struct {
+		name   string
+		prefix string
+		limit  int
+		want   []string
+	}{
+		// start of any word, most popular first; not inside a word (hamburger)
+		{"start of any word", "bur", 10, []string{"Burgers Deluxe", "Cheese Burger"}},
+		{"case ignored", "BUR", 10, []string{"Burgers Deluxe", "Cheese Burger"}},
+		{"across words", "cheese b", 10, []string{"Cheese Burger"}},
+		{"limit keeps the most popular", "bur", 1, []string{"Burgers Deluxe"}},
+		// an empty prefix starts every name
+		{"equal popularity by name", "", 3,
+			[]string{"Hamburger Platter", "Burgers Deluxe", "Chicken Wrap"}},
+		{"no match", "pizza", 10, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names, err := searcher.Autocomplete(context.Background(), test.prefix, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("got %v, want %v", names, test.want)
+			}
+		})
+	}
+}
+
+func TestMemorySearcherOnlyOrderable(t *testing.T) {
+	searcher := NewMemorySearcher(searchItems())
+	for _, query := range []string{"special", "old"} {
+		hits, err := searcher.Search(context.Background(), query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 0 {
+			t.Errorf("search %q found %v, unavailable and deleted items can't be ordered",
+				query, hitNames(hits))
+		}
+	}
+	names, err := searcher.Autocomplete(context.Background(), "special", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("autocomplete suggested %v", names)
+	}
+
+	// a refresh replaces the index, an item made unavailable drops out of it
+	items := searchItems()
+	items[0].Availability = false
+	searcher.Refresh(items)
+	hits, err := searcher.Search(context.Background(), "cheese", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 {
+		t.Errorf("found %v after it became unavailable", hitNames(hits))
+	}
+	items[5].Availability = true
+	searcher.Refresh(items)
+	names, err = searcher.Autocomplete(context.Background(), "special", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"Burger Special"}) {
+		t.Errorf("got %v after it became available", names)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -21,10 +23,23 @@ import (
 
 var sessionCollection *mongo.Collection
 var userCollection *mongo.Collection
+var magicLinkCollection *mongo.Collection
+var legalCollection *mongo.Collection
+var jobCollection *mongo.Collection
 var authCollections []*mongo.Collection
 
 var itemCollection *mongo.Collection
 var cartCollection *mongo.Collection
+var categoryCollection *mongo.Collection
+var reservationCollection *mongo.Collection
+var orderCollection *mongo.Collection
+var stockEventCollection *mongo.Collection
+var menuVersionCollection *mongo.Collection
+var menuStateCollection *mongo.Collection
+var reviewCollection *mongo.Collection
+var recommendationCollection *mongo.Collection
+var priceChangeCollection *mongo.Collection
+var menuPublisher *content.MenuPublisher   // the menu customers see, see content/publish.go
 var contentCollections []*mongo.Collection // db collections for content routes
 
 func init() {
@@ -33,6 +48,12 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the auth package's settings (SALT, password policy, passkeys, mail) may sit in
+	// ./auth/.env; the package itself reads only the environment
+	err = godotenv.Load("./auth/.env")
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
 
 	// mongoClient represents connection to mongo instance
 	mongoClient, err := mongo.Connect(context.TODO(),
@@ -49,10 +70,22 @@ func init() {
 	}
 
 	collectionExists := map[string]bool{
-		"sessions": false,
-		"users":    false,
-		"items":    false,
-		"carts":    false,
+		"sessions":        false,
+		"users":           false,
+		"magicLinks":      false,
+		"legalDocuments":  false,
+		"jobs":            false,
+		"items":           false,
+		"carts":           false,
+		"categories":      false,
+		"reservations":    false,
+		"orders":          false,
+		"stockEvents":     false,
+		"menuVersions":    false,
+		"menuState":       false,
+		"reviews":         false,
+		"recommendations": false,
+		"priceChanges":    false,
 	}
 	for _, collection := range collectionNames {
 		collectionExists[collection] = true
@@ -69,11 +102,110 @@ func init() {
 	authCollections = append(authCollections, sessionCollection)
 	userCollection = testDB.Collection("users")
 	authCollections = append(authCollections, userCollection)
+	magicLinkCollection = testDB.Collection("magicLinks")
+	authCollections = append(authCollections, magicLinkCollection)
+	legalCollection = testDB.Collection("legalDocuments")
+	authCollections = append(authCollections, legalCollection)
+	// mongo deletes magic links itself once the rate limit stops counting them
+	if err = auth.EnsureMagicLinkIndexes(magicLinkCollection); err != nil {
+		log.Fatal(err)
+	}
 
 	itemCollection = testDB.Collection("items")
 	contentCollections = append(contentCollections, itemCollection)
+	if err = content.EnsureItemIndexes(itemCollection); err != nil {
+		log.Fatal(err)
+	}
 	cartCollection = testDB.Collection("carts")
 	contentCollections = append(contentCollections, cartCollection)
+	categoryCollection = testDB.Collection("categories")
+	contentCollections = append(contentCollections, categoryCollection)
+	// cart writes look up the session's user
+	contentCollections = append(contentCollections, sessionCollection)
+	reservationCollection = testDB.Collection("reservations")
+	contentCollections = append(contentCollections, reservationCollection)
+	if err = content.EnsureReservationIndexes(reservationCollection); err != nil {
+		log.Fatal(err)
+	}
+	orderCollection = testDB.Collection("orders")
+	contentCollections = append(contentCollections, orderCollection)
+	stockEventCollection = testDB.Collection("stockEvents")
+	if err = content.EnsureCategoryIndexes(categoryCollection); err != nil {
+		log.Fatal(err)
+	}
+	if err = content.MigrateClassifications(itemCollection, categoryCollection); err != nil {
+		log.Fatal(err)
+	}
+	if err = content.MigrateCosts(itemCollection, content.DefaultCurrency()); err != nil {
+		log.Fatal(err)
+	}
+	if err = content.MigratePopularity(itemCollection); err != nil {
+		log.Fatal(err)
+	}
+	// items and categories above are the draft staff edit; customers get published versions
+	menuVersionCollection = testDB.Collection("menuVersions")
+	menuStateCollection = testDB.Collection("menuState")
+	// price history of draft edits goes live with the version that carries them
+	priceChangeCollection = testDB.Collection("priceChanges")
+	if err = content.EnsurePriceIndexes(priceChangeCollection); err != nil {
+		log.Fatal(err)
+	}
+	menuPublisher = &content.MenuPublisher{Drafts: itemCollection,
+		DraftCategories: categoryCollection, Versions: menuVersionCollection,
+		State: menuStateCollection, Prices: priceChangeCollection,
+		TextIndex: os.Getenv("SEARCH_BACKEND") != "memory"}
+	if err = menuPublisher.EnsurePublished(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+
+	reviewCollection = testDB.Collection("reviews")
+	if err = content.EnsureReviewIndexes(reviewCollection); err != nil {
+		log.Fatal(err)
+	}
+	recommendationCollection = testDB.Collection("recommendations")
+	// carts and checkout price lines with scheduled prices too
+	contentCollections = append(contentCollections, priceChangeCollection)
+
+	jobCollection = testDB.Collection("jobs")
+}
+
+// every collection holding documents about a user, for data export and erasure.
+// new collections with personal data (orders...) need adding here. reservations aren't:
+// they hold a session id, item and quantity and no user, erasure deletes the sessions
+// they point to, and ExpireReservationsEvery removes them within CART_RESERVATION_MINUTES
+// while handing their stock back (deleting them here would leave reserved counts high)
+func personalDataSources() []auth.PersonalDataSource {
+	return []auth.PersonalDataSource{
+		{Collection: userCollection, UserField: "user", OnErase: auth.ErasePseudonymise},
+		{Collection: sessionCollection, UserField: "user", OnErase: auth.EraseDelete},
+		{Collection: magicLinkCollection, UserField: "user", OnErase: auth.EraseDelete},
+		{Collection: cartCollection, UserField: "user", OnErase: auth.EraseDelete},
+		{Collection: orderCollection, UserField: "user", OnErase: auth.ErasePseudonymise},
+		// review text is the user's own words, so it goes rather than being kept anonymous
+		{Collection: reviewCollection, UserField: "user", OnErase: auth.EraseDelete},
+	}
+}
+
+// SEARCH_BACKEND=memory for mongo deployments without text indexes
+func menuSearcher() content.MenuSearcher {
+	if os.Getenv("SEARCH_BACKEND") == "memory" {
+		searcher := content.NewMemorySearcher(nil)
+		go searcher.RefreshEvery(context.Background(), time.Minute, menuPublisher, itemCollection)
+		return searcher
+	}
+	// every published version gets its own text index, see MenuPublisher.TextIndex
+	return content.MongoSearcher{Menu: menuPublisher, Items: itemCollection}
+}
+
+// MENU_CACHE=off reads the menu from mongo on every request
+func menuCache() content.MenuCache {
+	if os.Getenv("MENU_CACHE") == "off" {
+		return &content.NoMenuCache{Menu: menuPublisher, Items: itemCollection,
+			Reviews: reviewCollection, Prices: priceChangeCollection}
+	}
+	cache := content.NewMemoryMenuCache(menuPublisher, reviewCollection, priceChangeCollection)
+	go cache.Run(context.Background())
+	return cache
 }
 
 func chainMiddleware(baseHandler http.Handler,
@@ -97,17 +229,137 @@ func readCountAuthedUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	// go run . export|import ..., see cli.go
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	router := mux.NewRouter()
 	// CORS access for frontend running on port 3000
 	// use http://localhost:3000 for testing
 	router.Use(handlers.CORS(handlers.AllowedOrigins([]string{"*"})))
 
+	blobStore, err := content.LoadBlobStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// local uploads are served by this api, before /api/v1 so the subrouter doesn't claim them
+	if localStore, isLocal := blobStore.(*content.LocalBlobStore); isLocal &&
+		strings.HasPrefix(localStore.BaseURL, "/") {
+		router.PathPrefix(strings.TrimSuffix(localStore.BaseURL, "/")+"/").
+			Handler(localStore.Handler()).Methods("GET", "HEAD")
+	}
+
+	stockEvents := content.CollectionStockEvents{Events: stockEventCollection}
+	go content.ExpireReservationsEvery(context.Background(), time.Minute,
+		itemCollection, reservationCollection)
+	go menuPublisher.PublishDueEvery(context.Background(), time.Minute)
+	go content.ApplyPriceChangesEvery(context.Background(), time.Minute,
+		itemCollection, priceChangeCollection)
+	customerMenu := menuCache()
+	go content.BuildRecommendationsEvery(context.Background(), time.Hour,
+		recommendationCollection, cartCollection, orderCollection)
+
 	apiV1Router := router.PathPrefix("/api/v1").Subrouter()
 	v1AuthRouter := apiV1Router.PathPrefix("/auth").Subrouter()
 	v1ContentRouter := apiV1Router.PathPrefix("/content").Subrouter()
+	v1MeRouter := apiV1Router.PathPrefix("/me").Subrouter()
+	v1AdminRouter := apiV1Router.PathPrefix("/admin").Subrouter()
 
 	v1AuthRouter.Handle("/register", auth.Register(authCollections...)).Methods("POST")
 	v1AuthRouter.Handle("/login", auth.Login(authCollections...)).Methods("POST")
+	v1AuthRouter.Handle("/legal", auth.GetLegalDocuments(legalCollection)).Methods("GET")
+	v1AuthRouter.Handle("/consent", auth.AcceptConsent(sessionCollection,
+		userCollection, legalCollection)).Methods("POST")
+	v1AuthRouter.Handle("/magic-link",
+		auth.RequestMagicLink(auth.LoadMailer(), authCollections...)).Methods("POST")
+	v1AuthRouter.Handle("/magic-link/callback",
+		auth.MagicLinkCallback(authCollections...)).Methods("GET")
+	v1AuthRouter.Handle("/webauthn/register/begin",
+		auth.WebAuthnRegisterBegin(authCollections...)).Methods("POST")
+	v1AuthRouter.Handle("/webauthn/register/finish",
+		auth.WebAuthnRegisterFinish(authCollections...)).Methods("POST")
+	v1AuthRouter.Handle("/webauthn/login/begin",
+		auth.WebAuthnLoginBegin(authCollections...)).Methods("POST")
+	v1AuthRouter.Handle("/webauthn/login/finish",
+		auth.WebAuthnLoginFinish(authCollections...)).Methods("POST")
+
+	// no ConsentMiddleware: data subject rights don't depend on accepting new terms
+	v1MeRouter.Use(auth.AuthMiddleware(sessionCollection))
+	v1MeRouter.Handle("/export", auth.RequestExport(personalDataSources(),
+		sessionCollection, jobCollection)).Methods("POST")
+	v1MeRouter.Handle("/erase", auth.RequestErasure(personalDataSources(),
+		sessionCollection, userCollection, jobCollection)).Methods("POST")
+	v1MeRouter.Handle("/jobs/{id}",
+		auth.GetJobStatus(sessionCollection, jobCollection)).Methods("GET")
+	v1MeRouter.Handle("/jobs/{id}/download",
+		auth.DownloadExport(sessionCollection, jobCollection)).Methods("GET")
+
+	v1AdminRouter.Use(auth.AuthMiddleware(sessionCollection))
+	v1AdminRouter.Use(auth.StaffMiddleware(sessionCollection, userCollection))
+	v1AdminRouter.Handle("/items",
+		content.ListItemsAdmin(itemCollection, categoryCollection)).Methods("GET")
+	v1AdminRouter.Handle("/items",
+		content.CreateItem(itemCollection, categoryCollection, priceChangeCollection)).Methods("POST")
+	v1AdminRouter.Handle("/items/export",
+		content.ExportItemsHandler(itemCollection, categoryCollection)).Methods("GET")
+	v1AdminRouter.Handle("/items/import",
+		content.ImportItemsHandler(itemCollection, categoryCollection, priceChangeCollection)).
+		Methods("POST")
+	v1AdminRouter.Handle("/items/{id}",
+		content.ReplaceItem(itemCollection, categoryCollection, priceChangeCollection)).Methods("PUT")
+	v1AdminRouter.Handle("/items/{id}",
+		content.PatchItem(itemCollection, categoryCollection, priceChangeCollection)).
+		Methods("PATCH")
+	v1AdminRouter.Handle("/items/{id}", content.DeleteItem(itemCollection)).Methods("DELETE")
+	v1AdminRouter.Handle("/items/{id}/restore",
+		content.RestoreItem(itemCollection)).Methods("POST")
+	v1AdminRouter.Handle("/items/{id}/images",
+		content.UploadItemImage(blobStore, content.LoadImagePolicy(), itemCollection)).
+		Methods("POST")
+	v1AdminRouter.Handle("/items/{id}/images/{imageId}",
+		content.DeleteItemImage(blobStore, itemCollection)).Methods("DELETE")
+	v1AdminRouter.Handle("/items/{id}/stock",
+		content.SetItemStock(stockEvents, itemCollection, reservationCollection)).Methods("PUT")
+	v1AdminRouter.Handle("/items/{id}/prices",
+		content.ItemPricesHandler(priceChangeCollection)).Methods("GET")
+	v1AdminRouter.Handle("/items/{id}/prices", content.SchedulePriceChange(itemCollection,
+		priceChangeCollection, sessionCollection)).Methods("POST")
+	v1AdminRouter.Handle("/items/{id}/prices/{changeId}",
+		content.CancelPriceChange(priceChangeCollection)).Methods("DELETE")
+	v1AdminRouter.Handle("/categories",
+		content.CreateCategory(categoryCollection)).Methods("POST")
+	v1AdminRouter.Handle("/categories/{id}",
+		content.ReplaceCategory(categoryCollection)).Methods("PUT")
+	v1AdminRouter.Handle("/items/{id}/translations/{lang}",
+		content.PutItemTranslation(itemCollection)).Methods("PUT")
+	v1AdminRouter.Handle("/items/{id}/translations/{lang}",
+		content.DeleteItemTranslation(itemCollection)).Methods("DELETE")
+	v1AdminRouter.Handle("/categories/{id}/translations/{lang}",
+		content.CategoryTranslationHandler(categoryCollection)).Methods("PUT", "DELETE")
+	v1AdminRouter.Handle("/translations/missing",
+		content.MissingTranslationsHandler(itemCollection, categoryCollection)).Methods("GET")
+	v1AdminRouter.Handle("/menu/preview", content.GetMenuHandler(&content.NoMenuCache{
+		Menu:    content.DraftMenu{Items: itemCollection, Categories: categoryCollection},
+		Items:   itemCollection,
+		Reviews: reviewCollection})).Methods("GET")
+	v1AdminRouter.Handle("/menu/cache",
+		content.MenuCacheStatsHandler(customerMenu)).Methods("GET")
+	v1AdminRouter.Handle("/menu/versions",
+		content.ListMenuVersions(menuPublisher)).Methods("GET")
+	v1AdminRouter.Handle("/menu/publish",
+		content.PublishMenu(menuPublisher, sessionCollection)).Methods("POST")
+	v1AdminRouter.Handle("/menu/versions/{version}/publish",
+		content.ActivateMenuVersion(menuPublisher)).Methods("POST")
+	v1AdminRouter.Handle("/menu/versions/{version}",
+		content.CancelMenuVersion(menuPublisher)).Methods("DELETE")
+	v1AdminRouter.Handle("/reviews", content.ReviewQueue(reviewCollection)).Methods("GET")
+	v1AdminRouter.Handle("/reviews/{reviewId}/approve",
+		content.ModerateReview(content.ReviewApproved, reviewCollection, sessionCollection)).
+		Methods("POST")
+	v1AdminRouter.Handle("/reviews/{reviewId}/hide",
+		content.ModerateReview(content.ReviewHidden, reviewCollection, sessionCollection)).
+		Methods("POST")
 
 	v1ContentRouter.
 		// type http.HandlerFunc implements serveHTTP method;
@@ -118,16 +370,41 @@ func main() {
 		Methods("GET")
 	// set middleware first
 	v1ContentRouter.Use(auth.AuthMiddleware(sessionCollection))
+	// after AuthMiddleware: needs a valid session to know whose consents to check
+	v1ContentRouter.Use(auth.ConsentMiddleware(sessionCollection,
+		userCollection, legalCollection))
 	v1ContentRouter.Handle("/cart",
 		content.GetCartByUserSession(contentCollections...)).
 		Methods("GET")
 	v1ContentRouter.
 		Handle("/menu",
-			content.GetMenuHandler(contentCollections...)).
+			content.GetMenuHandler(customerMenu)).
+		Methods("GET")
+	v1ContentRouter.Handle("/categories",
+		content.GetCategoriesHandler(customerMenu)).Methods("GET")
+	searcher := menuSearcher()
+	v1ContentRouter.Handle("/menu/search",
+		content.SearchMenuHandler(searcher, customerMenu)).Methods("GET")
+	v1ContentRouter.Handle("/menu/autocomplete",
+		content.AutocompleteMenuHandler(searcher)).Methods("GET")
+	v1ContentRouter.Handle("/menu/{id}/reviews",
+		content.ListItemReviews(reviewCollection, sessionCollection)).Methods("GET")
+	v1ContentRouter.Handle("/menu/{id}/reviews", content.CreateReview(reviewCollection,
+		itemCollection, orderCollection, sessionCollection)).Methods("POST")
+	v1ContentRouter.Handle("/reviews/{reviewId}",
+		content.UpdateReview(reviewCollection, sessionCollection)).Methods("PUT")
+	v1ContentRouter.Handle("/reviews/{reviewId}",
+		content.DeleteReview(reviewCollection, sessionCollection)).Methods("DELETE")
+	v1ContentRouter.Handle("/menu/{id}/recommendations",
+		content.ItemRecommendationsHandler(customerMenu, recommendationCollection)).
 		Methods("GET")
+	v1ContentRouter.Handle("/cart/recommendations", content.CartRecommendationsHandler(
+		customerMenu, recommendationCollection, cartCollection)).Methods("GET")
 	v1ContentRouter.Handle("/cart-upsert",
-		content.PutUpsertCartSync(contentCollections...)).
+		content.PutUpsertCartSync(menuPublisher, contentCollections...)).
 		Methods("PUT")
+	v1ContentRouter.Handle("/checkout",
+		content.PlaceOrder(menuPublisher, stockEvents, contentCollections...)).Methods("POST")
 
 	log.Fatal(http.ListenAndServe(":8080", router))
 }